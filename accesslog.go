@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Access log formats selected with -access-log-format
+const (
+	AccessLogCommon   = "clf"
+	AccessLogCombined = "combined"
+)
+
+// clfTime is the timestamp layout of Apache and nginx access logs
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// accessLog receives one line per request, apart from the event log so pipelines can tell them apart
+var accessLog = log.New(os.Stdout, "", 0)
+
+// clfEscaper keeps quoted fields on one line and their quotes balanced
+var clfEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+
+// logAccess writes an access log line for every request once it is done, in Common Log Format or,
+// with -access-log-format=combined, with the referer and user agent appended
+func (s *Server) logAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := s.config().AccessLogFormat
+		if format == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		user := "-"
+		if u, _, ok := r.BasicAuth(); ok && u != "" {
+			user = clfEscaper.Replace(u)
+		}
+		bytes := "-"
+		if rec.bytes > 0 {
+			bytes = fmt.Sprint(rec.bytes)
+		}
+		line := fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s`, s.getClientIP(r), user, start.Format(clfTime),
+			clfEscaper.Replace(r.Method), clfEscaper.Replace(r.RequestURI), r.Proto, rec.statusCode(), bytes)
+		if format == AccessLogCombined {
+			line += fmt.Sprintf(` "%s" "%s"`, clfField(r.Referer()), clfField(r.UserAgent()))
+		}
+		accessLog.Print(line)
+	})
+}
+
+// clfField escapes a quoted combined log field, using "-" for empty values
+func clfField(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return clfEscaper.Replace(v)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// captureAccessLog sends the access log to a buffer until the test ends
+func captureAccessLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	accessLog.SetOutput(buf)
+	t.Cleanup(func() { accessLog.SetOutput(io.Discard) })
+	return buf
+}
+
+func TestAccessLogLine(t *testing.T) {
+	// The timestamp is checked for its layout, the rest of the line exactly
+	const stamp = `\[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] `
+	tests := []struct {
+		name   string
+		format string
+		method string
+		path   string
+		header map[string]string
+		want   string
+	}{
+		{
+			// The byte count is what went on the wire, so compression is turned off
+			name: "download", format: AccessLogCommon, method: http.MethodGet, path: "/download?size=100",
+			header: map[string]string{"Accept-Encoding": "identity"},
+			want:   `^127\.0\.0\.1 - - ` + stamp + `"GET /download\?size=100 HTTP/1\.1" 200 100$`,
+		},
+		{
+			name: "not found", format: AccessLogCommon, method: http.MethodGet, path: "/nope",
+			want: `^127\.0\.0\.1 - - ` + stamp + `"GET /nope HTTP/1\.1" 404 \d+$`,
+		},
+		{
+			name: "no body", format: AccessLogCommon, method: http.MethodHead, path: "/download?size=100",
+			header: map[string]string{"Accept-Encoding": "identity"},
+			want:   `^127\.0\.0\.1 - - ` + stamp + `"HEAD /download\?size=100 HTTP/1\.1" 200 -$`,
+		},
+		{
+			name: "basic auth user", format: AccessLogCommon, method: http.MethodGet, path: "/ping",
+			header: map[string]string{"Authorization": "Basic YWxpY2U6c2VjcmV0"},
+			want:   `^127\.0\.0\.1 - alice ` + stamp + `"GET /ping HTTP/1\.1" 200 \d+$`,
+		},
+		{
+			name: "combined", format: AccessLogCombined, method: http.MethodGet, path: "/ping",
+			header: map[string]string{"Referer": "http://example.com/", "User-Agent": `tester "1.0"`},
+			want:   `^127\.0\.0\.1 - - ` + stamp + `"GET /ping HTTP/1\.1" 200 \d+ "http://example\.com/" "tester \\"1\.0\\""$`,
+		},
+		{
+			name: "combined without referer", format: AccessLogCombined, method: http.MethodGet, path: "/ping",
+			header: map[string]string{"User-Agent": "tester"},
+			want:   `^127\.0\.0\.1 - - ` + stamp + `"GET /ping HTTP/1\.1" 200 \d+ "-" "tester"$`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.AccessLogFormat = tt.format
+			_, ts := newTestServer(t, cfg)
+			logs := captureAccessLog(t)
+
+			req := newRequest(t, tt.method, ts.URL+tt.path, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			fetch(t, req)
+
+			// The line is written once the handler returns, which may be just after the client has the response
+			var line string
+			for i := 0; i < 100 && line == ""; i++ {
+				line = strings.TrimSuffix(logs.String(), "\n")
+				if line == "" {
+					waitABit()
+				}
+			}
+			if !regexp.MustCompile(tt.want).MatchString(line) {
+				t.Errorf("access log line\n%s\ndoes not match\n%s", line, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	logs := captureAccessLog(t)
+	fetch(t, newRequest(t, http.MethodGet, ts.URL+"/ping", nil))
+	if got := logs.String(); got != "" {
+		t.Errorf("access log written without -access-log-format: %q", got)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// secretEqual compares secrets in constant time; hashing first keeps the length from leaking too
+func secretEqual(given, want string) bool {
+	g, w := sha256.Sum256([]byte(given)), sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(g[:], w[:]) == 1
+}
+
+// authorized reports whether r carries the configured bearer token or Basic credentials.
+// With both configured either one is accepted.
+func (s *Server) authorized(r *http.Request) bool {
+	cfg := s.config()
+	if cfg.AuthToken != "" {
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if strings.EqualFold(scheme, "Bearer") && secretEqual(token, cfg.AuthToken) {
+			return true
+		}
+	}
+	if cfg.BasicUser != "" {
+		// Both halves are always compared so a wrong user takes as long as a wrong password
+		user, pass, ok := r.BasicAuth()
+		userOK, passOK := secretEqual(user, cfg.BasicUser), secretEqual(pass, cfg.BasicPass)
+		if ok && userOK && passOK {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAuth rejects unauthenticated requests with 401 when -auth-token or -basic-user is set
+func (s *Server) requireAuth(next http.Handler) http.Handler {
+	cfg := s.config()
+	if cfg.AuthToken == "" && cfg.BasicUser == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if healthPaths[r.URL.Path] || s.authorized(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		logWarn("AUTH_FAILED", "Client", s.getClientIP(r), "RequestID", requestIDFromContext(r.Context()),
+			"URL", r.URL.Path, "Scheme", scheme)
+		if cfg.AuthToken != "" {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="echo-stream"`)
+		}
+		if cfg.BasicUser != "" {
+			w.Header().Add("WWW-Authenticate", `Basic realm="echo-stream", charset="UTF-8"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBearerAuth(t *testing.T) {
+	_, ts := newTestServer(t, testConfig(t, "-auth-token", "s3cret"))
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		want          int
+	}{
+		{"missing token", "/download?size=10", "", http.StatusUnauthorized},
+		{"wrong token", "/download?size=10", "Bearer wrong", http.StatusUnauthorized},
+		{"token prefix", "/download?size=10", "Bearer s3cre", http.StatusUnauthorized},
+		{"wrong scheme", "/download?size=10", "Token s3cret", http.StatusUnauthorized},
+		{"correct token", "/download?size=10", "Bearer s3cret", http.StatusOK},
+		{"scheme is case-insensitive", "/download?size=10", "bearer s3cret", http.StatusOK},
+		{"health stays open", "/health", "", http.StatusOK},
+		{"livez stays open", "/livez", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+tt.path, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			resp, _ := fetch(t, req)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != `Bearer realm="echo-stream"` {
+				t.Errorf("WWW-Authenticate = %q", resp.Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	_, ts := newTestServer(t, testConfig(t, "-basic-user", "alice", "-basic-pass", "hunter2"))
+
+	tests := []struct {
+		name       string
+		user, pass string
+		send       bool
+		want       int
+	}{
+		{"correct credentials", "alice", "hunter2", true, http.StatusOK},
+		{"wrong password", "alice", "wrong", true, http.StatusUnauthorized},
+		{"wrong user", "bob", "hunter2", true, http.StatusUnauthorized},
+		{"no credentials", "", "", false, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, http.MethodPost, ts.URL+"/upload", nil)
+			if tt.send {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			resp, _ := fetch(t, req)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			challenge := resp.Header.Get("WWW-Authenticate")
+			if tt.want == http.StatusUnauthorized && challenge != `Basic realm="echo-stream", charset="UTF-8"` {
+				t.Errorf("WWW-Authenticate = %q, want a Basic challenge", challenge)
+			}
+			if tt.want == http.StatusOK && challenge != "" {
+				t.Errorf("WWW-Authenticate = %q on success", challenge)
+			}
+		})
+	}
+
+	if resp, _ := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/readyz", nil)); resp.StatusCode != http.StatusOK {
+		t.Errorf("/readyz without credentials = %d, want 200", resp.StatusCode)
+	}
+}
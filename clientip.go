@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies parses a comma-separated list of CIDRs such as "10.0.0.0/8,192.168.1.5/32".
+// A bare IP is treated as a single-address range.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// trustsProxy reports whether forwarding headers sent by peer may be honored.
+// With no trusted proxies configured no peer is trusted, so clients cannot spoof their address.
+func (s *Server) trustsProxy(peer string) bool {
+	cfg := s.config()
+	ip := net.ParseIP(peer)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range cfg.TrustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientIP extracts the real client IP from various headers when the
+// request came through a trusted proxy, otherwise it uses the socket peer
+func (s *Server) getClientIP(r *http.Request) string {
+	peer := normalizeIP(r.RemoteAddr)
+	if !s.trustsProxy(peer) {
+		return peer
+	}
+
+	// Check Cloudflare/Load balancer headers first
+	if ip := r.Header.Get("CF-Connecting-IP"); ip != "" {
+		return normalizeIP(ip)
+	}
+	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
+		return normalizeIP(forwardedClient(strings.Split(ip, ","), s.config().ForwardedHops))
+	}
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return normalizeIP(ip)
+	}
+
+	// Fall back to remote address
+	return peer
+}
+
+// normalizeIP reduces an address from a socket or forwarding header to its canonical IP, accepting
+// "1.2.3.4", "1.2.3.4:80", "::1", "[::1]" and "[::1]:1234". IPv4-mapped IPv6 addresses come back
+// as IPv4, so a client has the same identity on dual-stack sockets. Anything that is not an IP
+// is returned trimmed but otherwise as is, so it still shows up in logs.
+func normalizeIP(addr string) string {
+	addr = strings.TrimSpace(addr)
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
+// Response headers set by debugClientIP
+const (
+	DetectedClientIPHeader = "X-Detected-Client-IP"
+	RemoteAddrHeader       = "X-Remote-Addr"
+)
+
+// debugClientIP reports the client IP the server resolved, and the socket address it resolved it from,
+// so trusted-proxy and forwarded-hops settings can be checked from the client side
+func (s *Server) debugClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config().DebugClientIP {
+			w.Header().Set(DetectedClientIPHeader, s.getClientIP(r))
+			w.Header().Set(RemoteAddrHeader, r.RemoteAddr)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClient picks the client from X-Forwarded-For entries. With hops set to the number of
+// trusted proxies in front of the server, it takes the hops-th entry from the right, skipping the
+// hops-1 addresses appended by inner proxies, so spoofed leftmost entries are ignored. Zero hops
+// keeps the legacy behavior of taking the leftmost entry.
+func forwardedClient(ips []string, hops int) string {
+	i := 0
+	if hops > 0 {
+		i = len(ips) - hops
+		if i < 0 {
+			i = 0
+		}
+	}
+	return strings.TrimSpace(ips[i])
+}
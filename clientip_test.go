@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	cfg := testConfig(t, "-trusted-proxies", "10.0.0.0/8,192.0.2.1")
+	s := NewServer(cfg)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		value      string
+		want       string
+	}{
+		{"trusted proxy forwards XFF", "10.1.2.3:4000", "X-Forwarded-For", "198.51.100.7", "198.51.100.7"},
+		{"trusted single address", "192.0.2.1:4000", "X-Real-IP", "198.51.100.7", "198.51.100.7"},
+		{"trusted proxy without header", "10.1.2.3:4000", "", "", "10.1.2.3"},
+		{"untrusted client spoofs XFF", "203.0.113.9:4000", "X-Forwarded-For", "198.51.100.7", "203.0.113.9"},
+		{"untrusted client spoofs CF header", "203.0.113.9:4000", "CF-Connecting-IP", "198.51.100.7", "203.0.113.9"},
+		{"untrusted client spoofs X-Real-IP", "192.0.2.2:4000", "X-Real-IP", "198.51.100.7", "192.0.2.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			if got := s.getClientIP(r); got != tt.want {
+				t.Errorf("getClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	for _, list := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.0/8,bogus"} {
+		if _, err := parseTrustedProxies(list); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded, want an error", list)
+		}
+	}
+}
+
+func TestForwardedHops(t *testing.T) {
+	const xff = "1.1.1.1, 2.2.2.2, 3.3.3.3"
+	tests := []struct {
+		hops int
+		want string
+	}{
+		{0, "1.1.1.1"},
+		{1, "3.3.3.3"},
+		{2, "2.2.2.2"},
+		{3, "1.1.1.1"},
+		{5, "1.1.1.1"},
+	}
+	for _, tt := range tests {
+		s := NewServer(testConfig(t, "-forwarded-hops", strconv.Itoa(tt.hops), "-trusted-proxies", "192.0.2.1"))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Forwarded-For", xff)
+		if got := s.getClientIP(r); got != tt.want {
+			t.Errorf("hops %d: getClientIP = %q, want %q", tt.hops, got, tt.want)
+		}
+	}
+}
+
+func TestDebugClientIPHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		xff    string
+		wantIP string
+	}{
+		{"forwarded through a trusted proxy", []string{"-debug-client-ip", "-trusted-proxies", "127.0.0.1"},
+			"198.51.100.7, 127.0.0.1", "198.51.100.7"},
+		{"forwarded hops", []string{"-debug-client-ip", "-trusted-proxies", "127.0.0.1", "-forwarded-hops", "1"},
+			"6.6.6.6, 198.51.100.7", "198.51.100.7"},
+		{"untrusted peer", []string{"-debug-client-ip", "-trusted-proxies", "10.0.0.0/8"},
+			"198.51.100.7", "127.0.0.1"},
+		{"disabled", nil, "198.51.100.7", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ts := newTestServer(t, testConfig(t, tt.args...))
+			req := newRequest(t, http.MethodGet, ts.URL+"/ping", nil)
+			req.Header.Set("X-Forwarded-For", tt.xff)
+			resp, _ := fetch(t, req)
+
+			if got := resp.Header.Get(DetectedClientIPHeader); got != tt.wantIP {
+				t.Errorf("%s = %q, want %q", DetectedClientIPHeader, got, tt.wantIP)
+			}
+			remote := resp.Header.Get(RemoteAddrHeader)
+			if tt.wantIP == "" {
+				if remote != "" {
+					t.Errorf("%s = %q while disabled", RemoteAddrHeader, remote)
+				}
+				return
+			}
+			if host, _, err := net.SplitHostPort(remote); err != nil || host != "127.0.0.1" {
+				t.Errorf("%s = %q, want the test client's address", RemoteAddrHeader, remote)
+			}
+		})
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:4000", "192.0.2.1"},
+		{" 192.0.2.1 ", "192.0.2.1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"[::ffff:192.0.2.1]:4000", "192.0.2.1"},
+		{"::1", "::1"},
+		{"[::1]", "::1"},
+		{"[::1]:1234", "::1"},
+		{"2001:DB8:0:0::1", "2001:db8::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"unknown", "unknown"},
+	}
+	for _, tt := range tests {
+		if got := normalizeIP(tt.in); got != tt.want {
+			t.Errorf("normalizeIP(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestClientIPFromIPv6Headers(t *testing.T) {
+	s := NewServer(testConfig(t, "-trusted-proxies", "::1"))
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		value      string
+		want       string
+	}{
+		{"IPv4 peer", "192.0.2.1:4000", "", "", "192.0.2.1"},
+		{"IPv4-mapped peer", "[::ffff:192.0.2.1]:4000", "", "", "192.0.2.1"},
+		{"IPv6 peer", "[2001:db8::1]:4000", "", "", "2001:db8::1"},
+		{"XFF with an IPv4 port", "[::1]:4000", "X-Forwarded-For", "198.51.100.7:5555", "198.51.100.7"},
+		{"XFF with a bracketed IPv6 address", "[::1]:4000", "X-Forwarded-For", "[2001:db8::7]:5555, 10.0.0.1", "2001:db8::7"},
+		{"X-Real-IP IPv4-mapped", "[::1]:4000", "X-Real-IP", "::ffff:198.51.100.7", "198.51.100.7"},
+		{"CF header bracketed", "[::1]:4000", "CF-Connecting-IP", "[2001:db8::8]", "2001:db8::8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			if got := s.getClientIP(r); got != tt.want {
+				t.Errorf("getClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpoofedHeadersIgnoredByDefault(t *testing.T) {
+	cfg := testConfig(t, "-debug-client-ip", "-rate-limit", "1", "-rate-burst", "1")
+	_, ts := newTestServer(t, cfg)
+	tests := []struct {
+		header string
+		value  string
+	}{
+		{"X-Forwarded-For", "198.51.100.7"},
+		{"X-Forwarded-For", "198.51.100.8, 10.0.0.1"},
+		{"X-Real-IP", "198.51.100.9"},
+		{"CF-Connecting-IP", "198.51.100.10"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.header+" "+tt.value, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/ping", nil)
+			req.Header.Set(tt.header, tt.value)
+			resp, _ := fetch(t, req)
+			if got := resp.Header.Get(DetectedClientIPHeader); got != "127.0.0.1" {
+				t.Errorf("%s = %q, want the socket peer", DetectedClientIPHeader, got)
+			}
+			// A new claimed address each time still draws from the one bucket of the real peer
+			if want := http.StatusTooManyRequests; i > 0 && resp.StatusCode != want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the runtime tunables for the server.
+//
+// Values are resolved in order of precedence, highest first:
+//  1. command-line flags (e.g. -port, -buffer-size)
+//  2. environment variables (e.g. ECHO_PORT, ECHO_BUFFER_SIZE)
+//  3. the compiled defaults
+type Config struct {
+	Port                string
+	ReadTimeout         time.Duration
+	WriteTimeout        time.Duration
+	IdleTimeout         time.Duration
+	BufferSize          int
+	MaxUploadSize       int
+	MaxDownloadSize     int
+	DefaultDownloadSize int
+	TLSCert             string
+	TLSKey              string
+	TLSSelfSigned       bool
+	Pprof               bool
+	LogFormat           string
+	LogLevel            string
+	MaxPerClient        int
+	MaxConcurrent       int
+	TrustedProxies      []*net.IPNet
+	ForwardedHops       int
+	WSIdleTimeout       time.Duration
+	TCPPort             string
+	TCPIdleTimeout      time.Duration
+	UDPPort             string
+	UDPMaxDatagram      int
+	ShutdownTimeout     time.Duration
+	DrainDelay          time.Duration
+	EchoSensitive       bool
+	CORSOrigins         []string
+	AuthToken           string
+	BasicUser           string
+	BasicPass           string
+	RateLimit           int
+	RateBurst           int
+	MaxEgress           int
+	MaxRequestDuration  time.Duration
+	UnixSocket          string
+	KeepAlive           time.Duration
+	H2C                 bool
+	EnvFile             string
+	DebugClientIP       bool
+	AccessLogFormat     string
+	LogFile             string
+	MaxHeaderBytes      int
+	MinThroughput       int
+	MinThroughputGrace  time.Duration
+	DebugPanics         bool
+	TLSClientCA         string
+	TLSMinVersion       string
+	TLSCipherSuites     string
+	EnableUpload        bool
+	EnableDownload      bool
+	EnableHealth        bool
+	MaxProcs            int
+	DownloadFile        string
+	MaxLifetime         time.Duration
+	ListenBacklog       int
+	ProxyProtocol       string
+	EnableIndex         bool
+	Prewarm             bool
+}
+
+// TLSEnabled reports whether a certificate and key or a self-signed certificate were configured
+func (c *Config) TLSEnabled() bool {
+	return (c.TLSCert != "" && c.TLSKey != "") || c.TLSSelfSigned
+}
+
+// DefaultConfig returns a Config populated with the compiled defaults
+func DefaultConfig() *Config {
+	return &Config{
+		Port:                ServerPort,
+		ReadTimeout:         ServerTimeout,
+		WriteTimeout:        ServerTimeout,
+		IdleTimeout:         ServerTimeout,
+		BufferSize:          DefaultBufferSize,
+		MaxUploadSize:       MaxUploadSize,
+		MaxDownloadSize:     MaxDownloadSize,
+		DefaultDownloadSize: DefaultDownloadSize,
+		LogFormat:           LogFormatText,
+		LogLevel:            "info",
+		WSIdleTimeout:       DefaultWSIdleTimeout,
+		TCPIdleTimeout:      DefaultTCPIdleTimeout,
+		UDPMaxDatagram:      DefaultUDPMaxDatagram,
+		ShutdownTimeout:     ShutdownTimeout,
+		KeepAlive:           DefaultKeepAlive,
+		MaxHeaderBytes:      http.DefaultMaxHeaderBytes,
+		MinThroughputGrace:  DefaultMinThroughputGrace,
+		TLSMinVersion:       DefaultTLSMinVersion,
+		EnableUpload:        true,
+		EnableDownload:      true,
+		EnableHealth:        true,
+		EnableIndex:         true,
+	}
+}
+
+// envVars are variables read from -env-file, consulted before the process environment
+type envVars map[string]string
+
+// get returns the -env-file value of key if the file sets it, or else the environment's
+func (e envVars) get(key string) string {
+	if v, ok := e[key]; ok {
+		return v
+	}
+	return os.Getenv(key)
+}
+
+// loadConfig resolves the configuration from the compiled defaults, then the
+// environment with the -env-file variables in env over it, then the given command-line arguments
+func loadConfig(args []string, env envVars) (*Config, error) {
+	cfg := DefaultConfig()
+	cfg.Port = envString(env, "ECHO_PORT", cfg.Port)
+	cfg.ReadTimeout = envDuration(env, "ECHO_READ_TIMEOUT", cfg.ReadTimeout)
+	cfg.WriteTimeout = envDuration(env, "ECHO_WRITE_TIMEOUT", cfg.WriteTimeout)
+	cfg.IdleTimeout = envDuration(env, "ECHO_IDLE_TIMEOUT", cfg.IdleTimeout)
+	cfg.BufferSize = envSize(env, "ECHO_BUFFER_SIZE", cfg.BufferSize)
+	cfg.MaxUploadSize = envSize(env, "ECHO_MAX_UPLOAD", cfg.MaxUploadSize)
+	cfg.MaxDownloadSize = envSize(env, "ECHO_MAX_DOWNLOAD", cfg.MaxDownloadSize)
+	cfg.DefaultDownloadSize = envSize(env, "ECHO_DEFAULT_DOWNLOAD", cfg.DefaultDownloadSize)
+	cfg.TLSCert = envString(env, "ECHO_TLS_CERT", cfg.TLSCert)
+	cfg.TLSKey = envString(env, "ECHO_TLS_KEY", cfg.TLSKey)
+	cfg.TLSSelfSigned = envBool(env, "ECHO_TLS_SELF_SIGNED", cfg.TLSSelfSigned)
+	cfg.TLSClientCA = envString(env, "ECHO_TLS_CLIENT_CA", cfg.TLSClientCA)
+	cfg.TLSMinVersion = envString(env, "ECHO_TLS_MIN_VERSION", cfg.TLSMinVersion)
+	cfg.TLSCipherSuites = envString(env, "ECHO_TLS_CIPHER_SUITES", cfg.TLSCipherSuites)
+	cfg.Pprof = envBool(env, "ECHO_PPROF", cfg.Pprof)
+	cfg.LogFormat = envString(env, "ECHO_LOG_FORMAT", cfg.LogFormat)
+	cfg.LogLevel = envString(env, "ECHO_LOG_LEVEL", cfg.LogLevel)
+	cfg.MaxPerClient = envInt(env, "ECHO_MAX_PER_CLIENT", cfg.MaxPerClient)
+	cfg.MaxConcurrent = envInt(env, "ECHO_MAX_CONCURRENT", cfg.MaxConcurrent)
+	trustedProxies := envString(env, "ECHO_TRUSTED_PROXIES", "")
+	cfg.ForwardedHops = envInt(env, "ECHO_FORWARDED_HOPS", cfg.ForwardedHops)
+	cfg.WSIdleTimeout = envDuration(env, "ECHO_WS_IDLE_TIMEOUT", cfg.WSIdleTimeout)
+	cfg.TCPPort = envString(env, "ECHO_TCP_PORT", cfg.TCPPort)
+	cfg.TCPIdleTimeout = envDuration(env, "ECHO_TCP_IDLE_TIMEOUT", cfg.TCPIdleTimeout)
+	cfg.UDPPort = envString(env, "ECHO_UDP_PORT", cfg.UDPPort)
+	cfg.UDPMaxDatagram = envSize(env, "ECHO_UDP_MAX_DATAGRAM", cfg.UDPMaxDatagram)
+	cfg.ShutdownTimeout = envDuration(env, "ECHO_SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout)
+	cfg.DrainDelay = envDuration(env, "ECHO_DRAIN_DELAY", cfg.DrainDelay)
+	corsOrigins := envString(env, "ECHO_CORS_ORIGINS", "")
+	cfg.AuthToken = envString(env, "ECHO_AUTH_TOKEN", cfg.AuthToken)
+	cfg.BasicUser = envString(env, "ECHO_BASIC_USER", cfg.BasicUser)
+	cfg.BasicPass = envString(env, "ECHO_BASIC_PASS", cfg.BasicPass)
+	cfg.RateLimit = envInt(env, "ECHO_RATE_LIMIT", cfg.RateLimit)
+	cfg.RateBurst = envInt(env, "ECHO_RATE_BURST", cfg.RateBurst)
+	cfg.MaxEgress = envSize(env, "ECHO_MAX_EGRESS", cfg.MaxEgress)
+	cfg.MaxRequestDuration = envDuration(env, "ECHO_MAX_REQUEST_DURATION", cfg.MaxRequestDuration)
+	cfg.UnixSocket = envString(env, "ECHO_UNIX_SOCKET", cfg.UnixSocket)
+	cfg.KeepAlive = envDuration(env, "ECHO_KEEPALIVE", cfg.KeepAlive)
+	cfg.H2C = envBool(env, "ECHO_H2C", cfg.H2C)
+	cfg.EnvFile = envString(env, "ECHO_ENV_FILE", cfg.EnvFile)
+	cfg.DebugClientIP = envBool(env, "ECHO_DEBUG_CLIENT_IP", cfg.DebugClientIP)
+	cfg.AccessLogFormat = envString(env, "ECHO_ACCESS_LOG_FORMAT", cfg.AccessLogFormat)
+	cfg.LogFile = envString(env, "ECHO_LOG_FILE", cfg.LogFile)
+	cfg.MaxHeaderBytes = envSize(env, "ECHO_MAX_HEADER_BYTES", cfg.MaxHeaderBytes)
+	cfg.MinThroughput = envSize(env, "ECHO_MIN_THROUGHPUT", cfg.MinThroughput)
+	cfg.MinThroughputGrace = envDuration(env, "ECHO_MIN_THROUGHPUT_GRACE", cfg.MinThroughputGrace)
+	cfg.DebugPanics = envBool(env, "ECHO_DEBUG_PANICS", cfg.DebugPanics)
+	cfg.EnableUpload = envBool(env, "ECHO_ENABLE_UPLOAD", cfg.EnableUpload)
+	cfg.EnableDownload = envBool(env, "ECHO_ENABLE_DOWNLOAD", cfg.EnableDownload)
+	cfg.EnableHealth = envBool(env, "ECHO_ENABLE_HEALTH", cfg.EnableHealth)
+	cfg.EnableIndex = envBool(env, "ECHO_ENABLE_INDEX", cfg.EnableIndex)
+	cfg.MaxProcs = envInt(env, "ECHO_MAXPROCS", cfg.MaxProcs)
+	cfg.DownloadFile = envString(env, "ECHO_DOWNLOAD_FILE", cfg.DownloadFile)
+	cfg.MaxLifetime = envDuration(env, "ECHO_MAX_LIFETIME", cfg.MaxLifetime)
+	cfg.ListenBacklog = envInt(env, "ECHO_LISTEN_BACKLOG", cfg.ListenBacklog)
+	cfg.ProxyProtocol = envString(env, "ECHO_PROXY_PROTOCOL", cfg.ProxyProtocol)
+	cfg.Prewarm = envBool(env, "ECHO_PREWARM", cfg.Prewarm)
+	cfg.EchoSensitive = envBool(env, "ECHO_ECHO_SENSITIVE_HEADERS", cfg.EchoSensitive)
+
+	// Flag defaults are the env-resolved values, so an unset flag keeps them
+	fs := flag.NewFlagSet("echo-stream", flag.ContinueOnError)
+	fs.StringVar(&cfg.Port, "port", cfg.Port, "listen port, e.g. 8080 or :8080 (env ECHO_PORT)")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout, "server read timeout (env ECHO_READ_TIMEOUT)")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", cfg.WriteTimeout, "server write timeout (env ECHO_WRITE_TIMEOUT)")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "server idle timeout (env ECHO_IDLE_TIMEOUT)")
+	fs.Var(sizeValue{&cfg.BufferSize}, "buffer-size", "download write buffer `size`, e.g. 32768 or 32KiB (env ECHO_BUFFER_SIZE)")
+	fs.Var(sizeValue{&cfg.MaxUploadSize}, "max-upload", "maximum upload `size`, e.g. 33554432 or 32MiB (env ECHO_MAX_UPLOAD)")
+	fs.Var(sizeValue{&cfg.MaxDownloadSize}, "max-download", "maximum download `size`, e.g. 104857600 or 100MiB (env ECHO_MAX_DOWNLOAD)")
+	fs.Var(sizeValue{&cfg.DefaultDownloadSize}, "default-download", "download `size` when none is requested (env ECHO_DEFAULT_DOWNLOAD)")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "TLS certificate file, enables HTTPS with -tls-key (env ECHO_TLS_CERT)")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "TLS private key file, enables HTTPS with -tls-cert (env ECHO_TLS_KEY)")
+	fs.BoolVar(&cfg.TLSSelfSigned, "tls-self-signed", cfg.TLSSelfSigned, "serve HTTPS with a generated self-signed certificate (env ECHO_TLS_SELF_SIGNED)")
+	fs.StringVar(&cfg.TLSMinVersion, "tls-min-version", cfg.TLSMinVersion, "oldest TLS version accepted: 1.0, 1.1, 1.2 or 1.3 (env ECHO_TLS_MIN_VERSION)")
+	fs.StringVar(&cfg.TLSCipherSuites, "tls-cipher-suites", cfg.TLSCipherSuites, "comma-separated TLS 1.0-1.2 cipher suites to allow, empty for the Go defaults (env ECHO_TLS_CIPHER_SUITES)")
+	fs.StringVar(&cfg.TLSClientCA, "tls-client-ca", cfg.TLSClientCA, "PEM file of CAs; require HTTPS clients to present a certificate signed by one (env ECHO_TLS_CLIENT_CA)")
+	fs.BoolVar(&cfg.Pprof, "pprof", cfg.Pprof, "expose profiling handlers under /debug/pprof/ (env ECHO_PPROF)")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "log output format, text or json (env ECHO_LOG_FORMAT)")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "minimum log level: debug, info, warn or error (env ECHO_LOG_LEVEL)")
+	fs.IntVar(&cfg.MaxPerClient, "max-per-client", cfg.MaxPerClient, "concurrent uploads/downloads per client IP, 0 for unlimited (env ECHO_MAX_PER_CLIENT)")
+	fs.IntVar(&cfg.MaxConcurrent, "max-concurrent", cfg.MaxConcurrent, "concurrent uploads/downloads across all clients, 0 for unlimited (env ECHO_MAX_CONCURRENT)")
+	fs.StringVar(&trustedProxies, "trusted-proxies", trustedProxies, "comma-separated proxy CIDRs whose forwarding headers are honored, empty honors none (env ECHO_TRUSTED_PROXIES)")
+	fs.IntVar(&cfg.ForwardedHops, "forwarded-hops", cfg.ForwardedHops, "trusted proxy hops appending to X-Forwarded-For, 0 takes the leftmost entry (env ECHO_FORWARDED_HOPS)")
+	fs.DurationVar(&cfg.WSIdleTimeout, "ws-idle-timeout", cfg.WSIdleTimeout, "close WebSocket connections idle this long (env ECHO_WS_IDLE_TIMEOUT)")
+	fs.StringVar(&cfg.TCPPort, "tcp-port", cfg.TCPPort, "also serve a raw TCP echo on this port, empty to disable (env ECHO_TCP_PORT)")
+	fs.DurationVar(&cfg.TCPIdleTimeout, "tcp-idle-timeout", cfg.TCPIdleTimeout, "close TCP echo connections idle this long (env ECHO_TCP_IDLE_TIMEOUT)")
+	fs.StringVar(&cfg.UDPPort, "udp-port", cfg.UDPPort, "also serve a UDP echo on this port, empty to disable (env ECHO_UDP_PORT)")
+	fs.Var(sizeValue{&cfg.UDPMaxDatagram}, "udp-max-datagram", "largest UDP datagram `size` echoed in full, longer ones are truncated (env ECHO_UDP_MAX_DATAGRAM)")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "how long shutdown waits for in-flight requests before closing them (env ECHO_SHUTDOWN_TIMEOUT)")
+	fs.DurationVar(&cfg.DrainDelay, "drain-delay", cfg.DrainDelay, "on SIGTERM, fail /health for this long before shutting down (env ECHO_DRAIN_DELAY)")
+	fs.BoolVar(&cfg.EchoSensitive, "echo-sensitive-headers", cfg.EchoSensitive, "show Authorization and Cookie headers in /echo instead of redacting them (env ECHO_ECHO_SENSITIVE_HEADERS)")
+	fs.StringVar(&corsOrigins, "cors-origins", corsOrigins, "comma-separated origins allowed to call the server from browsers, * for any, empty disables CORS (env ECHO_CORS_ORIGINS)")
+	fs.StringVar(&cfg.AuthToken, "auth-token", cfg.AuthToken, "require Authorization: Bearer <token> on all endpoints but health checks (env ECHO_AUTH_TOKEN)")
+	fs.StringVar(&cfg.BasicUser, "basic-user", cfg.BasicUser, "require HTTP Basic auth with this user and -basic-pass on all endpoints but health checks (env ECHO_BASIC_USER)")
+	fs.StringVar(&cfg.BasicPass, "basic-pass", cfg.BasicPass, "password for -basic-user (env ECHO_BASIC_PASS)")
+	fs.IntVar(&cfg.RateLimit, "rate-limit", cfg.RateLimit, "requests per second allowed per client IP, 0 for unlimited (env ECHO_RATE_LIMIT)")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", cfg.RateBurst, "requests a client may make at once under -rate-limit, 0 for one second's worth (env ECHO_RATE_BURST)")
+	fs.Var(sizeValue{&cfg.MaxEgress}, "max-egress", "total download `bytes` per second across all clients, e.g. 10MB, 0 for unlimited (env ECHO_MAX_EGRESS)")
+	fs.DurationVar(&cfg.MaxRequestDuration, "max-request-duration", cfg.MaxRequestDuration, "abort uploads and downloads running longer than this, 0 for no limit (env ECHO_MAX_REQUEST_DURATION)")
+	fs.StringVar(&cfg.UnixSocket, "unix-socket", cfg.UnixSocket, "serve HTTP on this Unix domain socket path instead of -port (env ECHO_UNIX_SOCKET)")
+	fs.DurationVar(&cfg.KeepAlive, "keepalive", cfg.KeepAlive, "TCP keep-alive period of accepted HTTP and TCP echo connections, 0 to disable (env ECHO_KEEPALIVE)")
+	fs.BoolVar(&cfg.H2C, "h2c", cfg.H2C, "also accept cleartext HTTP/2, by prior knowledge or Upgrade: h2c (env ECHO_H2C)")
+	fs.StringVar(&cfg.EnvFile, "env-file", cfg.EnvFile, "file of ECHO_* variables read at startup and on SIGHUP (env ECHO_ENV_FILE)")
+	fs.BoolVar(&cfg.DebugClientIP, "debug-client-ip", cfg.DebugClientIP, "report the resolved client IP and socket address in X-Detected-Client-IP and X-Remote-Addr (env ECHO_DEBUG_CLIENT_IP)")
+	fs.StringVar(&cfg.AccessLogFormat, "access-log-format", cfg.AccessLogFormat, "also write an access log line per request to stdout, clf or combined, empty to disable (env ECHO_ACCESS_LOG_FORMAT)")
+	fs.StringVar(&cfg.LogFile, "log-file", cfg.LogFile, "append event and access logs to this file, reopened on SIGHUP and SIGUSR1, empty for stderr and stdout (env ECHO_LOG_FILE)")
+	fs.Var(sizeValue{&cfg.MaxHeaderBytes}, "max-header-bytes", "largest request line and headers `size` accepted, e.g. 1MiB (env ECHO_MAX_HEADER_BYTES)")
+	fs.Var(sizeValue{&cfg.MinThroughput}, "min-throughput", "cut off uploads and downloads whose client moves fewer `bytes` per second, e.g. 1KB, 0 to disable (env ECHO_MIN_THROUGHPUT)")
+	fs.DurationVar(&cfg.MinThroughputGrace, "min-throughput-grace", cfg.MinThroughputGrace, "how long a transfer may stay below -min-throughput (env ECHO_MIN_THROUGHPUT_GRACE)")
+	fs.BoolVar(&cfg.DebugPanics, "debug-panics", cfg.DebugPanics, "re-raise handler panics after logging them instead of answering 500 (env ECHO_DEBUG_PANICS)")
+	fs.BoolVar(&cfg.EnableUpload, "enable-upload", cfg.EnableUpload, "serve /upload; when false it answers 404 (env ECHO_ENABLE_UPLOAD)")
+	fs.BoolVar(&cfg.EnableDownload, "enable-download", cfg.EnableDownload, "serve /download; when false it answers 404 (env ECHO_ENABLE_DOWNLOAD)")
+	fs.BoolVar(&cfg.EnableHealth, "enable-health", cfg.EnableHealth, "serve /health, /livez and /readyz; when false they answer 404 (env ECHO_ENABLE_HEALTH)")
+	fs.BoolVar(&cfg.EnableIndex, "enable-index", cfg.EnableIndex, "serve a JSON index of the endpoints at /; when false it answers 404 (env ECHO_ENABLE_INDEX)")
+	fs.IntVar(&cfg.MaxProcs, "maxprocs", cfg.MaxProcs, "GOMAXPROCS to run with, 0 to follow GOMAXPROCS or the cgroup CPU quota (env ECHO_MAXPROCS)")
+	fs.StringVar(&cfg.DownloadFile, "download-file", cfg.DownloadFile, "serve /download bodies from this file, repeated to the requested size, instead of generating them (env ECHO_DOWNLOAD_FILE)")
+	fs.DurationVar(&cfg.MaxLifetime, "max-lifetime", cfg.MaxLifetime, "drain and exit as on SIGTERM after running this long, 0 to run until stopped (env ECHO_MAX_LIFETIME)")
+	fs.IntVar(&cfg.ListenBacklog, "listen-backlog", cfg.ListenBacklog, "pending connections the HTTP and TCP echo listeners queue, capped by the kernel, 0 for the system default (env ECHO_LISTEN_BACKLOG)")
+	fs.StringVar(&cfg.ProxyProtocol, "proxy-protocol", cfg.ProxyProtocol, "read PROXY protocol v1/v2 headers for the client address, optional or required, needs -trusted-proxies, empty to disable (env ECHO_PROXY_PROTOCOL)")
+	fs.BoolVar(&cfg.Prewarm, "prewarm", cfg.Prewarm, "generate the download pattern blocks and pool download buffers at startup, failing /readyz until done (env ECHO_PREWARM)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if cfg.BufferSize <= 0 || cfg.MaxUploadSize <= 0 || cfg.MaxDownloadSize <= 0 || cfg.DefaultDownloadSize <= 0 ||
+		cfg.UDPMaxDatagram <= 0 || cfg.MaxHeaderBytes <= 0 {
+		return nil, fmt.Errorf("buffer and size limits must be positive")
+	}
+	if cfg.DownloadFile != "" {
+		info, err := os.Stat(cfg.DownloadFile)
+		if err != nil {
+			return nil, fmt.Errorf("download file: %w", err)
+		}
+		if !info.Mode().IsRegular() || info.Size() == 0 {
+			return nil, fmt.Errorf("download file %s must be a non-empty regular file", cfg.DownloadFile)
+		}
+	}
+	if cfg.MaxProcs < 0 {
+		return nil, fmt.Errorf("maxprocs must not be negative, got %d", cfg.MaxProcs)
+	}
+	if cfg.MaxPerClient < 0 || cfg.MaxConcurrent < 0 {
+		return nil, fmt.Errorf("concurrency limits must not be negative")
+	}
+	if cfg.RateLimit < 0 || cfg.RateBurst < 0 || cfg.MaxEgress < 0 || cfg.MinThroughput < 0 {
+		return nil, fmt.Errorf("rate limits must not be negative")
+	}
+	if cfg.WSIdleTimeout <= 0 || cfg.TCPIdleTimeout <= 0 || cfg.ShutdownTimeout <= 0 {
+		return nil, fmt.Errorf("idle and shutdown timeouts must be positive")
+	}
+	if cfg.MinThroughputGrace <= 0 {
+		return nil, fmt.Errorf("min throughput grace must be positive, got %s", cfg.MinThroughputGrace)
+	}
+	if cfg.ListenBacklog < 0 {
+		return nil, fmt.Errorf("listen backlog must not be negative, got %d", cfg.ListenBacklog)
+	}
+	if cfg.KeepAlive < 0 {
+		return nil, fmt.Errorf("keepalive must not be negative, got %s", cfg.KeepAlive)
+	}
+	if cfg.MaxRequestDuration < 0 {
+		return nil, fmt.Errorf("max request duration must not be negative, got %s", cfg.MaxRequestDuration)
+	}
+	if cfg.MaxLifetime < 0 {
+		return nil, fmt.Errorf("max lifetime must not be negative, got %s", cfg.MaxLifetime)
+	}
+	if cfg.DrainDelay < 0 {
+		return nil, fmt.Errorf("drain delay must not be negative, got %s", cfg.DrainDelay)
+	}
+	if cfg.ForwardedHops < 0 {
+		return nil, fmt.Errorf("forwarded hops must not be negative, got %d", cfg.ForwardedHops)
+	}
+	if cfg.DefaultDownloadSize > cfg.MaxDownloadSize {
+		return nil, fmt.Errorf("default download size %d exceeds max download size %d", cfg.DefaultDownloadSize, cfg.MaxDownloadSize)
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, fmt.Errorf("both a TLS certificate and key are required, got cert=%q key=%q", cfg.TLSCert, cfg.TLSKey)
+	}
+	if (cfg.BasicUser == "") != (cfg.BasicPass == "") {
+		return nil, fmt.Errorf("basic auth needs both a user and a password")
+	}
+	if cfg.LogFormat != LogFormatText && cfg.LogFormat != LogFormatJSON {
+		return nil, fmt.Errorf("log format must be %q or %q, got %q", LogFormatText, LogFormatJSON, cfg.LogFormat)
+	}
+	if cfg.ProxyProtocol != "" && cfg.ProxyProtocol != ProxyProtocolOptional && cfg.ProxyProtocol != ProxyProtocolRequired {
+		return nil, fmt.Errorf("proxy protocol must be %q or %q, got %q", ProxyProtocolOptional, ProxyProtocolRequired, cfg.ProxyProtocol)
+	}
+	if cfg.AccessLogFormat != "" && cfg.AccessLogFormat != AccessLogCommon && cfg.AccessLogFormat != AccessLogCombined {
+		return nil, fmt.Errorf("access log format must be %q or %q, got %q", AccessLogCommon, AccessLogCombined, cfg.AccessLogFormat)
+	}
+	nets, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	cfg.TrustedProxies = nets
+	// Without an allowlist anyone reaching the port could claim any client address
+	if cfg.ProxyProtocol != "" && len(cfg.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("-proxy-protocol needs -trusted-proxies listing the load balancers allowed to send headers")
+	}
+	cfg.CORSOrigins = parseCORSOrigins(corsOrigins)
+
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		return nil, err
+	}
+	if cfg.TLSSelfSigned && cfg.TLSCert != "" {
+		return nil, fmt.Errorf("-tls-self-signed cannot be combined with -tls-cert/-tls-key")
+	}
+	minVersion, err := parseTLSVersion(cfg.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := parseCipherSuites(cfg.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	// HTTPS serves HTTP/2, which refuses to start below TLS 1.3 without one of its required suites
+	if len(suites) > 0 && minVersion < tls.VersionTLS13 && !allowsHTTP2(suites) {
+		return nil, fmt.Errorf("-tls-cipher-suites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, which HTTP/2 requires")
+	}
+	if cfg.TLSClientCA != "" && !cfg.TLSEnabled() {
+		return nil, fmt.Errorf("-tls-client-ca needs HTTPS, set -tls-cert/-tls-key or -tls-self-signed")
+	}
+	if cfg.H2C && cfg.TLSEnabled() {
+		return nil, fmt.Errorf("-h2c is cleartext HTTP/2 and cannot be combined with TLS, which negotiates HTTP/2 already")
+	}
+
+	cfg.Port = listenAddr(cfg.Port)
+	if cfg.TCPPort != "" {
+		cfg.TCPPort = listenAddr(cfg.TCPPort)
+	}
+	if cfg.UDPPort != "" {
+		cfg.UDPPort = listenAddr(cfg.UDPPort)
+	}
+	return cfg, nil
+}
+
+// envString returns the value of the environment variable key, or def when unset
+func envString(env envVars, key, def string) string {
+	if v := env.get(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt parses the environment variable key as a positive integer,
+// falling back to def when unset or unparseable
+func envInt(env envVars, key string, def int) int {
+	v := env.get(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		logWarn("CONFIG_WARNING", "Key", key, "Invalid", v, "Default", def)
+		return def
+	}
+	return n
+}
+
+// envBool parses the environment variable key as a boolean (e.g. "1", "true"),
+// falling back to def when unset or unparseable
+func envBool(env envVars, key string, def bool) bool {
+	v := env.get(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logWarn("CONFIG_WARNING", "Key", key, "Invalid", v, "Default", def)
+		return def
+	}
+	return b
+}
+
+// envSize parses the environment variable key as a size such as "32MiB", falling back to def
+// when unset, unparseable or not positive
+func envSize(env envVars, key string, def int) int {
+	v := env.get(key)
+	if v == "" {
+		return def
+	}
+	n, err := parseSize(v)
+	if err != nil || n <= 0 {
+		logWarn("CONFIG_WARNING", "Key", key, "Invalid", v, "Default", def)
+		return def
+	}
+	return n
+}
+
+// envDuration parses the environment variable key as a Go duration (e.g. "45s", "2m"),
+// falling back to def when unset or unparseable
+func envDuration(env envVars, key string, def time.Duration) time.Duration {
+	v := env.get(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		logWarn("CONFIG_WARNING", "Key", key, "Invalid", v, "Default", def)
+		return def
+	}
+	return d
+}
+
+// listenAddr normalizes a port setting so both "8080" and ":8080" are accepted
+func listenAddr(port string) string {
+	if !strings.Contains(port, ":") {
+		return ":" + port
+	}
+	return port
+}
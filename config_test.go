@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvConfiguresHTTPServer(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		addr  string
+		read  time.Duration
+		write time.Duration
+		idle  time.Duration
+	}{
+		{
+			name:  "defaults",
+			addr:  ServerPort,
+			read:  ServerTimeout,
+			write: ServerTimeout,
+			idle:  ServerTimeout,
+		},
+		{
+			name: "all set",
+			env: map[string]string{
+				"ECHO_PORT": "9090", "ECHO_READ_TIMEOUT": "5s", "ECHO_WRITE_TIMEOUT": "2m", "ECHO_IDLE_TIMEOUT": "90s",
+			},
+			addr:  ":9090",
+			read:  5 * time.Second,
+			write: 2 * time.Minute,
+			idle:  90 * time.Second,
+		},
+		{
+			name:  "port with host",
+			env:   map[string]string{"ECHO_PORT": "127.0.0.1:9090"},
+			addr:  "127.0.0.1:9090",
+			read:  ServerTimeout,
+			write: ServerTimeout,
+			idle:  ServerTimeout,
+		},
+		{
+			name:  "unparseable falls back to default",
+			env:   map[string]string{"ECHO_READ_TIMEOUT": "soon", "ECHO_WRITE_TIMEOUT": "-1s"},
+			addr:  ServerPort,
+			read:  ServerTimeout,
+			write: ServerTimeout,
+			idle:  ServerTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			server := newHTTPServer(testConfig(t), nil)
+			if server.Addr != tt.addr {
+				t.Errorf("Addr = %q, want %q", server.Addr, tt.addr)
+			}
+			if server.ReadTimeout != tt.read {
+				t.Errorf("ReadTimeout = %s, want %s", server.ReadTimeout, tt.read)
+			}
+			if server.WriteTimeout != tt.write {
+				t.Errorf("WriteTimeout = %s, want %s", server.WriteTimeout, tt.write)
+			}
+			if server.IdleTimeout != tt.idle {
+				t.Errorf("IdleTimeout = %s, want %s", server.IdleTimeout, tt.idle)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// HTTP/2 cancels a stream's context both when the client resets just that stream and when the
+// whole connection goes away. Watching the connection itself tells the two apart: a connection
+// that failed a read or write has been lost, one that is still healthy only lost the stream.
+
+// connKey carries the *watchedConn of a request's connection in its context
+type connKey struct{}
+
+// watchedConn records whether reading from or writing to the connection has failed
+type watchedConn struct {
+	net.Conn
+	broken atomic.Bool
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil && !isTimeout(err) {
+		c.broken.Store(true)
+	}
+	return n, err
+}
+
+func (c *watchedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil && !isTimeout(err) {
+		c.broken.Store(true)
+	}
+	return n, err
+}
+
+// ReadFrom hands io.Copy to the wrapped connection, keeping downloads from a file on sendfile
+func (c *watchedConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(c.Conn, r)
+	if err != nil {
+		c.broken.Store(true)
+	}
+	return n, err
+}
+
+// watchedListener wraps every accepted connection in a watchedConn
+type watchedListener struct {
+	net.Listener
+}
+
+func (l watchedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &watchedConn{Conn: conn}, nil
+}
+
+// watchConnContext is the http.Server ConnContext making the watchedConn reachable from requests
+func watchConnContext(ctx context.Context, c net.Conn) context.Context {
+	// ServeTLS wraps the listener, so HTTPS connections arrive with the watchedConn underneath
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if wc, ok := c.(*watchedConn); ok {
+		return context.WithValue(ctx, connKey{}, wc)
+	}
+	return ctx
+}
+
+// streamReset reports whether a canceled HTTP/2 request was reset by the client on a connection
+// that is still up, rather than lost along with its connection
+func streamReset(r *http.Request) bool {
+	if r.ProtoMajor != 2 || r.Context().Err() == nil {
+		return false
+	}
+	wc, ok := r.Context().Value(connKey{}).(*watchedConn)
+	return ok && !wc.broken.Load()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// cookieResult is the JSON response of /cookies
+type cookieResult struct {
+	Cookies map[string]string `json:"cookies"`
+}
+
+// cookiesHandler sets the cookies named by repeated set=name=value parameters, and returns the cookies
+// the request carried either way
+func (s *Server) cookiesHandler(w http.ResponseWriter, r *http.Request) {
+	clientIP := s.getClientIP(r)
+	reqID := requestIDFromContext(r.Context())
+
+	cookies, err := parseSetCookies(r)
+	if err != nil {
+		logError("COOKIES_ERROR", "Client", clientIP, "RequestID", reqID, "Error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, c := range cookies {
+		http.SetCookie(w, c)
+	}
+
+	received := make(map[string]string)
+	for _, c := range r.Cookies() {
+		received[c.Name] = c.Value
+	}
+	logInfo("COOKIES_SUCCESS", "Client", clientIP, "RequestID", reqID, "Received", len(received),
+		"Set", len(cookies))
+	writeJSON(w, http.StatusOK, cookieResult{Cookies: received})
+}
+
+// parseSetCookies builds the cookies requested by the set parameters, applying the path, max_age,
+// samesite, secure and httponly attributes to all of them
+func parseSetCookies(r *http.Request) ([]*http.Cookie, error) {
+	q := r.URL.Query()
+	if len(q["set"]) == 0 {
+		return nil, nil
+	}
+
+	attrs := http.Cookie{Path: q.Get("path"), Secure: q.Get("secure") == "true", HttpOnly: q.Get("httponly") == "true"}
+	if attrs.Path == "" {
+		attrs.Path = "/"
+	}
+	if v := q.Get("max_age"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("max_age must be a number of seconds, got %q", v)
+		}
+		// net/http uses a negative MaxAge for "Max-Age=0", which deletes the cookie
+		if n <= 0 {
+			n = -1
+		}
+		attrs.MaxAge = n
+	}
+	switch v := strings.ToLower(q.Get("samesite")); v {
+	case "":
+	case "lax":
+		attrs.SameSite = http.SameSiteLaxMode
+	case "strict":
+		attrs.SameSite = http.SameSiteStrictMode
+	case "none":
+		// Browsers drop SameSite=None cookies that are not also Secure
+		if !attrs.Secure {
+			return nil, fmt.Errorf("samesite=none requires secure=true")
+		}
+		attrs.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("samesite must be one of lax, strict, none, got %q", v)
+	}
+
+	cookies := make([]*http.Cookie, 0, len(q["set"]))
+	for _, p := range q["set"] {
+		name, value, ok := strings.Cut(p, "=")
+		if !ok {
+			return nil, fmt.Errorf("set %q must look like name=value", p)
+		}
+		c := attrs
+		c.Name, c.Value = name, value
+		if err := c.Valid(); err != nil {
+			return nil, err
+		}
+		cookies = append(cookies, &c)
+	}
+	return cookies, nil
+}
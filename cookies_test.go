@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"reflect"
+	"testing"
+)
+
+// getCookies fetches url with client and decodes the cookies the server says it received
+func getCookies(t *testing.T, client *http.Client, url string) (*http.Response, map[string]string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result cookieResult
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp, result.Cookies
+}
+
+func TestCookiesRoundTrip(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+
+	tests := []struct {
+		name  string
+		query string
+		want  map[string]string
+	}{
+		{"one cookie", "set=session=abc123", map[string]string{"session": "abc123"}},
+		{"two cookies", "set=a=1&set=b=2", map[string]string{"a": "1", "b": "2"}},
+		{"with attributes", "set=session=xyz&samesite=strict&httponly=true&max_age=60",
+			map[string]string{"session": "xyz"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jar, err := cookiejar.New(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Jar: jar}
+
+			resp, received := getCookies(t, client, ts.URL+"/cookies?"+tt.query)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("setting: status %d", resp.StatusCode)
+			}
+			if len(received) != 0 {
+				t.Errorf("setting: received %v before any were set", received)
+			}
+
+			_, received = getCookies(t, client, ts.URL+"/cookies")
+			if !reflect.DeepEqual(received, tt.want) {
+				t.Errorf("reading: received %v, want %v", received, tt.want)
+			}
+		})
+	}
+}
+
+func TestCookieAttributes(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+
+	tests := []struct {
+		query string
+		check func(*http.Cookie) bool
+	}{
+		{"path=/cookies", func(c *http.Cookie) bool { return c.Path == "/cookies" }},
+		{"max_age=60", func(c *http.Cookie) bool { return c.MaxAge == 60 }},
+		{"max_age=0", func(c *http.Cookie) bool { return c.MaxAge < 0 }},
+		{"samesite=lax", func(c *http.Cookie) bool { return c.SameSite == http.SameSiteLaxMode }},
+		{"samesite=none&secure=true", func(c *http.Cookie) bool { return c.SameSite == http.SameSiteNoneMode && c.Secure }},
+		{"httponly=true", func(c *http.Cookie) bool { return c.HttpOnly }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			resp, _ := getCookies(t, http.DefaultClient, ts.URL+"/cookies?set=k=v&"+tt.query)
+			cookies := resp.Cookies()
+			if len(cookies) != 1 || !tt.check(cookies[0]) {
+				t.Errorf("Set-Cookie = %q", resp.Header.Values("Set-Cookie"))
+			}
+		})
+	}
+}
+
+func TestCookiesInvalid(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+
+	for _, query := range []string{
+		"set=novalue",
+		"set=k=v&max_age=soon",
+		"set=k=v&samesite=sometimes",
+		"set=k=v&samesite=none",
+		"set==v",
+	} {
+		t.Run(query, func(t *testing.T) {
+			resp, _ := getCookies(t, http.DefaultClient, ts.URL+"/cookies?"+query)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CORS response values; the exposed headers are the ones speed-test pages need to read
+const (
+	corsAllowMethods  = "GET, HEAD, POST, PUT, OPTIONS"
+	corsExposeHeaders = "Content-Length, Content-Range, Retry-After, X-Checksum, X-Content-SHA256, X-Request-Start, X-Request-End, X-Request-ID, X-Upload-Limit, X-Detected-Client-IP, X-Remote-Addr, X-Client-Cert-Subject"
+	corsMaxAge        = "600"
+)
+
+// parseCORSOrigins splits a comma-separated origin allowlist such as "https://a.example,https://b.example"
+func parseCORSOrigins(list string) []string {
+	var origins []string
+	for _, origin := range strings.Split(list, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+// corsOrigin returns the Access-Control-Allow-Origin value for origin, or "" when it is not allowed
+func (s *Server) corsOrigin(origin string) string {
+	for _, allowed := range s.config().CORSOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// cors adds CORS headers for allowed origins and answers preflight requests itself.
+// Requests from other origins are served without CORS headers, so browsers block them.
+func (s *Server) cors(next http.Handler) http.Handler {
+	if len(s.config().CORSOrigins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed := s.corsOrigin(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			if allowed == "" {
+				logWarn("CORS_REJECTED", "Client", s.getClientIP(r), "RequestID", requestIDFromContext(r.Context()),
+					"Origin", origin, "URL", r.URL.Path)
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowed != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
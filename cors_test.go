@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	cfg := testConfig(t, "-cors-origins", "https://speed.example, https://other.example/")
+	_, ts := newTestServer(t, cfg)
+
+	tests := []struct {
+		name       string
+		method     string
+		origin     string
+		preflight  bool
+		wantStatus int
+		wantOrigin string
+	}{
+		{"matching origin", http.MethodGet, "https://speed.example", false, http.StatusOK, "https://speed.example"},
+		{"trailing slash in the allowlist", http.MethodGet, "https://other.example", false, http.StatusOK, "https://other.example"},
+		{"non-matching origin", http.MethodGet, "https://evil.example", false, http.StatusOK, ""},
+		{"no origin", http.MethodGet, "", false, http.StatusOK, ""},
+		{"preflight", http.MethodOptions, "https://speed.example", true, http.StatusNoContent, "https://speed.example"},
+		{"rejected preflight", http.MethodOptions, "https://evil.example", true, http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, tt.method, ts.URL+"/ping", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+				req.Header.Set("Access-Control-Request-Headers", "Content-Type, X-Request-Start")
+			}
+			resp, _ := fetch(t, req)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if !tt.preflight || tt.wantOrigin == "" {
+				return
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Methods"); got != corsAllowMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q", got)
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Headers"); got != "Content-Type, X-Request-Start" {
+				t.Errorf("Access-Control-Allow-Headers = %q", got)
+			}
+		})
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	_, ts := newTestServer(t, testConfig(t, "-cors-origins", "*"))
+	req := newRequest(t, http.MethodGet, ts.URL+"/ping", nil)
+	req.Header.Set("Origin", "https://anywhere.example")
+	if resp, _ := fetch(t, req); resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// MaxDelay caps the ms parameter of /delay, and the other waits a request can ask for
+const MaxDelay = 60 * time.Second
+
+// Delay distributions selected with the dist parameter of /delay
+const (
+	DelayFixed   = "fixed"
+	DelayUniform = "uniform"
+	DelayNormal  = "normal"
+)
+
+// delayDist is the latency model of a /delay request, with all values in milliseconds
+type delayDist struct {
+	kind         string
+	ms           int // fixed
+	min, max     int // uniform
+	mean, stddev int // normal
+}
+
+// parseDelay reads the distribution and its parameters: ms for fixed, min and max for uniform,
+// mean and stddev for normal
+func parseDelay(q url.Values) (delayDist, error) {
+	d := delayDist{kind: q.Get("dist")}
+	var err error
+	switch d.kind {
+	case "", DelayFixed:
+		d.kind = DelayFixed
+		d.ms, err = delayParam(q, "ms")
+	case DelayUniform:
+		if d.min, err = delayParam(q, "min"); err == nil {
+			d.max, err = delayParam(q, "max")
+		}
+		if err == nil && d.min > d.max {
+			err = fmt.Errorf("min %d exceeds max %d", d.min, d.max)
+		}
+	case DelayNormal:
+		if d.mean, err = delayParam(q, "mean"); err == nil {
+			d.stddev, err = delayParam(q, "stddev")
+		}
+	default:
+		err = fmt.Errorf("dist must be one of %s, %s, %s", DelayFixed, DelayUniform, DelayNormal)
+	}
+	return d, err
+}
+
+// delayParam parses a millisecond parameter between 0 and MaxDelay
+func delayParam(q url.Values, name string) (int, error) {
+	ms, err := strconv.Atoi(q.Get(name))
+	if err != nil || ms < 0 || time.Duration(ms)*time.Millisecond > MaxDelay {
+		return 0, fmt.Errorf("%s must be between 0 and %d", name, MaxDelay.Milliseconds())
+	}
+	return ms, nil
+}
+
+// sample draws one delay, clamped to between 0 and MaxDelay since a normal distribution is unbounded
+func (d delayDist) sample() time.Duration {
+	var ms float64
+	switch d.kind {
+	case DelayUniform:
+		ms = float64(d.min) + rand.Float64()*float64(d.max-d.min)
+	case DelayNormal:
+		ms = float64(d.mean) + rand.NormFloat64()*float64(d.stddev)
+	default:
+		ms = float64(d.ms)
+	}
+	delay := time.Duration(ms * float64(time.Millisecond))
+	if delay < 0 {
+		return 0
+	}
+	if delay > MaxDelay {
+		return MaxDelay
+	}
+	return delay
+}
+
+func (s *Server) delayHandler(w http.ResponseWriter, r *http.Request) {
+	clientIP := s.getClientIP(r)
+	reqID := requestIDFromContext(r.Context())
+
+	dist, err := parseDelay(r.URL.Query())
+	if err != nil {
+		logError("DELAY_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidDelay", r.URL.RawQuery, "Error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	delay := dist.sample()
+	ms := delay.Milliseconds()
+
+	// Abandoned requests wake up immediately instead of pinning the goroutine
+	if err := sleepContext(r.Context(), delay); err != nil {
+		logWarn("DELAY_DISCONNECTED", "Client", clientIP, "RequestID", reqID, "Ms", ms, "Error", err)
+		return
+	}
+
+	logInfo("DELAY_SUCCESS", "Client", clientIP, "RequestID", reqID, "Dist", dist.kind, "Ms", ms)
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "delayed %dms", ms)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		query    string
+		wantCode int
+		wantBody string
+		minDelay time.Duration
+	}{
+		{"ms=100", http.StatusOK, "delayed 100ms", 100 * time.Millisecond},
+		{"ms=0", http.StatusOK, "delayed 0ms", 0},
+		{"ms=-5", http.StatusBadRequest, "", 0},
+		{"ms=soon", http.StatusBadRequest, "", 0},
+		{"", http.StatusBadRequest, "", 0},
+		{"ms=60001", http.StatusBadRequest, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			start := time.Now()
+			resp, body := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/delay?"+tt.query, nil))
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantCode, body)
+			}
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minDelay {
+				t.Errorf("answered after %s, want at least %s", elapsed, tt.minDelay)
+			}
+		})
+	}
+}
+
+func TestDelayCanceled(t *testing.T) {
+	logs := captureLogs(t, LogFormatText, LevelInfo)
+	s := NewServer(DefaultConfig())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/delay?ms=10000", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+
+	start := time.Now()
+	s.delayHandler(rec, req)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("handler returned after %s, want soon after the cancellation", elapsed)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("canceled delay wrote %q", rec.Body.String())
+	}
+	if !strings.Contains(logs.String(), "DELAY DISCONNECTED") {
+		t.Errorf("no DELAY_DISCONNECTED event in %q", logs.String())
+	}
+}
+
+func TestDelayDistributions(t *testing.T) {
+	const samples = 10000
+	tests := []struct {
+		query    string
+		min, max time.Duration // every sample within
+		mean     time.Duration // the average within 5% of the range of samples
+	}{
+		{"dist=fixed&ms=250", 250 * time.Millisecond, 250 * time.Millisecond, 250 * time.Millisecond},
+		{"ms=40", 40 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond},
+		{"dist=uniform&min=100&max=300", 100 * time.Millisecond, 300 * time.Millisecond, 200 * time.Millisecond},
+		{"dist=uniform&min=70&max=70", 70 * time.Millisecond, 70 * time.Millisecond, 70 * time.Millisecond},
+		// Beyond six standard deviations, which ten thousand samples will not reach
+		{"dist=normal&mean=500&stddev=50", 200 * time.Millisecond, 800 * time.Millisecond, 500 * time.Millisecond},
+		// Clamped at zero, so about half the samples are 0
+		{"dist=normal&mean=0&stddev=100", 0, 700 * time.Millisecond, 40 * time.Millisecond},
+		// Clamped at MaxDelay, so about half the samples are the maximum
+		{"dist=normal&mean=60000&stddev=1000", 54 * time.Second, MaxDelay, 59600 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dist, err := parseDelay(q)
+			if err != nil {
+				t.Fatalf("parseDelay: %v", err)
+			}
+			var sum time.Duration
+			for i := 0; i < samples; i++ {
+				d := dist.sample()
+				if d < tt.min || d > tt.max {
+					t.Fatalf("sample %s outside %s to %s", d, tt.min, tt.max)
+				}
+				sum += d
+			}
+			mean := sum / samples
+			tolerance := (tt.max - tt.min) / 20
+			if mean < tt.mean-tolerance || mean > tt.mean+tolerance {
+				t.Errorf("mean %s, want %s ± %s", mean, tt.mean, tolerance)
+			}
+		})
+	}
+}
+
+func TestDelayDistributionParams(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		query    string
+		wantCode int
+		min, max time.Duration
+	}{
+		{"dist=uniform&min=50&max=150", http.StatusOK, 50 * time.Millisecond, 150 * time.Millisecond},
+		{"dist=normal&mean=100&stddev=0", http.StatusOK, 100 * time.Millisecond, 100 * time.Millisecond},
+		{"dist=uniform&min=200&max=100", http.StatusBadRequest, 0, 0},
+		{"dist=uniform&min=100", http.StatusBadRequest, 0, 0},
+		{"dist=normal&mean=100", http.StatusBadRequest, 0, 0},
+		{"dist=normal&mean=100&stddev=-1", http.StatusBadRequest, 0, 0},
+		{"dist=pareto&ms=100", http.StatusBadRequest, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			start := time.Now()
+			resp, body := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/delay?"+tt.query, nil))
+			elapsed := time.Since(start)
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantCode, body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var ms int64
+			if _, err := fmt.Sscanf(string(body), "delayed %dms", &ms); err != nil {
+				t.Fatalf("body %q: %v", body, err)
+			}
+			if d := time.Duration(ms) * time.Millisecond; d < tt.min || d > tt.max || elapsed < d {
+				t.Errorf("delayed %s after %s, want a delay within %s to %s", d, elapsed, tt.min, tt.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Bounds of the per-request bufsize parameter
+const (
+	MinDownloadBuffer = 1024            // 1KB
+	MaxDownloadBuffer = 4 * 1024 * 1024 // 4MB
+)
+
+// MaxChunkWrites bounds how many writes a download with the chunk parameter may take, since every
+// one of them is flushed; chunk=1 can therefore send at most this many bytes
+const MaxChunkWrites = 100000
+
+// MaxStreamDuration bounds the duration parameter of a download
+const MaxStreamDuration = 10 * time.Minute
+
+func (s *Server) downloadHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	s.metrics.downloadsInFlight.Add(1)
+	defer s.metrics.downloadsInFlight.Add(-1)
+
+	clientIP := s.getClientIP(r)
+	reqID := requestIDFromContext(r.Context())
+	pattern := r.URL.Query().Get("pattern")
+
+	// size takes bytes or a human-readable size such as 10MB
+	size := cfg.DefaultDownloadSize
+	if sizeStr := r.URL.Query().Get("size"); sizeStr != "" {
+		n, err := parseSize(sizeStr)
+		if err != nil {
+			logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidSize", sizeStr,
+				"Error", err)
+			http.Error(w, "size must be a number of bytes or a size such as 10MB", http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+	if size < 1 {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "SizeTooSmall", size)
+		http.Error(w, "size must be at least 1 byte", http.StatusBadRequest)
+		return
+	}
+	if size > cfg.MaxDownloadSize {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "SizeTooLarge", size,
+			"Max", cfg.MaxDownloadSize)
+		http.Error(w, fmt.Sprintf("size must be at most %d bytes", cfg.MaxDownloadSize), http.StatusBadRequest)
+		return
+	}
+
+	// text on its own selects the text pattern
+	text := r.URL.Query().Get("text")
+	if text != "" && pattern == "" {
+		pattern = PatternText
+	}
+	if text != "" && pattern != PatternText {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidText", text, "Pattern", pattern)
+		http.Error(w, "text requires pattern=text", http.StatusBadRequest)
+		return
+	}
+	block, err := payloadBlock(pattern, text)
+	if err != nil && pattern == PatternText {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidText", text, "Error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidPattern", pattern,
+			"Error", err)
+		http.Error(w, "pattern must be one of zero, random, incrementing, text", http.StatusBadRequest)
+		return
+	}
+
+	// A seed makes the random pattern reproducible
+	if seedStr := r.URL.Query().Get("seed"); seedStr != "" {
+		seed, err := strconv.ParseInt(seedStr, 10, 64)
+		if err != nil || pattern != PatternRandom {
+			logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID,
+				"InvalidSeed", seedStr, "Pattern", pattern)
+			http.Error(w, "seed must be an integer and requires pattern=random", http.StatusBadRequest)
+			return
+		}
+		block = seededRandomBlock(seed)
+	}
+
+	// With -download-file the body repeats the file, so there is no pattern to choose
+	var file *os.File
+	var fileSize int64
+	if cfg.DownloadFile != "" {
+		if pattern != "" || r.URL.Query().Has("seed") {
+			logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "Pattern", pattern,
+				"DownloadFile", cfg.DownloadFile)
+			http.Error(w, "pattern and seed are not available when serving a download file", http.StatusBadRequest)
+			return
+		}
+		file, fileSize, err = openDownloadFile(cfg.DownloadFile)
+		if err != nil {
+			logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "DownloadFile", cfg.DownloadFile,
+				"Error", err)
+			http.Error(w, "download file unavailable", http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+	}
+
+	// Optional bandwidth cap in bytes per second
+	rate, err := positiveQuerySize(r, "rate")
+	if err != nil {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID,
+			"InvalidRate", r.URL.Query().Get("rate"))
+		http.Error(w, "rate must be a positive number of bytes per second", http.StatusBadRequest)
+		return
+	}
+
+	// Optional slow start, climbing linearly to full speed over the rampup window
+	var rampup time.Duration
+	if v := r.URL.Query().Get("rampup"); v != "" {
+		rampup, err = time.ParseDuration(v)
+		if err != nil || rampup <= 0 || rampup > MaxDelay {
+			logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidRampup", v)
+			http.Error(w, fmt.Sprintf("rampup must be a duration such as 3s, at most %s", MaxDelay), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Optional random pause of up to jitter milliseconds between writes, to emulate an uneven link
+	jitter, err := positiveQueryInt(r, "jitter")
+	if err != nil || time.Duration(jitter)*time.Millisecond > MaxDelay {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID,
+			"InvalidJitter", r.URL.Query().Get("jitter"))
+		http.Error(w, fmt.Sprintf("jitter must be between 1 and %d milliseconds", MaxDelay.Milliseconds()), http.StatusBadRequest)
+		return
+	}
+
+	// Optional pause between sending the headers and the first body byte, in milliseconds
+	ttfbMs, err := positiveQueryInt(r, "ttfb")
+	if err != nil || time.Duration(ttfbMs)*time.Millisecond > MaxDelay {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID,
+			"InvalidTTFB", r.URL.Query().Get("ttfb"))
+		http.Error(w, fmt.Sprintf("ttfb must be between 1 and %d milliseconds", MaxDelay.Milliseconds()), http.StatusBadRequest)
+		return
+	}
+	ttfb := time.Duration(ttfbMs) * time.Millisecond
+
+	// Buffer size changes the number of writes and syscalls per transfer
+	bufSize, err := positiveQuerySize(r, "bufsize")
+	if err != nil || (bufSize != 0 && (bufSize < MinDownloadBuffer || bufSize > MaxDownloadBuffer)) {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID,
+			"InvalidBufsize", r.URL.Query().Get("bufsize"))
+		http.Error(w, fmt.Sprintf("bufsize must be between %d and %d bytes", MinDownloadBuffer, MaxDownloadBuffer), http.StatusBadRequest)
+		return
+	}
+	if bufSize == 0 {
+		bufSize = cfg.BufferSize
+	}
+
+	// chunk sets the bytes per flushed write apart from the buffer, so chunk=1 sends one byte at a time
+	chunk, err := positiveQuerySize(r, "chunk")
+	if err != nil || chunk > MaxDownloadBuffer {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID,
+			"InvalidChunk", r.URL.Query().Get("chunk"))
+		http.Error(w, fmt.Sprintf("chunk must be between 1 and %d bytes", MaxDownloadBuffer), http.StatusBadRequest)
+		return
+	}
+	if chunk > bufSize {
+		bufSize = chunk
+	}
+
+	// A duration streams for that long instead of sending size bytes
+	var streamFor time.Duration
+	if v := r.URL.Query().Get("duration"); v != "" {
+		streamFor, err = time.ParseDuration(v)
+		if err != nil || streamFor <= 0 || streamFor > MaxStreamDuration {
+			logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidDuration", v)
+			http.Error(w, fmt.Sprintf("duration must be a duration such as 10s, at most %s", MaxStreamDuration), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// fail_after cuts the connection once that many bytes are out, to test truncation handling
+	failAfter, err := positiveQuerySize(r, "fail_after")
+	if err != nil {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID,
+			"InvalidFailAfter", r.URL.Query().Get("fail_after"))
+		http.Error(w, "fail_after must be a positive number of bytes", http.StatusBadRequest)
+		return
+	}
+
+	// A single Range narrows the body to a slice of the generated payload; a timed stream
+	// has no known length to take a slice of
+	rangeHeader := r.Header.Get("Range")
+	if streamFor > 0 {
+		size, rangeHeader = 0, ""
+	}
+	offset, length, status := 0, size, http.StatusOK
+	start, end, partial, err := parseRange(rangeHeader, size)
+	if err != nil {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID,
+			"InvalidRange", r.Header.Get("Range"), "Error", err)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	// Ranges address the uncompressed payload, so partial responses are never compressed
+	offers := downloadEncodings
+	if partial {
+		offers = []string{"identity"}
+	}
+	encoding, ok := negotiateEncoding(r.Header.Get("Accept-Encoding"), offers)
+	if !ok {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID,
+			"UnacceptableEncoding", r.Header.Get("Accept-Encoding"))
+		http.Error(w, "no acceptable content encoding, available: br, gzip, identity", http.StatusNotAcceptable)
+		return
+	}
+	if encoding == "identity" {
+		encoding = ""
+	}
+	compress := encoding != ""
+
+	if partial {
+		offset, length, status = start, end-start+1, http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	if chunk > 0 && streamFor == 0 && (length+chunk-1)/chunk > MaxChunkWrites {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "TooManyChunks", (length+chunk-1)/chunk,
+			"Chunk", chunk, "Length", length)
+		http.Error(w, fmt.Sprintf("size/chunk must be at most %d writes", MaxChunkWrites), http.StatusBadRequest)
+		return
+	}
+
+	// The checksum is only known after streaming, so it goes in a trailer and the
+	// response switches to chunked encoding
+	var digest hash.Hash
+	switch checksum := r.URL.Query().Get("checksum"); checksum {
+	case "":
+	case "sha256":
+		digest = sha256.New()
+	default:
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidChecksum", checksum)
+		http.Error(w, "checksum must be sha256", http.StatusBadRequest)
+		return
+	}
+
+	// Caching and proxy tests can ask for extra response headers from a safe allowlist
+	extraHeaders, err := parseResponseHeaders(r.URL.Query()["header"])
+	if err != nil {
+		logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidHeader", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// chunked=true leaves the length unknown to the client to exercise that code path
+	chunked := r.URL.Query().Get("chunked") == "true" || streamFor > 0
+
+	for name, values := range extraHeaders {
+		w.Header()[name] = values
+	}
+	if pattern == PatternText {
+		w.Header().Set("Content-Type", "text/plain; charset=us-ascii")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Vary", "Accept-Encoding")
+	if compress {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	if digest != nil {
+		w.Header().Set("Trailer", "X-Content-SHA256")
+	} else if !compress && !chunked {
+		w.Header().Set("Content-Length", strconv.Itoa(length))
+	}
+	w.WriteHeader(status)
+
+	// HEAD only needs the headers, skip generating the body
+	if r.Method == http.MethodHead {
+		logDebug("DOWNLOAD_HEAD", "Client", clientIP, "RequestID", reqID, "ContentLength", length)
+		return
+	}
+
+	written := 0
+
+	// A stream cut short by -max-request-duration is logged apart from one the client abandoned,
+	// and an HTTP/2 client resetting only this stream apart from one that went away entirely
+	aborted := func() {
+		if timedOut(r) {
+			logWarn("DOWNLOAD_TIMEOUT", "Client", clientIP, "RequestID", reqID,
+				"BytesSent", written, "Total", length, "MaxDuration", cfg.MaxRequestDuration)
+			// The client is still there, and a chunked or compressed body ended normally would look complete
+			abortResponse(w)
+			return
+		}
+		if streamReset(r) {
+			logWarn("DOWNLOAD_STREAM_RESET", "Client", clientIP, "RequestID", reqID,
+				"BytesSent", written, "Total", length)
+			return
+		}
+		logWarn("DOWNLOAD_DISCONNECTED", "Client", clientIP, "RequestID", reqID,
+			"BytesSent", written, "Total", length)
+	}
+
+	logDebug("DOWNLOAD_START", "Client", clientIP, "RequestID", reqID, "TotalSize", size, "Offset", offset,
+		"Length", length, "Rate", rate, "Rampup", rampup, "Jitter", jitter, "Encoding", encoding, "Chunked", chunked,
+		"BufferSize", bufSize, "Chunk", chunk, "StreamFor", streamFor, "FailAfter", failAfter, "TTFB", ttfb)
+
+	// The headers are already on their way, so a ttfb delay holds back only the first body byte
+	if ttfb > 0 {
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		if err := sleepContext(r.Context(), ttfb); err != nil {
+			aborted()
+			return
+		}
+	}
+
+	pace := newRampPacer(rate, rampup)
+	egress := s.egress.Load()
+	guard := newThroughputGuard(cfg.MinThroughput, cfg.MinThroughputGrace)
+
+	// A file-backed download that needs no shaping of its writes is copied straight from the file,
+	// letting net/http send it with sendfile instead of through a buffer
+	if file != nil && pace == nil && egress == nil && guard == nil && jitter == 0 && chunk == 0 && !compress &&
+		digest == nil && failAfter == 0 && streamFor == 0 {
+		err := copyFromFile(w, file, fileSize, offset, length, func(n int) {
+			written += n
+			s.metrics.downloadBytes.Add(int64(n))
+		})
+		if err != nil && r.Context().Err() != nil {
+			aborted()
+			return
+		}
+		if err != nil {
+			logError("DOWNLOAD_WRITE_ERROR", "Client", clientIP, "RequestID", reqID,
+				"BytesSent", written, "Error", err)
+			return
+		}
+		logInfo("DOWNLOAD_SUCCESS", "Client", clientIP, "RequestID", reqID, "BytesSent", written,
+			"Source", "file")
+		return
+	}
+
+	bp := getDownloadBuffer(bufSize, cfg.BufferSize)
+	defer putDownloadBuffer(bp, cfg.BufferSize)
+	buf := *bp
+
+	var out io.Writer = w
+	var enc compressor
+	switch encoding {
+	case "br":
+		enc = brotli.NewWriter(w)
+	case "gzip":
+		enc = gzip.NewWriter(w)
+	}
+	if enc != nil {
+		out = enc
+	}
+
+	// A timed stream may outlast the server write timeout, which still bounds a stalled final write
+	rc := http.NewResponseController(w)
+	streamEnd := time.Now().Add(streamFor)
+	var deadline time.Time
+	if cfg.WriteTimeout > 0 {
+		deadline = time.Now().Add(cfg.WriteTimeout)
+	}
+	if streamFor > 0 && cfg.WriteTimeout > 0 {
+		deadline = streamEnd.Add(cfg.WriteTimeout)
+		err := rc.SetWriteDeadline(deadline)
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			logWarn("DOWNLOAD_WARNING", "Client", clientIP, "RequestID", reqID, "Error", err)
+		}
+	}
+	// A timed stream of tiny chunks also stops at MaxChunkWrites
+	writes := 0
+	more := func() bool {
+		if chunk > 0 && writes >= MaxChunkWrites {
+			return false
+		}
+		if streamFor > 0 {
+			return time.Now().Before(streamEnd)
+		}
+		return written < length
+	}
+
+	var jitterRand *rand.Rand
+	if jitter > 0 {
+		jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	for more() {
+		// Check if client disconnected or the request ran out of time
+		select {
+		case <-r.Context().Done():
+			aborted()
+			return
+		default:
+		}
+
+		toWrite := len(buf)
+		if chunk > 0 {
+			toWrite = chunk
+		}
+		if streamFor == 0 && length-written < toWrite {
+			toWrite = length - written
+		}
+		if failAfter > 0 && failAfter-written < toWrite {
+			toWrite = failAfter - written
+		}
+		toWrite = egress.limit(pace.limit(toWrite))
+
+		// Throttled downloads sleep here, still waking up on client disconnect.
+		// The server-wide egress cap applies on top of the per-request rate.
+		if err := pace.wait(r.Context(), written+toWrite); err != nil {
+			aborted()
+			return
+		}
+		if err := egress.wait(r.Context(), toWrite); err != nil {
+			aborted()
+			return
+		}
+
+		if jitterRand != nil && written > 0 {
+			pause := time.Duration(jitterRand.Int63n(int64(jitter)*int64(time.Millisecond) + 1))
+			if err := sleepContext(r.Context(), pause); err != nil {
+				aborted()
+				return
+			}
+		}
+
+		if file != nil {
+			if err := fillFromFile(buf[:toWrite], file, fileSize, offset+written); err != nil {
+				logError("DOWNLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "DownloadFile", cfg.DownloadFile,
+					"BytesSent", written, "Error", err)
+				abortResponse(w)
+				return
+			}
+		} else {
+			fillPayload(buf[:toWrite], block, offset+written)
+		}
+		if digest != nil {
+			digest.Write(buf[:toWrite])
+		}
+
+		// A write blocked on a stalled client never reports its rate, so under -min-throughput each
+		// write gets one grace period, never past the deadline above
+		writeStart := time.Now()
+		if guard != nil {
+			writeBy := writeStart.Add(cfg.MinThroughputGrace)
+			if !deadline.IsZero() && deadline.Before(writeBy) {
+				writeBy = deadline
+			}
+			rc.SetWriteDeadline(writeBy)
+		}
+		_, err := out.Write(buf[:toWrite])
+		if err != nil && guard != nil && isTimeout(err) && (deadline.IsZero() || time.Now().Before(deadline)) {
+			logWarn("DOWNLOAD_TOO_SLOW", "Client", clientIP, "RequestID", reqID, "BytesSent", written,
+				"Total", length, "Error", err)
+			return
+		}
+		if err != nil && r.Context().Err() != nil {
+			aborted()
+			return
+		}
+		if err != nil {
+			logError("DOWNLOAD_WRITE_ERROR", "Client", clientIP, "RequestID", reqID,
+				"BytesSent", written, "Error", err)
+			return
+		}
+
+		// Flush to ensure data is sent immediately, pushing out whatever the encoder has buffered first
+		if enc != nil {
+			enc.Flush()
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		written += toWrite
+		writes++
+		s.metrics.downloadBytes.Add(int64(toWrite))
+
+		// A client reading too slowly is cut off so it cannot hold the connection within the write timeout
+		if err := guard.observe(toWrite, time.Since(writeStart)); err != nil {
+			logWarn("DOWNLOAD_TOO_SLOW", "Client", clientIP, "RequestID", reqID, "BytesSent", written,
+				"Total", length, "Error", err)
+			abortResponse(w)
+			return
+		}
+
+		if failAfter > 0 && written >= failAfter {
+			logInfo("DOWNLOAD_FAIL_AFTER", "Client", clientIP, "RequestID", reqID, "BytesSent", written,
+				"Total", length)
+			abortResponse(w)
+			return
+		}
+	}
+
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			logError("DOWNLOAD_WRITE_ERROR", "Client", clientIP, "RequestID", reqID,
+				"BytesSent", written, "Error", err)
+			return
+		}
+	}
+
+	if digest != nil {
+		w.Header().Set("X-Content-SHA256", hex.EncodeToString(digest.Sum(nil)))
+	}
+
+	if streamFor > 0 {
+		logInfo("DOWNLOAD_SUCCESS", "Client", clientIP, "RequestID", reqID, "BytesSent", written,
+			"StreamFor", streamFor)
+		return
+	}
+	logInfo("DOWNLOAD_SUCCESS", "Client", clientIP, "RequestID", reqID, "BytesSent", written)
+}
+
+// openDownloadFile opens the -download-file for one download and returns its current size
+func openDownloadFile(path string) (*os.File, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if info.Size() == 0 {
+		f.Close()
+		return nil, 0, errors.New("download file is empty")
+	}
+	return f, info.Size(), nil
+}
+
+// abortResponse cuts off a response midway so the client sees a truncated transfer rather than
+// a complete one
+func abortResponse(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		// HTTP/2 streams cannot be hijacked; aborting the handler resets the stream instead
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
+
+// compressor is the part of gzip.Writer and brotli.Writer a download uses
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
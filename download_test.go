@@ -0,0 +1,866 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/http2"
+)
+
+func TestSeededDownloadIsReproducible(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	download := func(query string) []byte {
+		t.Helper()
+		resp, body := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/download?"+query, nil))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", query, resp.StatusCode, body)
+		}
+		return body
+	}
+
+	first := download("size=3MB&pattern=random&seed=42")
+	if !bytes.Equal(first, download("size=3MB&pattern=random&seed=42")) {
+		t.Error("two downloads with the same seed differ")
+	}
+	if bytes.Equal(first, download("size=3MB&pattern=random&seed=43")) {
+		t.Error("downloads with different seeds are equal")
+	}
+	if !bytes.Equal(first[:1000], download("size=1000&pattern=random&seed=42")) {
+		t.Error("a shorter download with the same seed is not a prefix of the longer one")
+	}
+}
+
+func TestSeededBlockCache(t *testing.T) {
+	block := seededRandomBlock(1)
+	if &seededRandomBlock(1)[0] != &block[0] {
+		t.Error("a cached seed generated a new block")
+	}
+	for seed := int64(2); seed <= SeededBlockCacheSize+1; seed++ {
+		seededRandomBlock(seed)
+	}
+	regenerated := seededRandomBlock(1)
+	if &regenerated[0] == &block[0] {
+		t.Error("the least recently used seed was not evicted")
+	}
+	if !bytes.Equal(regenerated, block) {
+		t.Error("a regenerated block differs from the evicted one")
+	}
+	if n := seededBlocks.order.Len(); n > SeededBlockCacheSize {
+		t.Errorf("cache holds %d blocks, want at most %d", n, SeededBlockCacheSize)
+	}
+}
+
+func TestThrottledDownloadTakesExpectedTime(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		size, rate int
+	}{
+		{20000, 40000},
+		{30000, 100000},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		url := fmt.Sprintf("%s/download?size=%d&rate=%d", ts.URL, tt.size, tt.rate)
+		resp, body := fetch(t, newRequest(t, http.MethodGet, url, nil))
+		elapsed := time.Since(start)
+		if resp.StatusCode != http.StatusOK || len(body) != tt.size {
+			t.Fatalf("size=%d rate=%d: status %d with %d bytes", tt.size, tt.rate, resp.StatusCode, len(body))
+		}
+		want := time.Duration(float64(tt.size) / float64(tt.rate) * float64(time.Second))
+		if elapsed < want {
+			t.Errorf("size=%d rate=%d took %s, want at least %s", tt.size, tt.rate, elapsed, want)
+		}
+	}
+}
+
+func TestDownloadHead(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		query string
+		want  int64
+	}{
+		{"size=12345", 12345},
+		{"", DefaultDownloadSize},
+	}
+	for _, tt := range tests {
+		resp, body := fetch(t, newRequest(t, http.MethodHead, ts.URL+"/download?"+tt.query, nil))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("HEAD ?%s: status %d", tt.query, resp.StatusCode)
+		}
+		if resp.ContentLength != tt.want {
+			t.Errorf("HEAD ?%s: Content-Length = %d, want %d", tt.query, resp.ContentLength, tt.want)
+		}
+		if len(body) != 0 {
+			t.Errorf("HEAD ?%s: got a %d byte body", tt.query, len(body))
+		}
+	}
+}
+
+func TestDownloadChecksumTrailer(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []string{
+		"size=1",
+		"size=1000&pattern=zero",
+		"size=3MB&pattern=random&seed=7",
+		"size=100000&pattern=incrementing",
+	}
+	for _, query := range tests {
+		t.Run(query, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?checksum=sha256&"+query, nil)
+			req.Header.Set("Accept-Encoding", "identity")
+			resp, body := fetch(t, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+			if resp.ContentLength != -1 {
+				t.Errorf("Content-Length = %d, want a chunked response", resp.ContentLength)
+			}
+			sum := sha256.Sum256(body)
+			if got, want := resp.Trailer.Get("X-Content-SHA256"), hex.EncodeToString(sum[:]); got != want {
+				t.Errorf("trailer = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestGzipDownload(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		query string
+		size  int
+	}{
+		{"size=1000&pattern=incrementing", 1000},
+		{"size=5MB&pattern=incrementing", 5 * 1000 * 1000},
+		{"size=1MB&pattern=random", 1000 * 1000},
+		{"size=50000&pattern=zero&rate=1MB", 50000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?"+tt.query, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, body := fetch(t, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+				t.Fatalf("Content-Encoding = %q, want gzip", got)
+			}
+			if resp.ContentLength != -1 {
+				t.Errorf("Content-Length = %d on a compressed response", resp.ContentLength)
+			}
+			gz, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := io.Copy(io.Discard, gz)
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			if n != int64(tt.size) {
+				t.Errorf("decoded %d bytes, want %d", n, tt.size)
+			}
+		})
+	}
+}
+
+func TestDownloadBufsize(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantBytes  int
+	}{
+		{"size=100000&bufsize=1KiB", http.StatusOK, 100000},
+		{"size=1001&bufsize=1KiB", http.StatusOK, 1001},
+		{"size=5MB&bufsize=4MiB", http.StatusOK, 5 * 1000 * 1000},
+		{"size=1000&bufsize=1023", http.StatusBadRequest, 0},
+		{"size=1000&bufsize=5MiB", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?"+tt.query, nil)
+			req.Header.Set("Accept-Encoding", "identity")
+			resp, body := fetch(t, req)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus == http.StatusOK && len(body) != tt.wantBytes {
+				t.Errorf("received %d bytes, want %d", len(body), tt.wantBytes)
+			}
+		})
+	}
+}
+
+func TestJitteredDownload(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []string{
+		"size=20000&bufsize=1KiB&jitter=5",
+		"size=20000&bufsize=1KiB&jitter=5&rate=200KB",
+		"size=1&jitter=50",
+	}
+	for _, query := range tests {
+		t.Run(query, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?"+query, nil)
+			req.Header.Set("Accept-Encoding", "identity")
+			resp, body := fetch(t, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+			if int64(len(body)) != resp.ContentLength {
+				t.Errorf("received %d bytes, want %d", len(body), resp.ContentLength)
+			}
+		})
+	}
+}
+
+func TestJitterSleepIsCancelable(t *testing.T) {
+	logs := captureLogs(t, LogFormatText, LevelInfo)
+	_, ts := newTestServer(t, DefaultConfig())
+
+	// Pauses of up to a minute, so only cancellation can end this download in time
+	resp, err := http.Get(ts.URL + "/download?size=1MB&bufsize=1KiB&jitter=60000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Read(make([]byte, 1))
+	start := time.Now()
+	resp.Body.Close()
+	waitForLog(t, logs, "DOWNLOAD DISCONNECTED:")
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("download noticed the disconnect after %s", elapsed)
+	}
+}
+
+func TestChunkedDownload(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	for _, size := range []int{1, 32768, 1000000} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, fmt.Sprintf("%s/download?size=%d&chunked=true", ts.URL, size), nil)
+			req.Header.Set("Accept-Encoding", "identity")
+			resp, body := fetch(t, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+			if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+				t.Errorf("Content-Length = %d, want none", resp.ContentLength)
+			}
+			if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+				t.Errorf("Transfer-Encoding = %v, want chunked", resp.TransferEncoding)
+			}
+			if len(body) != size {
+				t.Errorf("received %d bytes, want %d", len(body), size)
+			}
+		})
+	}
+}
+
+func TestTimedDownload(t *testing.T) {
+	logs := captureLogs(t, LogFormatText, LevelInfo)
+	_, ts := newTestServer(t, DefaultConfig())
+
+	tests := []struct {
+		query string
+		d     time.Duration
+	}{
+		{"duration=200ms", 200 * time.Millisecond},
+		{"duration=200ms&size=10", 200 * time.Millisecond},
+		{"duration=300ms&rate=100KB", 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?"+tt.query, nil)
+			req.Header.Set("Accept-Encoding", "identity")
+			start := time.Now()
+			resp, body := fetch(t, req)
+			elapsed := time.Since(start)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+			if resp.ContentLength != -1 {
+				t.Errorf("Content-Length = %d on a timed stream", resp.ContentLength)
+			}
+			// size is ignored, so even size=10 streams for the whole duration
+			if len(body) <= 10 {
+				t.Errorf("received %d bytes", len(body))
+			}
+			if elapsed < tt.d || elapsed > tt.d+2*time.Second {
+				t.Errorf("stream took %s, want about %s", elapsed, tt.d)
+			}
+			waitForLog(t, logs, fmt.Sprintf("BytesSent=%d", len(body)))
+		})
+	}
+
+	for _, bad := range []string{"0s", "-1s", "forever", (MaxStreamDuration + time.Second).String()} {
+		if resp, _ := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/download?duration="+bad, nil)); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("duration=%s: status = %d, want %d", bad, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestFailAfter(t *testing.T) {
+	logs := captureLogs(t, LogFormatText, LevelInfo)
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		query     string
+		failAfter int64
+	}{
+		{"size=100000&fail_after=1000", 1000},
+		{"size=100000&fail_after=50000&bufsize=1KiB", 50000},
+		{"size=100000&fail_after=1000&chunked=true", 1000},
+	}
+	for i, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			reqID := fmt.Sprintf("fail-after-%d", i)
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?"+tt.query, nil)
+			req.Header.Set("Accept-Encoding", "identity")
+			req.Header.Set(RequestIDHeader, reqID)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			n, err := io.Copy(io.Discard, resp.Body)
+			if err == nil {
+				t.Error("the cut-off body read as complete")
+			}
+			if n != tt.failAfter {
+				t.Errorf("received %d bytes, want %d", n, tt.failAfter)
+			}
+			// The hijacked connection is no longer tracked by the test server, so wait for the
+			// handler to get this far rather than leave it running past the test
+			waitForLog(t, logs, "DOWNLOAD FAIL AFTER: Client=127.0.0.1 RequestID="+reqID)
+		})
+	}
+}
+
+func TestTTFB(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		name string
+		ttfb time.Duration
+	}{
+		{"no delay", 0},
+		{"delayed", 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := ts.URL + "/download?size=1000"
+			if tt.ttfb > 0 {
+				url += fmt.Sprintf("&ttfb=%d", tt.ttfb.Milliseconds())
+			}
+			start := time.Now()
+			resp, err := http.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			headers := time.Since(start)
+			if _, err := resp.Body.Read(make([]byte, 1)); err != nil {
+				t.Fatal(err)
+			}
+			firstByte := time.Since(start)
+
+			// The headers arrive right away; only the body waits
+			if headers > 200*time.Millisecond {
+				t.Errorf("headers took %s", headers)
+			}
+			if gap := firstByte - headers; gap < tt.ttfb-50*time.Millisecond || gap > tt.ttfb+200*time.Millisecond {
+				t.Errorf("first byte %s after the headers, want about %s", gap, tt.ttfb)
+			}
+		})
+	}
+}
+
+func TestDownloadSizeValidation(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxDownloadSize = 1000 * 1000 * 1000
+	_, ts := newTestServer(t, cfg)
+
+	tests := []struct {
+		size       string
+		wantStatus int
+		wantBody   string
+		wantLength string
+	}{
+		{size: "1GB", wantStatus: http.StatusOK, wantLength: "1000000000"},
+		{size: "10MB", wantStatus: http.StatusOK, wantLength: "10000000"},
+		{size: "1024", wantStatus: http.StatusOK, wantLength: "1024"},
+		{size: "lots", wantStatus: http.StatusBadRequest, wantBody: "size must be a number of bytes or a size such as 10MB"},
+		{size: "0", wantStatus: http.StatusBadRequest, wantBody: "size must be at least 1 byte"},
+		{size: "1001MB", wantStatus: http.StatusBadRequest, wantBody: "size must be at most 1000000000 bytes"},
+		{size: "1GiB", wantStatus: http.StatusBadRequest, wantBody: "size must be at most 1000000000 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.size, func(t *testing.T) {
+			// HEAD validates the size like GET without streaming a gigabyte
+			resp, _ := fetch(t, newRequest(t, http.MethodHead, ts.URL+"/download?size="+tt.size, nil))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("HEAD: status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantLength != "" {
+				if got := resp.Header.Get("Content-Length"); got != tt.wantLength {
+					t.Errorf("Content-Length %s, want %s", got, tt.wantLength)
+				}
+				return
+			}
+			_, body := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/download?size="+tt.size, nil))
+			if got := strings.TrimSpace(string(body)); got != tt.wantBody {
+				t.Errorf("error %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestBrotliDownload(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		query  string
+		accept string
+		size   int
+	}{
+		{"size=1000&pattern=incrementing", "br", 1000},
+		{"size=5MB&pattern=incrementing", "br", 5 * 1000 * 1000},
+		{"size=1MB&pattern=random&seed=7", "gzip, br", 1000 * 1000},
+		{"size=50000&pattern=zero&rate=1MB", "gzip, deflate, br", 50000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?"+tt.query, nil)
+			req.Header.Set("Accept-Encoding", tt.accept)
+			resp, body := fetch(t, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != "br" {
+				t.Fatalf("Content-Encoding = %q, want br", got)
+			}
+			if resp.ContentLength != -1 {
+				t.Errorf("Content-Length = %d on a compressed response", resp.ContentLength)
+			}
+			decoded, err := io.ReadAll(brotli.NewReader(bytes.NewReader(body)))
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			if len(decoded) != tt.size {
+				t.Errorf("decoded %d bytes, want %d", len(decoded), tt.size)
+			}
+
+			// The payload is the same one an uncompressed download carries
+			plain := newRequest(t, http.MethodGet, ts.URL+"/download?"+tt.query, nil)
+			plain.Header.Set("Accept-Encoding", "identity")
+			if _, want := fetch(t, plain); !bytes.Equal(decoded, want) {
+				t.Error("decoded body differs from the uncompressed download")
+			}
+		})
+	}
+}
+
+// flushCounter records a handler's response, counting its flushes
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (f *flushCounter) Flush() {
+	f.flushes++
+	f.ResponseRecorder.Flush()
+}
+
+func TestChunkParamFlushes(t *testing.T) {
+	s := NewServer(DefaultConfig())
+	tests := []struct {
+		query       string
+		wantStatus  int
+		wantFlushes int
+	}{
+		{"size=10&chunk=1", http.StatusOK, 10},
+		{"size=100&chunk=7", http.StatusOK, 15},
+		{"size=1000&chunk=1000", http.StatusOK, 1},
+		{"size=64KiB&chunk=1KiB&bufsize=4KiB", http.StatusOK, 64},
+		{"size=1MB&chunk=1", http.StatusBadRequest, 0},
+		{"size=10&chunk=0", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+			r := httptest.NewRequest(http.MethodGet, "/download?"+tt.query, nil)
+			r.Header.Set("Accept-Encoding", "identity")
+			s.downloadHandler(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.flushes != tt.wantFlushes {
+				t.Errorf("%d flushes, want %d", w.flushes, tt.wantFlushes)
+			}
+		})
+	}
+}
+
+func TestChunkParamOnTheWire(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /download?size=10&chunk=1&chunked=true HTTP/1.1\r\nHost: test\r\nAccept-Encoding: identity\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+
+	// Every flushed byte travels as an HTTP chunk of its own, up to the terminating empty chunk.
+	// http.ReadResponse has only read the header, so the raw chunks are still in br.
+	var sizes []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := strings.TrimSpace(line)
+		if size == "0" {
+			break
+		}
+		sizes = append(sizes, size)
+		if _, err := br.Discard(len("x\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := strings.Join(sizes, ","); got != "1,1,1,1,1,1,1,1,1,1" {
+		t.Errorf("chunk sizes %v, want ten chunks of 1 byte", sizes)
+	}
+}
+
+func TestFileBackedDownload(t *testing.T) {
+	// An odd-sized file shows where each repetition starts
+	contents := make([]byte, 1000)
+	for i := range contents {
+		contents[i] = byte('a' + i%26)
+	}
+	contents[0] = '#'
+	path := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(path, contents, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.DownloadFile = path
+	_, ts := newTestServer(t, cfg)
+
+	// expected is the file repeated from offset for size bytes
+	expected := func(offset, size int) []byte {
+		want := make([]byte, size)
+		for i := range want {
+			want[i] = contents[(offset+i)%len(contents)]
+		}
+		return want
+	}
+	tests := []struct {
+		name       string
+		query      string
+		header     map[string]string
+		wantStatus int
+		wantOffset int
+		wantSize   int
+	}{
+		{"smaller than the file", "size=300", nil, http.StatusOK, 0, 300},
+		{"exactly the file", "size=1000", nil, http.StatusOK, 0, 1000},
+		{"repeated", "size=123456", nil, http.StatusOK, 0, 123456},
+		{"range across the end of the file", "size=5000", map[string]string{"Range": "bytes=995-1004"},
+			http.StatusPartialContent, 995, 10},
+		// Shaped downloads go through the buffer instead of sendfile, with the same bytes
+		{"chunked", "size=5000&chunk=700", nil, http.StatusOK, 0, 5000},
+		{"throttled", "size=5000&rate=1MB", nil, http.StatusOK, 0, 5000},
+		{"gzip", "size=5000", map[string]string{"Accept-Encoding": "gzip"}, http.StatusOK, 0, 5000},
+		{"pattern", "size=5000&pattern=random", nil, http.StatusBadRequest, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?"+tt.query, nil)
+			req.Header.Set("Accept-Encoding", "identity")
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			resp, body := fetch(t, req)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus == http.StatusBadRequest {
+				return
+			}
+			if resp.Header.Get("Content-Encoding") == "gzip" {
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(body) != tt.wantSize {
+				t.Fatalf("received %d bytes, want %d", len(body), tt.wantSize)
+			}
+			if !bytes.Equal(body, expected(tt.wantOffset, tt.wantSize)) {
+				t.Error("body is not the file repeated to the requested size")
+			}
+		})
+	}
+}
+
+func TestTextPatternDownload(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		name       string
+		query      string
+		rangeStart int
+		wantStatus int
+		wantUnit   string
+		wantSize   int
+	}{
+		{"marker", "size=100&text=HELLO", 0, http.StatusOK, "HELLO", 100},
+		{"cut mid-marker", "size=13&text=HELLO", 0, http.StatusOK, "HELLO", 13},
+		{"shorter than the marker", "size=3&text=HELLO", 0, http.StatusOK, "HELLO", 3},
+		{"default text", "size=1000&pattern=text", 0, http.StatusOK, DefaultPatternText, 1000},
+		{"across writes", "size=100003&text=abc-123%0A&bufsize=1KiB", 0, http.StatusOK, "abc-123\n", 100003},
+		{"non-printable bytes", "size=50&text=" + url.QueryEscape("tab\there\x00é"), 0, http.StatusOK, "tab.here...", 50},
+		{"range", "size=100&text=HELLO", 7, http.StatusPartialContent, "HELLO", 10},
+		{"too long", "size=100&text=" + strings.Repeat("x", MaxPatternText+1), 0, http.StatusBadRequest, "", 0},
+		{"with another pattern", "size=100&text=HELLO&pattern=zero", 0, http.StatusBadRequest, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?"+tt.query, nil)
+			req.Header.Set("Accept-Encoding", "identity")
+			if tt.wantStatus == http.StatusPartialContent {
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", tt.rangeStart, tt.rangeStart+tt.wantSize-1))
+			}
+			resp, body := fetch(t, req)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus == http.StatusBadRequest {
+				return
+			}
+			if got := resp.Header.Get("Content-Type"); got != "text/plain; charset=us-ascii" {
+				t.Errorf("Content-Type = %q", got)
+			}
+			repeated := strings.Repeat(tt.wantUnit, (tt.rangeStart+tt.wantSize)/len(tt.wantUnit)+1)
+			if want := repeated[tt.rangeStart : tt.rangeStart+tt.wantSize]; string(body) != want {
+				t.Errorf("body = %.60q, want %.60q", body, want)
+			}
+		})
+	}
+}
+
+func TestDownloadStreamReset(t *testing.T) {
+	// One capture for the whole server, whose handlers may still be logging as a subtest ends
+	logs := captureLogs(t, LogFormatText, LevelInfo)
+	cfg := DefaultConfig()
+	cfg.H2C = true
+	_, ts := newTestServer(t, cfg)
+
+	tests := []struct {
+		name      string
+		h2        bool
+		cut       func(cancel context.CancelFunc, conn net.Conn)
+		wantLog   string
+		wantReuse bool
+	}{
+		{"HTTP/2 stream canceled", true, func(cancel context.CancelFunc, _ net.Conn) { cancel() },
+			"DOWNLOAD STREAM RESET: ", true},
+		{"HTTP/2 connection closed", true, func(_ context.CancelFunc, conn net.Conn) { conn.Close() },
+			"DOWNLOAD DISCONNECTED: ", false},
+		{"HTTP/1.1 canceled", false, func(cancel context.CancelFunc, _ net.Conn) { cancel() },
+			"DOWNLOAD DISCONNECTED: ", false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqID := fmt.Sprintf("stream-%d", i)
+			conns := make(chan net.Conn, 2)
+			dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				conn, err := d.DialContext(ctx, network, addr)
+				if err == nil {
+					conns <- conn
+				}
+				return conn, err
+			}
+			var transport http.RoundTripper = &http.Transport{DialContext: dial}
+			if tt.h2 {
+				transport = &http2.Transport{AllowHTTP: true,
+					DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+						return dial(ctx, network, addr)
+					}}
+			}
+			client := &http.Client{Transport: transport}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?size=10MB&rate=100KB", nil).WithContext(ctx)
+			req.Header.Set("Accept-Encoding", "identity")
+			req.Header.Set(RequestIDHeader, reqID)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if _, err := io.ReadFull(resp.Body, make([]byte, 1000)); err != nil {
+				t.Fatal(err)
+			}
+			tt.cut(cancel, <-conns)
+
+			waitForLog(t, logs, tt.wantLog+"Client=127.0.0.1 RequestID="+reqID)
+			if strings.Contains(logs.String(), "DOWNLOAD SUCCESS") {
+				t.Errorf("download kept streaming to the end:\n%s", logs.String())
+			}
+			// A reset stream leaves its connection to the other streams
+			if tt.wantReuse {
+				resp, err := client.Get(ts.URL + "/ping")
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if len(conns) != 0 {
+					t.Error("the client had to open a new connection after the reset")
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadBufferPool(t *testing.T) {
+	const pooled = DefaultBufferSize
+	tests := []struct {
+		name     string
+		size     int
+		put      int
+		wantPool bool
+	}{
+		{"pooled size", pooled, pooled, true},
+		{"custom bufsize", 64 * 1024, 64 * 1024, false},
+		// Left over from before a reload changed -buffer-size
+		{"stale pooled buffer", pooled, 16 * 1024, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dirty := make([]byte, tt.put)
+			for i := range dirty {
+				dirty[i] = 0xff
+			}
+			if tt.put == pooled {
+				putDownloadBuffer(&dirty, pooled)
+			} else {
+				downloadBuffers.Put(&dirty)
+			}
+			bp := getDownloadBuffer(tt.size, pooled)
+			defer putDownloadBuffer(bp, pooled)
+			if len(*bp) != tt.size {
+				t.Fatalf("got a %d byte buffer, want %d", len(*bp), tt.size)
+			}
+			if !tt.wantPool && &(*bp)[0] == &dirty[0] {
+				t.Error("got the pooled buffer for a size it does not have")
+			}
+			// The pool may have dropped the buffer, but one handed out again must be zeroed
+			if !bytes.Equal(*bp, make([]byte, tt.size)) {
+				t.Error("buffer is not zeroed")
+			}
+		})
+	}
+}
+
+func TestPooledDownloadsStayCorrect(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	// The zero pattern writes the buffer as it is, so a reused buffer holding old bytes would show
+	tests := []struct {
+		query string
+		want  func(i int) byte
+	}{
+		{"size=200000&pattern=incrementing", func(i int) byte { return byte(i) }},
+		{"size=200000&pattern=zero", func(int) byte { return 0 }},
+		{"size=200000&pattern=incrementing&bufsize=4KiB", func(i int) byte { return byte(i) }},
+		{"size=200000&pattern=zero&bufsize=4KiB", func(int) byte { return 0 }},
+	}
+	var wg sync.WaitGroup
+	for round := 0; round < 4; round++ {
+		for _, tt := range tests {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := newRequest(t, http.MethodGet, ts.URL+"/download?"+tt.query, nil)
+				req.Header.Set("Accept-Encoding", "identity")
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				if err != nil || len(body) != 200000 {
+					t.Errorf("%s: received %d bytes (%v)", tt.query, len(body), err)
+					return
+				}
+				for i, b := range body {
+					if b != tt.want(i) {
+						t.Errorf("%s: byte %d = %#x, want %#x", tt.query, i, b, tt.want(i))
+						return
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// discardResponse is a ResponseWriter that throws the body away, so a benchmark measures the
+// handler rather than a recorder's buffer
+type discardResponse struct {
+	header http.Header
+}
+
+func (w *discardResponse) Header() http.Header         { return w.header }
+func (w *discardResponse) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponse) WriteHeader(int)             {}
+
+func BenchmarkDownload(b *testing.B) {
+	s := NewServer(DefaultConfig())
+	h := s.Handler()
+	for _, bm := range []struct {
+		name  string
+		query string
+	}{
+		// The default buffer size comes from the pool; a custom bufsize allocates every time
+		{"pooled", "size=64KiB"},
+		{"custom bufsize", "size=64KiB&bufsize=64KiB"},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, "/download?"+bm.query, nil)
+			req.Header.Set("Accept-Encoding", "identity")
+			b.ReportAllocs()
+			b.SetBytes(64 * 1024)
+			for i := 0; i < b.N; i++ {
+				h.ServeHTTP(&discardResponse{header: http.Header{}}, req)
+			}
+		})
+	}
+}
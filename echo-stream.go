@@ -2,16 +2,24 @@ package main
 
 import (
 	"context"
-	"io"
-	"log"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const (
@@ -20,166 +28,513 @@ const (
 	MaxUploadSize       = 32 * 1024 * 1024  // 32MB limit
 	DefaultDownloadSize = 2 * 1024 * 1024   // 2MB default
 	ServerTimeout       = 30 * time.Second
+	ShutdownTimeout     = 5 * time.Second
 	ServerPort          = ":8080"
 )
 
-// getClientIP extracts the real client IP from various headers
-func getClientIP(r *http.Request) string {
-	// Check Cloudflare/Load balancer headers first
-	if ip := r.Header.Get("CF-Connecting-IP"); ip != "" {
-		return ip
-	}
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		// X-Forwarded-For can contain multiple IPs, take the first one
-		ips := strings.Split(ip, ",")
-		return strings.TrimSpace(ips[0])
-	}
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		return ip
-	}
+// Server holds the configuration and state shared by the HTTP handlers
+type Server struct {
+	// cfg and the limiters are swapped as a whole when SIGHUP reloads the configuration;
+	// nil limiters are unlimited
+	cfg       atomic.Pointer[Config]
+	metrics   *Metrics
+	perClient atomic.Pointer[clientLimiter]
+	rateLimit atomic.Pointer[rateLimiter]        // per-client request rate
+	egress    atomic.Pointer[egressLimiter]      // server-wide download rate
+	inflight  atomic.Pointer[concurrencyLimiter] // -max-concurrent slots
+
+	// shutdown is closed when the server stops, for connections net/http does not track
+	// such as WebSockets and raw TCP echoes; conns counts them so shutdown can wait
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	conns        sync.WaitGroup
+
+	// subsystems are the listeners besides HTTP, closed on shutdown; stopped closes late arrivals
+	subsystemsMu sync.Mutex
+	subsystems   []*subsystem
+	stopped      bool
+
+	// Open connection counts, reported when shutdown has to force them closed
+	httpOpen atomic.Int64
+	echoOpen atomic.Int64
+
+	// draining fails health checks so load balancers stop routing here before shutdown
+	draining atomic.Bool
+	// warming fails health checks until -prewarm has finished
+	warming atomic.Bool
+}
 
-	// Fall back to remote address
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
+// NewServer returns a Server whose handlers honor the limits in cfg
+func NewServer(cfg *Config) *Server {
+	s := &Server{
+		metrics:  NewMetrics(),
+		shutdown: make(chan struct{}),
 	}
-	return ip
+	s.cfg.Store(cfg)
+	s.applyLimits(cfg, nil)
+	return s
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	// Log incoming request
-	clientIP := getClientIP(r)
-	log.Printf("UPLOAD REQUEST: Client=%s Method=%s URL=%s ContentLength=%d UserAgent=%s",
-		clientIP, r.Method, r.URL.Path, r.ContentLength, r.UserAgent())
+// config returns the current configuration; handlers take it once so a request sees one consistent version
+func (s *Server) config() *Config {
+	return s.cfg.Load()
+}
 
-	// Limit request body size to prevent abuse
-	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
-	defer r.Body.Close()
+// Shutdown stops the TCP and UDP listeners and tells long-lived connections such as WebSockets and
+// TCP echoes to close; it is safe to call more than once
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		s.stopSubsystems()
+		close(s.shutdown)
+	})
+}
 
-	// Stream request body directly to discard
-	bytesRead, err := io.Copy(io.Discard, r.Body)
-	if err != nil {
-		log.Printf("UPLOAD ERROR: Client=%s Error=%v BytesRead=%d", clientIP, err, bytesRead)
-		http.Error(w, "Request too large or processing error", http.StatusRequestEntityTooLarge)
-		return
-	}
+// connOpened registers a connection outside net/http so shutdown waits for it; pair it with connClosed
+func (s *Server) connOpened() {
+	s.conns.Add(1)
+	s.echoOpen.Add(1)
+}
 
-	log.Printf("UPLOAD SUCCESS: Client=%s BytesReceived=%d", clientIP, bytesRead)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("ok"))
+func (s *Server) connClosed() {
+	s.echoOpen.Add(-1)
+	s.conns.Done()
 }
 
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	clientIP := getClientIP(r)
-	sizeStr := r.URL.Query().Get("size")
-	if sizeStr == "" {
-		sizeStr = strconv.Itoa(DefaultDownloadSize)
+// trackConn counts open HTTP connections; it is installed as http.Server.ConnState
+func (s *Server) trackConn(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		s.httpOpen.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		s.httpOpen.Add(-1)
 	}
+}
 
-	log.Printf("DOWNLOAD REQUEST: Client=%s Method=%s URL=%s RequestedSize=%s UserAgent=%s",
-		clientIP, r.Method, r.URL.Path, sizeStr, r.UserAgent())
+// trackH2C counts cleartext HTTP/2 requests like echo connections: h2c hijacks its connections,
+// so net/http's Shutdown would otherwise return while they are still streaming
+func (s *Server) trackH2C(next http.Handler) http.Handler {
+	if !s.config().H2C {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 {
+			s.connOpened()
+			defer s.connClosed()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-	size, err := strconv.Atoi(sizeStr)
-	if err != nil {
-		log.Printf("DOWNLOAD ERROR: Client=%s InvalidSize=%s Error=%v", clientIP, sizeStr, err)
-		http.Error(w, "invalid size parameter", http.StatusBadRequest)
-		return
+// Wait blocks until the subsystems have stopped and connections outside net/http have closed
+// after Shutdown, or ctx is done
+func (s *Server) Wait(ctx context.Context) error {
+	if err := s.waitSubsystems(ctx); err != nil {
+		return err
 	}
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	// Validate size bounds
-	if size <= 0 || size > MaxDownloadSize {
-		log.Printf("DOWNLOAD ERROR: Client=%s SizeOutOfBounds=%d Min=1 Max=%d", clientIP, size, MaxDownloadSize)
-		http.Error(w, "size must be between 1 and 104857600 bytes", http.StatusBadRequest)
-		return
+// Routes registers the endpoints on a new mux
+func (s *Server) Routes() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Each endpoint is measured; only the streaming endpoints count against the concurrency limits
+	handle := func(pattern, endpoint string, h http.HandlerFunc, mws ...middleware) {
+		mux.Handle(pattern, chain(h, append([]middleware{s.observe(endpoint)}, mws...)...))
 	}
+	cfg := s.config()
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.Itoa(size))
-	w.WriteHeader(http.StatusOK)
+	// Wrong methods are turned away before they take a concurrency slot
+	uploadMethods := s.allowMethods(http.MethodPost, http.MethodPut)
+	getMethods := s.allowMethods(http.MethodGet, http.MethodHead)
 
-	buf := make([]byte, DefaultBufferSize)
-	written := 0
+	// Disabled endpoints are left off the mux, so they answer 404 like any unknown path
+	if cfg.EnableUpload {
+		handle("/upload", "upload", s.uploadHandler, uploadMethods, s.limitConcurrent, s.limitPerClient, s.limitDuration)
+	}
+	if cfg.EnableDownload {
+		handle("/download", "download", s.downloadHandler, getMethods, s.limitConcurrent, s.limitPerClient, s.limitDuration)
+	}
+	if cfg.EnableHealth {
+		handle("/livez", "livez", s.livezHandler, getMethods)
+		handle("/readyz", "readyz", s.readyzHandler, getMethods)
+		handle("/health", "readyz", s.readyzHandler, getMethods) // kept for existing health checks
+	}
+	handle("/ping", "ping", s.pingHandler)
+	mux.HandleFunc("/metrics", s.metricsHandler)
+	mux.HandleFunc("/stats", s.statsHandler)
+	handle("/version", "version", s.versionHandler)
+	handle("/echo", "echo", s.reflectHandler)
+	handle("/delay", "delay", s.delayHandler)
+	handle("/status", "status", s.statusHandler)
+	handle("/ws", "ws", s.wsHandler)
+	handle("/events", "events", s.eventsHandler)
+	handle("/redirect", "redirect", s.redirectHandler)
+	handle("/cookies", "cookies", s.cookiesHandler)
+	if cfg.EnableIndex {
+		// {$} matches / alone, so unknown paths still get 404
+		handle("/{$}", "index", s.indexHandler)
+	}
 
-	log.Printf("DOWNLOAD START: Client=%s TotalSize=%d", clientIP, size)
+	// Admin endpoints change server state, so they only exist behind authentication
+	if cfg.AuthToken != "" || cfg.BasicUser != "" {
+		handle("/admin/drain", "admin_drain", s.drainHandler)
+	}
 
-	for written < size {
-		// Check if client disconnected
-		select {
-		case <-r.Context().Done():
-			log.Printf("DOWNLOAD DISCONNECTED: Client=%s BytesSent=%d Total=%d", clientIP, written, size)
-			return
-		default:
-		}
+	// Profiling handlers leak internals, so they are opt-in
+	if cfg.Pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
 
-		toWrite := len(buf)
-		if size-written < toWrite {
-			toWrite = size - written
-		}
+	return mux
+}
 
-		_, err := w.Write(buf[:toWrite])
-		if err != nil {
-			log.Printf("DOWNLOAD WRITE ERROR: Client=%s BytesSent=%d Error=%v", clientIP, written, err)
-			return
-		}
+// Handler returns the endpoints behind the middleware every request passes through
+func (s *Server) Handler() http.Handler {
+	return chain(s.Routes(), s.trackH2C, requestID, s.debugClientIP, s.exposeClientCert, s.logAccess, s.logRequests,
+		s.recoverPanics, s.cors, s.requireAuth, s.limitRate)
+}
 
-		// Flush to ensure data is sent immediately
-		if flusher, ok := w.(http.Flusher); ok {
-			flusher.Flush()
-		}
+// disabledEndpoints lists the paths switched off by the -enable-* flags
+func disabledEndpoints(cfg *Config) []string {
+	var paths []string
+	if !cfg.EnableUpload {
+		paths = append(paths, "/upload")
+	}
+	if !cfg.EnableDownload {
+		paths = append(paths, "/download")
+	}
+	if !cfg.EnableHealth {
+		paths = append(paths, "/health", "/livez", "/readyz")
+	}
+	if !cfg.EnableIndex {
+		paths = append(paths, "/")
+	}
+	return paths
+}
 
-		written += toWrite
+// newHTTPServer builds the HTTP server from the resolved configuration
+func newHTTPServer(cfg *Config, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:         cfg.Port,
+		Handler:      handler,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+		// Also bounds HTTP/2 header lists, which ConfigureServer derives from it
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
 	}
+	if cfg.H2C {
+		// h2c takes connections over from net/http, so the HTTP/2 server is also registered
+		// on it to send GOAWAY on shutdown. ConfigureServer can only fail on TLS settings.
+		h2s := &http2.Server{IdleTimeout: cfg.IdleTimeout}
+		http2.ConfigureServer(server, h2s)
+		server.Handler = h2c.NewHandler(handler, h2s)
+	}
+	return server
+}
 
-	log.Printf("DOWNLOAD SUCCESS: Client=%s BytesSent=%d", clientIP, written)
+// wantsJSON reports whether the client asked for a JSON response
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	clientIP := getClientIP(r)
-	log.Printf("HEALTH CHECK: Client=%s Method=%s URL=%s UserAgent=%s",
-		clientIP, r.Method, r.URL.Path, r.UserAgent())
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logError("JSON_ENCODE_ERROR", "Error", err)
+	}
+}
 
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("healthy"))
+// positiveQueryInt parses the named query parameter as a positive integer, returning 0 when absent
+func positiveQueryInt(r *http.Request, name string) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %d", name, n)
+	}
+	return n, nil
 }
 
 func main() {
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/upload", uploadHandler)
-	mux.HandleFunc("/download", downloadHandler)
-	mux.HandleFunc("/health", healthHandler)
-
-	server := &http.Server{
-		Addr:         ServerPort,
-		Handler:      mux,
-		ReadTimeout:  ServerTimeout,
-		WriteTimeout: ServerTimeout,
-		IdleTimeout:  ServerTimeout,
+	cfg, err := resolveConfig(os.Args[1:])
+	if err != nil {
+		logFatal("CONFIG_ERROR", "Error", err)
 	}
+	level, _ := parseLogLevel(cfg.LogLevel)
+	setLogOutput(os.Stderr, cfg.LogFormat, level)
+	var logs *logFile
+	if cfg.LogFile != "" {
+		logs, err = openLogFile(cfg.LogFile)
+		if err != nil {
+			logFatal("LOG_FILE_ERROR", "Path", cfg.LogFile, "Error", err)
+		}
+		setLogOutput(logs, cfg.LogFormat, level)
+		accessLog.SetOutput(logs)
+	}
+	logLifecycle(EventServerStarting)
+	procs, source := applyMaxProcs(cfg)
+	logInfo("MAXPROCS", "GOMAXPROCS", procs, "Source", source, "NumCPU", runtime.NumCPU())
+
+	app := NewServer(cfg)
+	server := newHTTPServer(cfg, app.Handler())
+	server.RegisterOnShutdown(app.Shutdown)
+	server.ConnState = app.trackConn
+	server.ConnContext = watchConnContext
 
 	// Handle graceful shutdown
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
-	log.Printf("SERVER STARTING: Port=%s Timeout=%v PID=%d", ServerPort, ServerTimeout, os.Getpid())
-	log.Printf("ENDPOINTS: UPLOAD=/upload DOWNLOAD=/download HEALTH=/health")
+	ln, err := listen(cfg)
+	if err != nil {
+		logFatal("SERVER_ERROR", "Message", "failed to listen", "Addr", server.Addr, "UnixSocket", cfg.UnixSocket,
+			"Error", err)
+	}
+	if cfg.ProxyProtocol != "" {
+		ln = newProxyListener(ln, cfg.ProxyProtocol, app.trustsProxy)
+	}
+	ln = watchedListener{Listener: ln}
+
+	logInfo("SERVER_STARTING", "Version", version, "Commit", commit, "BuildTime", buildTime,
+		"Addr", ln.Addr(), "ReadTimeout", server.ReadTimeout, "WriteTimeout", server.WriteTimeout,
+		"IdleTimeout", server.IdleTimeout, "KeepAlive", cfg.KeepAlive, "MaxHeaderBytes", server.MaxHeaderBytes,
+		"ListenBacklog", cfg.ListenBacklog,
+		"PID", os.Getpid())
+	logInfo("LIMITS", "BufferSize", cfg.BufferSize, "MaxUpload", cfg.MaxUploadSize,
+		"MaxDownload", cfg.MaxDownloadSize, "DefaultDownload", cfg.DefaultDownloadSize, "MaxPerClient", cfg.MaxPerClient,
+		"MaxConcurrent", cfg.MaxConcurrent, "RateLimit", cfg.RateLimit, "RateBurst", cfg.RateBurst,
+		"MaxEgress", cfg.MaxEgress, "MaxRequestDuration", cfg.MaxRequestDuration)
+	if len(cfg.TrustedProxies) > 0 {
+		cidrs := make([]string, len(cfg.TrustedProxies))
+		for i, ipNet := range cfg.TrustedProxies {
+			cidrs[i] = ipNet.String()
+		}
+		logInfo("TRUSTED_PROXIES", "CIDRs", strings.Join(cidrs, ","), "ForwardedHops", cfg.ForwardedHops)
+	} else {
+		logWarn("PROXY_WARNING", "Message", "no -trusted-proxies set, forwarding headers are honored from any client")
+	}
+	logInfo("ENDPOINTS", "UPLOAD", "/upload", "DOWNLOAD", "/download", "HEALTH", "/health",
+		"LIVEZ", "/livez", "READYZ", "/readyz",
+		"PING", "/ping", "METRICS", "/metrics", "DELAY", "/delay", "STATUS", "/status", "WS", "/ws",
+		"EVENTS", "/events", "STATS", "/stats", "VERSION", "/version", "ECHO", "/echo",
+		"REDIRECT", "/redirect", "COOKIES", "/cookies", "INDEX", "/")
+	if disabled := disabledEndpoints(cfg); len(disabled) > 0 {
+		logInfo("ENDPOINTS_DISABLED", "Endpoints", strings.Join(disabled, ","))
+	}
+	if cfg.AuthToken != "" {
+		logInfo("AUTH", "Scheme", "Bearer", "Exempt", "/health,/livez,/readyz")
+	}
+	if cfg.BasicUser != "" {
+		logInfo("AUTH", "Scheme", "Basic", "User", cfg.BasicUser, "Exempt", "/health,/livez,/readyz")
+	}
+	if cfg.ProxyProtocol != "" {
+		logInfo("PROXY_PROTOCOL", "Mode", cfg.ProxyProtocol, "HeaderTimeout", ProxyHeaderTimeout)
+	}
+	if len(cfg.CORSOrigins) > 0 {
+		logInfo("CORS", "Origins", strings.Join(cfg.CORSOrigins, ","))
+	}
+	if cfg.AuthToken != "" || cfg.BasicUser != "" {
+		logInfo("ADMIN", "Drain", "/admin/drain")
+	}
+	if cfg.Pprof {
+		logWarn("PPROF_WARNING", "Path", "/debug/pprof/",
+			"Message", "profiling enabled, do not expose publicly")
+	}
 
+	switch {
+	case cfg.TLSSelfSigned:
+		cert, err := selfSignedCert()
+		if err != nil {
+			logFatal("TLS_ERROR", "Message", "failed to generate self-signed certificate", "Error", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		logInfo("SERVER_MODE", "Mode", "HTTPS", "SelfSigned", true, "Hosts", "localhost,127.0.0.1",
+			"Validity", SelfSignedValidity)
+		logWarn("TLS_WARNING", "Message", "serving a self-signed certificate, do not use in production")
+	case cfg.TLSEnabled():
+		logInfo("SERVER_MODE", "Mode", "HTTPS", "Cert", cfg.TLSCert, "Key", cfg.TLSKey)
+	default:
+		logInfo("SERVER_MODE", "Mode", "HTTP", "H2C", cfg.H2C)
+	}
+	if cfg.TLSEnabled() {
+		// Both were validated with the configuration
+		minVersion, _ := parseTLSVersion(cfg.TLSMinVersion)
+		suites, _ := parseCipherSuites(cfg.TLSCipherSuites)
+		if server.TLSConfig == nil {
+			server.TLSConfig = &tls.Config{}
+		}
+		server.TLSConfig.MinVersion = minVersion
+		server.TLSConfig.CipherSuites = suites
+		cipherSuites := cfg.TLSCipherSuites
+		if cipherSuites == "" {
+			cipherSuites = "default"
+		}
+		logInfo("TLS_POLICY", "MinVersion", cfg.TLSMinVersion, "CipherSuites", cipherSuites)
+	}
+	if cfg.TLSClientCA != "" {
+		pool, err := loadClientCAs(cfg.TLSClientCA)
+		if err != nil {
+			logFatal("TLS_ERROR", "Message", "failed to load client CAs", "Path", cfg.TLSClientCA, "Error", err)
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		logInfo("TLS_CLIENT_AUTH", "ClientCA", cfg.TLSClientCA, "Mode", "require and verify")
+	}
+
+	// The raw TCP and UDP echoes share the HTTP server's lifetime; failing to bind them is as fatal as the main port.
+	// Their bound addresses are logged, which tell the actual ports when configured with port 0.
+	var tcpAddr, udpAddr string
+	if cfg.TCPPort != "" {
+		tcp, err := net.Listen("tcp", cfg.TCPPort)
+		if err == nil {
+			err = setBacklog(tcp, cfg.ListenBacklog)
+		}
+		if err != nil {
+			logFatal("TCP_ERROR", "Message", "failed to listen", "Addr", cfg.TCPPort, "Error", err)
+		}
+		ln := newRetryListener(tcp)
+		tcpAddr = tcp.Addr().String()
+		logInfo("TCP_ECHO", "Addr", tcpAddr, "IdleTimeout", cfg.TCPIdleTimeout, "KeepAlive", cfg.KeepAlive)
+		var accepted net.Listener = keepAliveListener{Listener: ln, period: cfg.KeepAlive}
+		if cfg.ProxyProtocol != "" {
+			accepted = newProxyListener(accepted, cfg.ProxyProtocol, app.trustsProxy)
+		}
+		app.startSubsystem("tcp_echo", ln, func() { app.serveTCP(accepted) })
+	}
+	if cfg.UDPPort != "" {
+		pc, err := net.ListenPacket("udp", cfg.UDPPort)
+		if err != nil {
+			logFatal("UDP_ERROR", "Message", "failed to listen", "Addr", cfg.UDPPort, "Error", err)
+		}
+		udpAddr = pc.LocalAddr().String()
+		logInfo("UDP_ECHO", "Addr", udpAddr, "MaxDatagram", cfg.UDPMaxDatagram)
+		app.startSubsystem("udp_echo", pc, func() { app.serveUDP(pc) })
+	}
+
+	app.warming.Store(cfg.Prewarm)
+	go func() {
+		var err error
+		if cfg.TLSEnabled() {
+			// Cert and key are empty in self-signed mode, which uses server.TLSConfig instead
+			err = server.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+		} else {
+			err = server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logFatal("SERVER_ERROR", "Message", "failed to start", "Error", err)
+		}
+	}()
+
+	// Liveness probes are answered while prewarming, readiness waits for it
+	if cfg.Prewarm {
+		app.prewarm(cfg)
+	}
+
+	// The listener is bound and listening, so the kernel already queues connections for Serve
+	logLifecycle(EventServerReady, "Addr", ln.Addr(), "TLS", cfg.TLSEnabled(), "TCPEcho", tcpAddr,
+		"UDPEcho", udpAddr)
+
+	// SIGHUP re-reads the environment file and flags, applying what can change without a restart.
+	// Both it and SIGUSR1 reopen the log file for logrotate; SIGUSR1 does nothing else.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP, syscall.SIGUSR1)
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("SERVER ERROR: Failed to start: %v", err)
+		for sig := range hup {
+			if logs != nil {
+				if err := logs.Reopen(); err != nil {
+					logError("LOG_FILE_ERROR", "Path", cfg.LogFile, "Signal", sig, "Error", err)
+				} else {
+					logInfo("LOG_FILE_REOPENED", "Path", cfg.LogFile, "Signal", sig)
+				}
+			}
+			if sig == syscall.SIGUSR1 {
+				continue
+			}
+			next, err := resolveConfig(os.Args[1:])
+			if err != nil {
+				logError("CONFIG_RELOAD_ERROR", "Error", err)
+				continue
+			}
+			app.Reload(next)
 		}
 	}()
 
-	<-stop
-	log.Println("SERVER SHUTDOWN: Received termination signal")
+	// Past -max-lifetime the server stops itself the way a SIGTERM would, drain delay included,
+	// for the orchestrator to start a fresh one
+	if cfg.MaxLifetime > 0 {
+		logInfo("MAX_LIFETIME", "MaxLifetime", cfg.MaxLifetime,
+			"ShutdownAt", time.Now().Add(cfg.MaxLifetime).Format(time.RFC3339))
+		time.AfterFunc(cfg.MaxLifetime, func() {
+			logInfo("MAX_LIFETIME_REACHED", "MaxLifetime", cfg.MaxLifetime)
+			select {
+			case stop <- syscall.SIGTERM:
+			default:
+			}
+		})
+	}
+
+	sig := <-stop
+	logLifecycle(EventServerShuttingDown, "Signal", sig, "DrainDelay", cfg.DrainDelay)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// On SIGTERM fail health checks first and keep serving while the load balancer notices;
+	// a second signal skips the rest of the delay
+	if sig == syscall.SIGTERM && cfg.DrainDelay > 0 {
+		app.draining.Store(true)
+		server.SetKeepAlivesEnabled(false)
+		logInfo("SERVER_DRAINING", "Signal", sig, "DrainDelay", cfg.DrainDelay)
+		select {
+		case <-time.After(cfg.DrainDelay):
+		case sig = <-stop:
+		}
+	}
+	logInfo("SERVER_SHUTDOWN", "Signal", sig)
+
+	shutdownStart := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 	defer cancel()
 
+	// Connections still busy when the timeout expires are cut off rather than waited for
+	graceful := true
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("SERVER SHUTDOWN ERROR: Forced shutdown: %v", err)
+		graceful = false
+		logWarn("SERVER_SHUTDOWN_TIMEOUT", "Timeout", cfg.ShutdownTimeout, "ForcedConnections", app.httpOpen.Load(),
+			"Error", err)
+		server.Close()
+	}
+	logInfo("SUBSYSTEM_STOPPED", "Name", "http")
+	if err := app.Wait(ctx); err != nil {
+		graceful = false
+		logWarn("SERVER_SHUTDOWN_TIMEOUT", "Timeout", cfg.ShutdownTimeout, "ForcedEchoConnections", app.echoOpen.Load(),
+			"Error", err)
 	}
 
-	log.Println("SERVER STOPPED: Exited gracefully")
+	if graceful {
+		logInfo("SERVER_STOPPED", "Message", "exited gracefully", "Duration", time.Since(shutdownStart))
+	} else {
+		logInfo("SERVER_STOPPED", "Message", "forced shutdown", "Duration", time.Since(shutdownStart))
+	}
+	logLifecycle(EventServerStopped, "Graceful", graceful, "ShutdownSeconds", time.Since(shutdownStart).Seconds())
 }
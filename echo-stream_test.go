@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestCustomConfigLimits(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.BufferSize = 1024
+	cfg.DefaultDownloadSize = 1000
+	cfg.MaxDownloadSize = 4096
+	cfg.MaxUploadSize = 512
+	_, ts := newTestServer(t, cfg)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     []byte
+		wantCode int
+		wantLen  int
+	}{
+		{"default download size", http.MethodGet, "/download", nil, http.StatusOK, 1000},
+		{"download at the limit", http.MethodGet, "/download?size=4096", nil, http.StatusOK, 4096},
+		{"download over the limit", http.MethodGet, "/download?size=4097", nil, http.StatusBadRequest, -1},
+		{"upload at the limit", http.MethodPost, "/upload", make([]byte, 512), http.StatusOK, -1},
+		{"upload over the limit", http.MethodPost, "/upload", make([]byte, 513), http.StatusRequestEntityTooLarge, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := fetch(t, newRequest(t, tt.method, ts.URL+tt.path, bytes.NewReader(tt.body)))
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantCode, body)
+			}
+			if tt.wantLen >= 0 && len(body) != tt.wantLen {
+				t.Errorf("body is %d bytes, want %d", len(body), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestPprofFlag(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"enabled", []string{"-pprof"}, http.StatusOK},
+		{"disabled by default", nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ts := newTestServer(t, testConfig(t, tt.args...))
+			resp, _ := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/debug/pprof/", nil))
+			if resp.StatusCode != tt.want {
+				t.Errorf("GET /debug/pprof/ = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+// h2cClient speaks HTTP/2 with prior knowledge over plain TCP
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func TestH2C(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.H2C = true
+	_, ts := newTestServer(t, cfg)
+	client := h2cClient()
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"download", "size=3MB", 3 * 1000 * 1000},
+		{"throttled download", "size=50000&rate=500KB", 50000},
+		{"chunked download", "size=100000&chunk=10000", 100000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?"+tt.query, nil)
+			req.Header.Set("Accept-Encoding", "identity")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.ProtoMajor != 2 {
+				t.Fatalf("served over %s, want HTTP/2", resp.Proto)
+			}
+			n, err := io.Copy(io.Discard, resp.Body)
+			if err != nil || n != int64(tt.want) {
+				t.Errorf("received %d bytes (%v), want %d", n, err, tt.want)
+			}
+		})
+	}
+
+	// Flushed events arrive one by one rather than when the stream ends
+	t.Run("events", func(t *testing.T) {
+		resp, err := client.Get(ts.URL + "/events?interval=10")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		line, err := bufio.NewReader(resp.Body).ReadString('\n')
+		if err != nil || line != "id: 1\n" {
+			t.Errorf("first line %q (%v), want the first event", line, err)
+		}
+	})
+
+	// HTTP/1.1 clients are still served on the same port
+	if resp, _ := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/ping", nil)); resp.ProtoMajor != 1 {
+		t.Errorf("HTTP/1.1 client served over %s", resp.Proto)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		header     int
+		wantStatus int
+	}{
+		{"small headers under a tiny limit", []string{"-max-header-bytes", "1KiB"}, 100, http.StatusOK},
+		{"large headers under a tiny limit", []string{"-max-header-bytes", "1KiB"}, 16 << 10, http.StatusRequestHeaderFieldsTooLarge},
+		{"large headers under the default", nil, 16 << 10, http.StatusOK},
+		{"large headers under a raised limit", []string{"-max-header-bytes", "4MiB"}, 2 << 20, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ts := newTestServer(t, testConfig(t, tt.args...))
+			req := newRequest(t, http.MethodGet, ts.URL+"/ping", nil)
+			req.Header.Set("X-Padding", strings.Repeat("a", tt.header))
+			// The server resets the connection after a 431 with the headers unread, so only the status is checked
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestEndpointFlags(t *testing.T) {
+	// Each path with a request it answers 200 to when enabled
+	requests := map[string]string{
+		"/upload":   http.MethodPost,
+		"/download": http.MethodGet,
+		"/health":   http.MethodGet,
+		"/livez":    http.MethodGet,
+		"/readyz":   http.MethodGet,
+		"/":         http.MethodGet,
+	}
+	tests := []struct {
+		name     string
+		args     []string
+		disabled []string
+	}{
+		{"all enabled", nil, nil},
+		{"upload disabled", []string{"-enable-upload=false"}, []string{"/upload"}},
+		{"download disabled", []string{"-enable-download=false"}, []string{"/download"}},
+		{"health disabled", []string{"-enable-health=false"}, []string{"/health", "/livez", "/readyz"}},
+		{"index disabled", []string{"-enable-index=false"}, []string{"/"}},
+		{"download only", []string{"-enable-upload=false", "-enable-health=false", "-enable-index=false"},
+			[]string{"/upload", "/health", "/livez", "/readyz", "/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ts := newTestServer(t, testConfig(t, tt.args...))
+			disabled := map[string]bool{}
+			for _, path := range tt.disabled {
+				disabled[path] = true
+			}
+			for path, method := range requests {
+				resp, body := fetch(t, newRequest(t, method, ts.URL+path, strings.NewReader("x")))
+				if disabled[path] && resp.StatusCode != http.StatusNotFound {
+					t.Errorf("disabled %s = %d, want 404", path, resp.StatusCode)
+				}
+				if !disabled[path] && resp.StatusCode != http.StatusOK {
+					t.Errorf("enabled %s = %d %q, want 200", path, resp.StatusCode, body)
+				}
+			}
+		})
+	}
+}
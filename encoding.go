@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// downloadEncodings are the content codings /download can produce, in order of preference
+var downloadEncodings = []string{"br", "gzip", "identity"}
+
+// negotiateEncoding picks the offer the Accept-Encoding header weighs highest, breaking ties by the
+// order of offers. Codings the header leaves out get the weight of "*" when it is present; identity
+// otherwise stays acceptable, ranked below anything listed, until excluded with "identity;q=0".
+// ok is false when the client accepts none of the offers.
+func negotiateEncoding(header string, offers []string) (coding string, ok bool) {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q, valid := parseQuality(params)
+		if name == "" || !valid {
+			continue
+		}
+		weights[name] = q
+	}
+
+	weight := func(coding string) float64 {
+		if q, ok := weights[coding]; ok {
+			return q
+		}
+		if q, ok := weights["*"]; ok {
+			return q
+		}
+		if coding == "identity" {
+			return math.SmallestNonzeroFloat64
+		}
+		return 0
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := weight(offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best, best != ""
+}
+
+// parseQuality returns the q parameter of an Accept-Encoding entry, 1 when absent. valid is false
+// for a weight outside 0 to 1, so a malformed entry is ignored rather than guessed at.
+func parseQuality(params string) (q float64, valid bool) {
+	q = 1
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(strings.TrimSpace(key), "q") {
+			continue
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || f < 0 || f > 1 {
+			return 0, false
+		}
+		q = f
+	}
+	return q, true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		ok     bool
+	}{
+		{"", "identity", true},
+		{"gzip", "gzip", true},
+		{"br", "br", true},
+		{"gzip, br", "br", true},
+		{"br;q=0.5, gzip", "gzip", true},
+		{"gzip;q=0.8, br;q=0.9", "br", true},
+		{"GZIP;Q=0.8", "gzip", true},
+		{"gzip;q=0, br;q=0", "identity", true},
+		{"deflate", "identity", true},
+		{"*", "br", true},
+		{"*;q=0.5, gzip", "gzip", true},
+		{"identity", "identity", true},
+		{"identity, gzip;q=0.5", "identity", true},
+		{"gzip;q=0.001", "gzip", true},
+		{"gzip;q=2, br;q=abc", "identity", true},
+		{"identity;q=0", "", false},
+		{"deflate, identity;q=0", "", false},
+		{"*;q=0", "", false},
+		{"identity;q=0, gzip;q=0.1", "gzip", true},
+		{"*;q=0, br", "br", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got, ok := negotiateEncoding(tt.header, downloadEncodings)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("negotiateEncoding(%q) = %q, %v, want %q, %v", tt.header, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestDownloadEncodingNegotiation(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		header       string
+		rangeHeader  string
+		wantStatus   int
+		wantEncoding string
+	}{
+		{"br;q=0.5, gzip", "", http.StatusOK, "gzip"},
+		{"gzip;q=0.5, br", "", http.StatusOK, "br"},
+		{"deflate", "", http.StatusOK, ""},
+		{"identity;q=0", "", http.StatusNotAcceptable, ""},
+		{"identity;q=0, gzip", "", http.StatusOK, "gzip"},
+		// Partial responses are never compressed
+		{"gzip", "bytes=0-99", http.StatusPartialContent, ""},
+		{"gzip, identity;q=0", "bytes=0-99", http.StatusNotAcceptable, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header+" "+tt.rangeHeader, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?size=1000", nil)
+			req.Header.Set("Accept-Encoding", tt.header)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			resp, body := fetch(t, req)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+		})
+	}
+}
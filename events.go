@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultEventInterval is the pause between events of /events when no interval is given
+const DefaultEventInterval = time.Second
+
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	clientIP := s.getClientIP(r)
+	reqID := requestIDFromContext(r.Context())
+
+	ms, err := positiveQueryInt(r, "interval")
+	if err != nil || time.Duration(ms)*time.Millisecond > MaxDelay {
+		logError("EVENTS_ERROR", "Client", clientIP, "RequestID", reqID,
+			"InvalidInterval", r.URL.Query().Get("interval"))
+		http.Error(w, fmt.Sprintf("interval must be between 1 and %d milliseconds", MaxDelay.Milliseconds()), http.StatusBadRequest)
+		return
+	}
+	interval := DefaultEventInterval
+	if ms > 0 {
+		interval = time.Duration(ms) * time.Millisecond
+	}
+
+	// The stream runs until the client leaves, so the server write timeout must not cut it off
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logWarn("EVENTS_WARNING", "Client", clientIP, "RequestID", reqID, "Error", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Ask nginx-style proxies not to buffer the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for n := 1; ; n++ {
+		select {
+		case <-r.Context().Done():
+			logInfo("EVENTS_CLOSED", "Client", clientIP, "RequestID", reqID, "Events", n-1,
+				"Duration", time.Since(start))
+			return
+		case <-s.shutdown:
+			// Endless streams would otherwise hold up graceful shutdown until it times out
+			logInfo("EVENTS_SHUTDOWN", "Client", clientIP, "RequestID", reqID, "Events", n-1,
+				"Duration", time.Since(start))
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %d\n\n", n, n); err != nil {
+			logWarn("EVENTS_DISCONNECTED", "Client", clientIP, "RequestID", reqID, "Events", n-1,
+				"Error", err)
+			return
+		}
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			logWarn("EVENTS_DISCONNECTED", "Client", clientIP, "RequestID", reqID, "Events", n-1,
+				"Error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	logs := captureLogs(t, LogFormatText, LevelInfo)
+	_, ts := newTestServer(t, DefaultConfig())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := newRequest(t, http.MethodGet, ts.URL+"/events?interval=10", nil).WithContext(ctx)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", got)
+	}
+
+	// Each event is an id and a data line followed by a blank line
+	sc := bufio.NewScanner(resp.Body)
+	for n := 1; n <= 3; n++ {
+		for _, want := range []string{fmt.Sprintf("id: %d", n), fmt.Sprintf("data: %d", n), ""} {
+			if !sc.Scan() {
+				t.Fatalf("stream ended before event %d: %v", n, sc.Err())
+			}
+			if sc.Text() != want {
+				t.Fatalf("event %d: line %q, want %q", n, sc.Text(), want)
+			}
+		}
+	}
+
+	cancel()
+	waitForLog(t, logs, "EVENTS CLOSED:")
+}
+
+func TestEventsInvalidInterval(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	for _, interval := range []string{"0", "-5", "abc", fmt.Sprint(MaxDelay.Milliseconds() + 1)} {
+		resp, _ := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/events?interval="+interval, nil))
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("interval=%s: status = %d, want %d", interval, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
@@ -1,3 +1,10 @@
 module github.com/geneliu/echo-stream
 
 go 1.22
+
+require (
+	github.com/andybalholm/brotli v1.2.5
+	golang.org/x/net v0.35.0
+)
+
+require golang.org/x/text v0.22.0 // indirect
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// responseHeaderAllowlist holds the headers /download lets clients set through the header parameter.
+// They only affect caching and presentation, never framing, encoding or security policy.
+var responseHeaderAllowlist = map[string]bool{
+	"Age":                 true,
+	"Cache-Control":       true,
+	"Content-Disposition": true,
+	"Content-Language":    true,
+	"Etag":                true,
+	"Expires":             true,
+	"Last-Modified":       true,
+	"Pragma":              true,
+}
+
+// parseResponseHeaders turns repeated Name:Value parameters into headers, rejecting names outside
+// the allowlist and values with control characters that could split the response
+func parseResponseHeaders(params []string) (http.Header, error) {
+	h := make(http.Header)
+	for _, p := range params {
+		name, value, ok := strings.Cut(p, ":")
+		if !ok {
+			return nil, fmt.Errorf("header %q must look like Name:Value", p)
+		}
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if !responseHeaderAllowlist[name] {
+			return nil, fmt.Errorf("header %q is not allowed", name)
+		}
+		value = strings.TrimSpace(value)
+		if strings.ContainsFunc(value, func(r rune) bool { return r < ' ' && r != '\t' || r == 0x7f }) {
+			return nil, fmt.Errorf("header %q value contains control characters", name)
+		}
+		h.Add(name, value)
+	}
+	return h, nil
+}
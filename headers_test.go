@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestResponseHeaders(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		name       string
+		params     []string
+		wantStatus int
+		want       http.Header
+	}{
+		{"single header", []string{"Cache-Control:no-cache"}, http.StatusOK,
+			http.Header{"Cache-Control": {"no-cache"}}},
+		{"repeated and lowercase", []string{"pragma: no-cache", "cache-control:max-age=60", "Cache-Control:public"}, http.StatusOK,
+			http.Header{"Pragma": {"no-cache"}, "Cache-Control": {"max-age=60", "public"}}},
+		{"value with a colon", []string{"Content-Disposition:attachment; filename=\"a:b.bin\""}, http.StatusOK,
+			http.Header{"Content-Disposition": {"attachment; filename=\"a:b.bin\""}}},
+		{"CRLF injection", []string{"Cache-Control:no-cache\r\nSet-Cookie: evil=1"}, http.StatusBadRequest, nil},
+		{"bare LF injection", []string{"Cache-Control:x\nX-Evil: 1"}, http.StatusBadRequest, nil},
+		{"header outside the allowlist", []string{"Set-Cookie:evil=1"}, http.StatusBadRequest, nil},
+		{"framing header", []string{"Content-Length:1"}, http.StatusBadRequest, nil},
+		{"missing colon", []string{"Cache-Control"}, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := url.Values{"size": {"10"}, "header": tt.params}
+			resp, body := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/download?"+q.Encode(), nil))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("X-Evil") != "" {
+				t.Errorf("injected headers made it into the response: %v", resp.Header)
+			}
+			for name, values := range tt.want {
+				if got := resp.Header.Values(name); !reflect.DeepEqual(got, values) {
+					t.Errorf("%s = %q, want %q", name, got, values)
+				}
+			}
+		})
+	}
+}
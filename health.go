@@ -0,0 +1,61 @@
+package main
+
+import "net/http"
+
+// healthPaths are the paths load balancers probe; they skip authentication and rate limiting
+var healthPaths = map[string]bool{"/health": true, "/livez": true, "/readyz": true}
+
+// livezHandler reports that the process is up and serving, whatever its load
+func (s *Server) livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("alive"))
+}
+
+// readyzHandler reports whether the server should receive new traffic. It fails while
+// -prewarm runs, while draining for shutdown and while every -max-concurrent slot is taken.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	switch {
+	case s.warming.Load():
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("warming up"))
+	case s.draining.Load():
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("draining"))
+	case s.inflight.Load().full():
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("overloaded"))
+	default:
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("healthy"))
+	}
+}
+
+// drainHandler lets an orchestrator take the server out of rotation over HTTP: POST starts draining so
+// /readyz fails while requests keep being served, DELETE cancels it. The process keeps running until
+// it gets a signal. It is only routed when authentication is configured.
+func (s *Server) drainHandler(w http.ResponseWriter, r *http.Request) {
+	clientIP := s.getClientIP(r)
+	reqID := requestIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodPost:
+		s.draining.Store(true)
+		logInfo("ADMIN_DRAIN", "Client", clientIP, "RequestID", reqID, "Draining", true)
+	case http.MethodDelete:
+		s.draining.Store(false)
+		logInfo("ADMIN_DRAIN", "Client", clientIP, "RequestID", reqID, "Draining", false)
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "use POST to drain or DELETE to resume", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if s.draining.Load() {
+		w.Write([]byte("draining"))
+	} else {
+		w.Write([]byte("serving"))
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	tests := []struct {
+		name      string
+		prepare   func(t *testing.T, app *Server, url string)
+		wantReady int
+		wantBody  string
+	}{
+		{"normal", func(*testing.T, *Server, string) {}, http.StatusOK, "healthy"},
+		{"prewarming", func(_ *testing.T, app *Server, _ string) { app.warming.Store(true) },
+			http.StatusServiceUnavailable, "warming up"},
+		{"draining", func(_ *testing.T, app *Server, _ string) { app.draining.Store(true) },
+			http.StatusServiceUnavailable, "draining"},
+		{"at the concurrency cap", func(t *testing.T, _ *Server, url string) { startSlowDownload(t, url, nil) },
+			http.StatusServiceUnavailable, "overloaded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.MaxConcurrent = 1
+			app, ts := newTestServer(t, cfg)
+			tt.prepare(t, app, ts.URL)
+
+			for _, path := range []string{"/readyz", "/health"} {
+				resp, body := fetch(t, newRequest(t, http.MethodGet, ts.URL+path, nil))
+				if resp.StatusCode != tt.wantReady || string(body) != tt.wantBody {
+					t.Errorf("%s = %d %q, want %d %q", path, resp.StatusCode, body, tt.wantReady, tt.wantBody)
+				}
+			}
+			if resp, body := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/livez", nil)); resp.StatusCode != http.StatusOK {
+				t.Errorf("/livez = %d %q, want 200 whatever the readiness", resp.StatusCode, body)
+			}
+		})
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AuthToken = "s3cret"
+	_, ts := newTestServer(t, cfg)
+
+	call := func(method, token string) (int, string) {
+		t.Helper()
+		req := newRequest(t, method, ts.URL+"/admin/drain", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, body := fetch(t, req)
+		return resp.StatusCode, string(body)
+	}
+	readyz := func() int {
+		t.Helper()
+		resp, _ := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/readyz", nil))
+		return resp.StatusCode
+	}
+
+	steps := []struct {
+		name       string
+		method     string
+		token      string
+		wantStatus int
+		wantReady  int
+	}{
+		{"without a token", http.MethodPost, "", http.StatusUnauthorized, http.StatusOK},
+		{"with the wrong token", http.MethodPost, "guess", http.StatusUnauthorized, http.StatusOK},
+		{"with GET", http.MethodGet, "s3cret", http.StatusMethodNotAllowed, http.StatusOK},
+		{"drain", http.MethodPost, "s3cret", http.StatusOK, http.StatusServiceUnavailable},
+		{"drain again", http.MethodPost, "s3cret", http.StatusOK, http.StatusServiceUnavailable},
+		{"resume", http.MethodDelete, "s3cret", http.StatusOK, http.StatusOK},
+	}
+	// The steps run in order, each starting from the state the previous one left
+	for _, step := range steps {
+		status, body := call(step.method, step.token)
+		if status != step.wantStatus {
+			t.Errorf("%s: status %d %q, want %d", step.name, status, body, step.wantStatus)
+		}
+		if got := readyz(); got != step.wantReady {
+			t.Errorf("%s: /readyz = %d, want %d", step.name, got, step.wantReady)
+		}
+	}
+
+	// The server keeps serving while draining
+	call(http.MethodPost, "s3cret")
+	req := newRequest(t, http.MethodGet, ts.URL+"/ping", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if resp, _ := fetch(t, req); resp.StatusCode != http.StatusOK {
+		t.Errorf("/ping while draining = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestAdminDrainNeedsAuth(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	resp, _ := fetch(t, newRequest(t, http.MethodPost, ts.URL+"/admin/drain", nil))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/admin/drain without auth configured = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	logs := captureLogs(t, LogFormatText, LevelInfo)
+	cfg := DefaultConfig()
+	cfg.Prewarm = true
+	cfg.MaxConcurrent = 3
+	app, ts := newTestServer(t, cfg)
+	// As at startup, where Serve already runs while prewarm does
+	app.warming.Store(cfg.Prewarm)
+
+	probe := func(path string) (int, string) {
+		t.Helper()
+		resp, body := fetch(t, newRequest(t, http.MethodGet, ts.URL+path, nil))
+		return resp.StatusCode, string(body)
+	}
+	if status, body := probe("/readyz"); status != http.StatusServiceUnavailable || body != "warming up" {
+		t.Errorf("/readyz before prewarm = %d %q, want 503 warming up", status, body)
+	}
+	if status, _ := probe("/livez"); status != http.StatusOK {
+		t.Errorf("/livez before prewarm = %d, want 200", status)
+	}
+
+	app.prewarm(cfg)
+	if !strings.Contains(logs.String(), "PREWARM COMPLETE: RandomBlock=") || !strings.Contains(logs.String(), "Buffers=3 ") {
+		t.Errorf("no PREWARM_COMPLETE for 3 buffers:\n%s", logs.String())
+	}
+	if status, body := probe("/readyz"); status != http.StatusOK || body != "healthy" {
+		t.Errorf("/readyz after prewarm = %d %q, want 200 healthy", status, body)
+	}
+}
+
+func TestPrewarmBeforeReady(t *testing.T) {
+	p := startProcess(t, "-prewarm")
+	logs := p.logs.String()
+	warmed := strings.Index(logs, `"event":"PREWARM_COMPLETE"`)
+	if warmed < 0 || warmed > strings.Index(logs, `"event":"`+EventServerReady+`"`) {
+		t.Fatalf("PREWARM_COMPLETE not logged before %s:\n%s", EventServerReady, logs)
+	}
+	if resp, body := fetch(t, newRequest(t, http.MethodGet, p.URL+"/readyz", nil)); resp.StatusCode != http.StatusOK {
+		t.Errorf("/readyz once ready = %d %q, want 200", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import "net/http"
+
+// indexResult is the JSON response of /, listing what the server exposes
+type indexResult struct {
+	Name      string        `json:"name"`
+	Version   string        `json:"version"`
+	Endpoints []endpointDoc `json:"endpoints"`
+}
+
+// endpointDoc describes one endpoint and the query parameters it accepts
+type endpointDoc struct {
+	Path        string   `json:"path"`
+	Methods     []string `json:"methods"`
+	Description string   `json:"description"`
+	Params      []string `json:"params,omitempty"`
+}
+
+// indexHandler answers / with the endpoints this configuration serves, for discovering the API
+func (s *Server) indexHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, indexResult{Name: "echo-stream", Version: version, Endpoints: endpointDocs(s.config())})
+}
+
+// endpointDocs lists the endpoints registered by Routes for cfg, in the same order
+func endpointDocs(cfg *Config) []endpointDoc {
+	get := []string{http.MethodGet, http.MethodHead}
+	var docs []endpointDoc
+	if cfg.EnableUpload {
+		docs = append(docs, endpointDoc{"/upload", []string{http.MethodPost, http.MethodPut},
+			"receive and discard or echo a body, reporting its size and throughput",
+			[]string{"rate", "max", "hash", "echo", "reject"}})
+	}
+	if cfg.EnableDownload {
+		docs = append(docs, endpointDoc{"/download", get, "stream a generated body",
+			[]string{"size", "pattern", "text", "seed", "rate", "rampup", "jitter", "ttfb", "bufsize", "chunk",
+				"chunked", "checksum", "duration", "fail_after", "header"}})
+	}
+	if cfg.EnableHealth {
+		docs = append(docs,
+			endpointDoc{"/livez", get, "liveness probe", nil},
+			endpointDoc{"/readyz", get, "readiness probe, 503 while draining or saturated", nil},
+			endpointDoc{"/health", get, "alias of /readyz", nil})
+	}
+	docs = append(docs,
+		endpointDoc{"/ping", get, "minimal latency probe", nil},
+		endpointDoc{"/metrics", get, "Prometheus or OpenMetrics metrics", nil},
+		endpointDoc{"/stats", get, "JSON counters and runtime figures", nil},
+		endpointDoc{"/version", get, "build information", nil},
+		endpointDoc{"/echo", []string{"any"}, "reflect the request back as JSON", nil},
+		endpointDoc{"/delay", get, "respond after a fixed or random delay",
+			[]string{"ms", "dist", "min", "max", "mean", "stddev"}},
+		endpointDoc{"/status", get, "respond with the given status code", []string{"code"}},
+		endpointDoc{"/ws", []string{http.MethodGet}, "WebSocket echo", nil},
+		endpointDoc{"/events", []string{http.MethodGet}, "server-sent events stream", []string{"interval"}},
+		endpointDoc{"/redirect", get, "follow a chain of redirects", []string{"count", "code"}},
+		endpointDoc{"/cookies", get, "set cookies and return the ones received",
+			[]string{"set", "path", "max_age", "samesite", "secure", "httponly"}})
+	if cfg.AuthToken != "" || cfg.BasicUser != "" {
+		docs = append(docs, endpointDoc{"/admin/drain", []string{http.MethodPost, http.MethodDelete},
+			"start or stop draining", nil})
+	}
+	if cfg.Pprof {
+		docs = append(docs, endpointDoc{"/debug/pprof/", get, "Go profiling handlers", nil})
+	}
+	return docs
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantStatus int
+		want       []string
+		wantAbsent []string
+	}{
+		{"default", nil, http.StatusOK,
+			[]string{"/upload", "/download", "/livez", "/readyz", "/health", "/ping", "/metrics", "/echo"}, []string{"/admin/drain"}},
+		{"disabled endpoints left out", []string{"-enable-upload=false", "-enable-health=false"}, http.StatusOK,
+			[]string{"/download", "/ping"}, []string{"/upload", "/livez", "/readyz", "/health"}},
+		{"admin endpoints with auth", []string{"-auth-token", "s3cret"}, http.StatusOK, []string{"/admin/drain"}, nil},
+		{"suppressed", []string{"-enable-index=false"}, http.StatusNotFound, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ts := newTestServer(t, testConfig(t, tt.args...))
+			req := newRequest(t, http.MethodGet, ts.URL+"/", nil)
+			req.Header.Set("Authorization", "Bearer s3cret")
+			resp, body := fetch(t, req)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := resp.Header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q", got)
+			}
+			var index indexResult
+			if err := json.Unmarshal(body, &index); err != nil {
+				t.Fatalf("%v: %s", err, body)
+			}
+			if index.Name != "echo-stream" || index.Version != version {
+				t.Errorf("name %q version %q", index.Name, index.Version)
+			}
+			listed := map[string]endpointDoc{}
+			for _, doc := range index.Endpoints {
+				if len(doc.Methods) == 0 || doc.Description == "" {
+					t.Errorf("%s is missing its methods or description", doc.Path)
+				}
+				listed[doc.Path] = doc
+			}
+			for _, path := range tt.want {
+				if _, ok := listed[path]; !ok {
+					t.Errorf("%s not listed", path)
+				}
+			}
+			for _, path := range tt.wantAbsent {
+				if _, ok := listed[path]; ok {
+					t.Errorf("%s listed", path)
+				}
+			}
+			if doc, ok := listed["/download"]; ok && len(doc.Params) == 0 {
+				t.Error("/download lists no parameters")
+			}
+		})
+	}
+}
+
+func TestIndexOnlyAtRoot(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	if resp, _ := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/nope", nil)); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown path: status %d, want 404", resp.StatusCode)
+	}
+}
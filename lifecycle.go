@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Lifecycle events, in the order a server goes through them. Unlike the other events they are
+// meant for automation, so their names and fields stay fixed.
+const (
+	EventServerStarting     = "server_starting"
+	EventServerReady        = "server_ready"
+	EventServerShuttingDown = "server_shutting_down"
+	EventServerStopped      = "server_stopped"
+)
+
+// processStart is when the process began, for the uptime reported by lifecycle events
+var processStart = time.Now()
+
+// logLifecycle logs a lifecycle event with the PID, version and uptime every one of them carries.
+// JSON logs use the event name as the event, e.g. {"event":"server_ready",...}; text logs keep the
+// usual line shape as "LIFECYCLE: Event=server_ready PID=...".
+func logLifecycle(event string, fields ...interface{}) {
+	fields = append([]interface{}{"PID", os.Getpid(), "Version", version,
+		"UptimeSeconds", time.Since(processStart).Seconds()}, fields...)
+	if eventLog.Load().json {
+		logInfo(event, fields...)
+		return
+	}
+	logInfo("LIFECYCLE", append([]interface{}{"Event", event}, fields...)...)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLogLifecycle(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{LogFormatText, `LIFECYCLE: Event=server_ready PID=\d+ Version=\S+ UptimeSeconds=[\d.e-]+ Addr=127.0.0.1:8080`},
+		{LogFormatJSON, `"event":"server_ready","level":"info","pid":\d+,"version":"[^"]+",` +
+			`"uptime_seconds":[\d.e-]+,"addr":"127.0.0.1:8080"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			logs := captureLogs(t, tt.format, LevelInfo)
+			logLifecycle(EventServerReady, "Addr", "127.0.0.1:8080")
+			if !regexp.MustCompile(tt.want).MatchString(logs.String()) {
+				t.Errorf("logged\n%s\nwant a match for\n%s", logs.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	p := newProcess()
+	p.run(t)
+	ready := p.event(t, EventServerReady)
+
+	// The ready event comes after the bind, so the very first attempt connects with no retrying
+	conn, err := net.DialTimeout("tcp", ready["addr"].(string), time.Second)
+	if err != nil {
+		t.Fatalf("dial right after %s: %v", EventServerReady, err)
+	}
+	conn.Close()
+	p.ready(ready)
+	if resp, _ := fetch(t, newRequest(t, http.MethodGet, p.URL+"/ping", nil)); resp.StatusCode != http.StatusOK {
+		t.Errorf("ping after %s: %d", EventServerReady, resp.StatusCode)
+	}
+
+	p.signal(t, syscall.SIGTERM)
+	p.wait(t, 10*time.Second)
+
+	logs := p.logs.String()
+	tests := []struct {
+		event  string
+		fields []string
+	}{
+		{EventServerStarting, nil},
+		{EventServerReady, []string{"addr", "tls"}},
+		{EventServerShuttingDown, []string{"signal", "drain_delay"}},
+		{EventServerStopped, []string{"graceful", "shutdown_seconds"}},
+	}
+	last := -1
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			entry := findEvent(logs, tt.event)
+			if entry == nil {
+				t.Fatalf("no %s in:\n%s", tt.event, logs)
+			}
+			for _, field := range append([]string{"pid", "version", "uptime_seconds"}, tt.fields...) {
+				if _, ok := entry[field]; !ok {
+					t.Errorf("%s has no %s: %v", tt.event, field, entry)
+				}
+			}
+			at := strings.Index(logs, `"event":"`+tt.event+`"`)
+			if at < last {
+				t.Errorf("%s logged out of order", tt.event)
+			}
+			last = at
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// clientLimiter caps the number of concurrent requests per client IP
+type clientLimiter struct {
+	max    int
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// newClientLimiter returns a limiter allowing max concurrent requests per client, or nil when max is not positive
+func newClientLimiter(max int) *clientLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &clientLimiter{max: max, active: make(map[string]int)}
+}
+
+// acquire takes a slot for ip, reporting false when the client already holds all of its slots
+func (l *clientLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] >= l.max {
+		return false
+	}
+	l.active[ip]++
+	return true
+}
+
+// release frees a slot taken by acquire, forgetting idle clients so the map stays small
+func (l *clientLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] <= 1 {
+		delete(l.active, ip)
+		return
+	}
+	l.active[ip]--
+}
+
+// limitPerClient rejects requests with 429 while the client is at its concurrency limit
+func (s *Server) limitPerClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The slot is returned to the limiter it came from, even if a reload replaced it since
+		l := s.perClient.Load()
+		if l == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		clientIP := s.getClientIP(r)
+		reqID := requestIDFromContext(r.Context())
+		if !l.acquire(clientIP) {
+			logWarn("CLIENT_LIMIT", "Client", clientIP, "RequestID", reqID, "URL", r.URL.Path,
+				"MaxPerClient", l.max)
+			http.Error(w, "too many concurrent requests", http.StatusTooManyRequests)
+			return
+		}
+		// Deferred so the slot is returned even when the client disconnects mid-stream
+		defer l.release(clientIP)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// concurrencyLimiter is a semaphore with a fixed number of slots shared by all clients
+type concurrencyLimiter struct {
+	slots chan struct{}
+}
+
+// newConcurrencyLimiter returns a limiter with max slots, or nil when max is not positive
+func newConcurrencyLimiter(max int) *concurrencyLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &concurrencyLimiter{slots: make(chan struct{}, max)}
+}
+
+// acquire takes a slot without waiting, reporting false when all of them are taken
+func (l *concurrencyLimiter) acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
+
+// full reports whether every slot is taken; a nil limiter is never full
+func (l *concurrencyLimiter) full() bool {
+	return l != nil && len(l.slots) == cap(l.slots)
+}
+
+// limitConcurrent rejects streaming requests with 503 once max-concurrent requests are in flight
+func (s *Server) limitConcurrent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := s.inflight.Load()
+		if l == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !l.acquire() {
+			// Fail fast instead of queuing so clients can back off and retry
+			logWarn("CONCURRENCY_LIMIT", "Client", s.getClientIP(r),
+				"RequestID", requestIDFromContext(r.Context()), "URL", r.URL.Path,
+				"MaxConcurrent", cap(l.slots))
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server is at its concurrent request limit", http.StatusServiceUnavailable)
+			return
+		}
+		defer l.release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimiterSweep is how often idle per-client token buckets are evicted
+const RateLimiterSweep = time.Minute
+
+// rateLimiter is a per-client token bucket: each client may make burst requests at once,
+// refilled at rate requests per second
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+
+	// stop ends the sweeper once a reload has replaced the limiter
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for rate requests per second per client, or nil when rate is not positive.
+// A burst of 0 defaults to one second's worth of requests.
+func newRateLimiter(rate, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &rateLimiter{rate: float64(rate), burst: float64(burst), buckets: make(map[string]*tokenBucket),
+		stop: make(chan struct{})}
+}
+
+// allow takes a token for ip, or reports how long until the next one is available
+func (l *rateLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops buckets that have refilled completely, which behave like new ones, until done
+// is closed or the limiter is retired
+func (l *rateLimiter) sweep(done <-chan struct{}) {
+	ticker := time.NewTicker(RateLimiterSweep)
+	defer ticker.Stop()
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for {
+		select {
+		case <-done:
+			return
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			for ip, b := range l.buckets {
+				if now.Sub(b.last) > full {
+					delete(l.buckets, ip)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// retire stops the sweeper of a limiter that is no longer in use; it is safe on nil
+func (l *rateLimiter) retire() {
+	if l != nil {
+		l.stopOnce.Do(func() { close(l.stop) })
+	}
+}
+
+// limitRate rejects requests with 429 once a client exceeds -rate-limit; health checks are exempt
+func (s *Server) limitRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := s.rateLimit.Load()
+		if l == nil || healthPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		clientIP := s.getClientIP(r)
+		ok, wait := l.allow(clientIP, time.Now())
+		if !ok {
+			logWarn("RATE_LIMIT", "Client", clientIP, "RequestID", requestIDFromContext(r.Context()),
+				"URL", r.URL.Path, "RateLimit", l.rate, "Burst", l.burst)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitDuration cancels the request context once -max-request-duration has passed, which stops
+// downloads between writes and unblocks uploads waiting on the client
+func (s *Server) limitDuration(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		max := s.config().MaxRequestDuration
+		if max <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), max)
+		defer cancel()
+
+		// A body read blocked on a slow client does not watch the context, so expire its
+		// deadline too; the server's own read timeout is never extended. Once the handler has
+		// returned the connection may already be reading the next request, so a callback
+		// that lost the race to stop leaves the deadline alone. Requests without a body are
+		// left alone as well: their connection is only read by net/http's background read,
+		// which a deadline would fail, cancelling every later request on the connection.
+		rc := http.NewResponseController(w)
+		hasBody := r.Body != nil && r.Body != http.NoBody
+		var mu sync.Mutex
+		finished := false
+		stop := context.AfterFunc(ctx, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if hasBody && !finished && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				rc.SetReadDeadline(time.Now())
+			}
+		})
+		defer func() {
+			stop()
+			mu.Lock()
+			finished = true
+			mu.Unlock()
+		}()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// timedOut reports whether the request was cut off by -max-request-duration
+func timedOut(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.DeadlineExceeded)
+}
+
+// DefaultMinThroughputGrace is how long a transfer may stay below -min-throughput before it is cut off
+const DefaultMinThroughputGrace = 10 * time.Second
+
+// errTooSlow is returned by transfers whose client keeps moving data below -min-throughput
+var errTooSlow = errors.New("transfer below the minimum throughput")
+
+// throughputGuard catches clients that trickle data to hold a connection open. Only time spent
+// blocked on the client counts, so server-side throttling such as rate= or -max-egress is not held
+// against it. Every grace of blocked time the average rate is checked against min bytes per second.
+// A nil guard never trips.
+type throughputGuard struct {
+	min   int
+	grace time.Duration
+	bytes int64
+	spent time.Duration
+}
+
+// newThroughputGuard returns a guard enforcing min bytes per second, or nil when min is not positive
+func newThroughputGuard(min int, grace time.Duration) *throughputGuard {
+	if min <= 0 || grace <= 0 {
+		return nil
+	}
+	return &throughputGuard{min: min, grace: grace}
+}
+
+// observe records n bytes moved during d spent waiting on the client, returning errTooSlow once a
+// full grace period averaged below the minimum
+func (g *throughputGuard) observe(n int, d time.Duration) error {
+	if g == nil {
+		return nil
+	}
+	g.bytes += int64(n)
+	g.spent += d
+	if g.spent < g.grace {
+		return nil
+	}
+	rate := float64(g.bytes) / g.spent.Seconds()
+	g.bytes, g.spent = 0, 0
+	if rate < float64(g.min) {
+		return fmt.Errorf("%w: %.0f bytes/s over %s, need %d", errTooSlow, rate, g.grace, g.min)
+	}
+	return nil
+}
+
+// guardedReader times each read of an upload body against a throughputGuard
+type guardedReader struct {
+	r     io.Reader
+	guard *throughputGuard
+}
+
+func (g guardedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := g.r.Read(p)
+	if err == nil {
+		err = g.guard.observe(n, time.Since(start))
+	}
+	return n, err
+}
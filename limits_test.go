@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPerClientLimit(t *testing.T) {
+	const max = 2
+	cfg := testConfig(t, "-trusted-proxies", "127.0.0.1")
+	cfg.MaxPerClient = max
+	_, ts := newTestServer(t, cfg)
+	client := http.Header{"X-Forwarded-For": {"203.0.113.7"}}
+
+	var held []*http.Response
+	for i := 0; i < max; i++ {
+		resp := startSlowDownload(t, ts.URL, client)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d within the limit got %d", i+1, resp.StatusCode)
+		}
+		held = append(held, resp)
+	}
+
+	tests := []struct {
+		name   string
+		client string
+		want   int
+	}{
+		{"same client over the limit", "203.0.113.7", http.StatusTooManyRequests},
+		{"other client", "203.0.113.8", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := newRequest(t, http.MethodGet, ts.URL+"/download?size=100", nil)
+		req.Header.Set("X-Forwarded-For", tt.client)
+		if resp, _ := fetch(t, req); resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+
+	// A finished request gives its slot back
+	held[0].Body.Close()
+	for i := 0; ; i++ {
+		req := newRequest(t, http.MethodGet, ts.URL+"/download?size=100", nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		resp, _ := fetch(t, req)
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("slot never released, still %d", resp.StatusCode)
+		}
+		waitABit()
+	}
+}
+
+func TestGlobalConcurrencyLimit(t *testing.T) {
+	const max = 2
+	cfg := DefaultConfig()
+	cfg.MaxConcurrent = max
+	_, ts := newTestServer(t, cfg)
+
+	for i := 0; i < max; i++ {
+		// Distinct clients, so only the global cap can be what turns the overflow away
+		client := http.Header{"X-Forwarded-For": {fmt.Sprintf("203.0.113.%d", i+1)}}
+		if resp := startSlowDownload(t, ts.URL, client); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d within the limit got %d", i+1, resp.StatusCode)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+	}{
+		{"download", http.MethodGet, "/download?size=100"},
+		{"upload", http.MethodPost, "/upload"},
+	}
+	for _, tt := range tests {
+		resp, _ := fetch(t, newRequest(t, tt.method, ts.URL+tt.path, strings.NewReader("x")))
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, http.StatusServiceUnavailable)
+		}
+		if got := resp.Header.Get("Retry-After"); got == "" {
+			t.Errorf("%s: missing Retry-After", tt.name)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	_, ts := newTestServer(t, testConfig(t, "-rate-limit", "1", "-rate-burst", "3", "-trusted-proxies", "127.0.0.1"))
+	get := func(path, client string) *http.Response {
+		t.Helper()
+		req := newRequest(t, http.MethodGet, ts.URL+path, nil)
+		req.Header.Set("X-Forwarded-For", client)
+		resp, _ := fetch(t, req)
+		return resp
+	}
+
+	for i := 1; i <= 3; i++ {
+		if resp := get("/ping", "203.0.113.1"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d of the burst got %d", i, resp.StatusCode)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		resp := get("/ping", "203.0.113.1")
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("request past the burst got %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+		}
+		if got := resp.Header.Get("Retry-After"); got != "1" {
+			t.Errorf("Retry-After = %q, want 1", got)
+		}
+	}
+	if resp := get("/ping", "203.0.113.2"); resp.StatusCode != http.StatusOK {
+		t.Errorf("another client got %d, want its own bucket", resp.StatusCode)
+	}
+	if resp := get("/health", "203.0.113.1"); resp.StatusCode != http.StatusOK {
+		t.Errorf("health check got %d, want it exempt", resp.StatusCode)
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := newRateLimiter(2, 2)
+	start := time.Now()
+	tests := []struct {
+		at   time.Duration
+		want bool
+	}{
+		{0, true},
+		{0, true},
+		{0, false},
+		{250 * time.Millisecond, false},
+		{500 * time.Millisecond, true},
+		{500 * time.Millisecond, false},
+		{10 * time.Second, true},
+		{10 * time.Second, true},
+		{10 * time.Second, false},
+	}
+	for i, tt := range tests {
+		if ok, _ := l.allow("client", start.Add(tt.at)); ok != tt.want {
+			t.Errorf("request %d at %s: allowed = %v, want %v", i, tt.at, ok, tt.want)
+		}
+	}
+}
+
+func TestMaxEgressSharedByDownloads(t *testing.T) {
+	const egress, size = 200000, 100000
+	_, ts := newTestServer(t, testConfig(t, "-max-egress", strconv.Itoa(egress)))
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	received := make([]int, 2)
+	for i := range received {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Get(ts.URL + "/download?size=" + strconv.Itoa(size))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			n, _ := io.Copy(io.Discard, resp.Body)
+			received[i] = int(n)
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := received[0] + received[1]
+	if total != 2*size {
+		t.Fatalf("received %v bytes, want %d each", received, size)
+	}
+	// The initial burst of the bucket comes for free, everything after that at the cap
+	burst := egress * PacerBurst.Seconds()
+	if rate := (float64(total) - burst) / elapsed.Seconds(); rate > egress*1.05 {
+		t.Errorf("combined throughput %.0f B/s, want at most the %d B/s cap", rate, egress)
+	}
+}
+
+func TestMaxRequestDuration(t *testing.T) {
+	logs := captureLogs(t, LogFormatText, LevelInfo)
+	_, ts := newTestServer(t, testConfig(t, "-max-request-duration", "200ms"))
+
+	t.Run("throttled download", func(t *testing.T) {
+		start := time.Now()
+		req := newRequest(t, http.MethodGet, ts.URL+"/download?size=100000&rate=10KB", nil)
+		req.Header.Set("Accept-Encoding", "identity")
+		req.Header.Set(RequestIDHeader, "timeout-download")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		n, err := io.Copy(io.Discard, resp.Body)
+		if err == nil || n >= resp.ContentLength {
+			t.Errorf("received %d of %d bytes (%v), want the download cut off", n, resp.ContentLength, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("cut off after %s", elapsed)
+		}
+		waitForLog(t, logs, "DOWNLOAD TIMEOUT: Client=127.0.0.1 RequestID=timeout-download")
+	})
+
+	t.Run("slow upload", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		go func() {
+			for i := 0; i < 100; i++ {
+				if _, err := pw.Write([]byte("slow")); err != nil {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			pw.Close()
+		}()
+		resp, _ := fetch(t, newRequest(t, http.MethodPost, ts.URL+"/upload", pr))
+		if resp.StatusCode != http.StatusRequestTimeout {
+			t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusRequestTimeout)
+		}
+		waitForLog(t, logs, "UPLOAD TIMEOUT:")
+	})
+
+	t.Run("chunked and compressed downloads are seen as cut off", func(t *testing.T) {
+		for _, encoding := range []string{"identity", "gzip"} {
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?size=100000&rate=10KB&chunked=true", nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			req.Header.Set(RequestIDHeader, "timeout-"+encoding)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if err == nil {
+				t.Errorf("%s: received %d bytes that read as a complete response", encoding, n)
+			}
+			// The cut-off connection is hijacked, so the test server does not wait for its handler
+			waitForLog(t, logs, "DOWNLOAD TIMEOUT: Client=127.0.0.1 RequestID=timeout-"+encoding)
+		}
+	})
+
+	t.Run("kept-alive connection outlives a quick request", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 1}}
+		defer client.CloseIdleConnections()
+		for i := 0; i < 2; i++ {
+			resp, err := client.Get(ts.URL + "/download?size=100")
+			if err != nil {
+				t.Fatalf("request %d: %v", i+1, err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			// Longer than the limit, so a deadline left behind by the first request would fail the second
+			time.Sleep(300 * time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// UnixSocketMode lets the owner and group, typically a local reverse proxy, connect to the socket
+const UnixSocketMode = 0o660
+
+// DefaultKeepAlive matches the TCP keep-alive period net.Listen applies on its own
+const DefaultKeepAlive = 15 * time.Second
+
+// Bounds of the pause after a temporary accept error, doubled for each one in a row
+const (
+	MinAcceptBackoff = 5 * time.Millisecond
+	MaxAcceptBackoff = time.Second
+)
+
+// sdListenFDsStart is the first file descriptor passed by systemd socket activation
+const sdListenFDsStart = 3
+
+// listen opens the HTTP listener: the socket passed by systemd when socket-activated, a Unix
+// domain socket when -unix-socket is set, otherwise TCP on -port
+func listen(cfg *Config) (net.Listener, error) {
+	ln, err := activatedListener()
+	switch {
+	case err != nil:
+		return nil, err
+	case ln != nil:
+	case cfg.UnixSocket != "":
+		ln, err = listenUnix(cfg.UnixSocket)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		ln, err = net.Listen("tcp", cfg.Port)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := setBacklog(ln, cfg.ListenBacklog); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	// Keep-alive only touches TCP connections, so Unix sockets pass through it unchanged
+	return keepAliveListener{Listener: newRetryListener(ln), period: cfg.KeepAlive}, nil
+}
+
+// setBacklog changes how many pending connections the kernel queues for ln. Go always listens
+// with the system maximum; Linux lets a second listen(2) on the socket replace it, and caps it at
+// net.core.somaxconn either way. Zero keeps the default.
+func setBacklog(ln net.Listener, backlog int) error {
+	if backlog == 0 {
+		return nil
+	}
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("listener %s does not support setting a backlog", ln.Addr())
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	if err := raw.Control(func(fd uintptr) { listenErr = syscall.Listen(int(fd), backlog) }); err != nil {
+		return err
+	}
+	if listenErr != nil {
+		return fmt.Errorf("setting backlog %d on %s: %w", backlog, ln.Addr(), listenErr)
+	}
+	return nil
+}
+
+// retryListener rides out temporary accept failures, such as running out of file descriptors
+// during a connection storm, by logging them and retrying with a growing pause instead of
+// handing them to the serve loop. Other errors are returned as they are.
+type retryListener struct {
+	net.Listener
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newRetryListener(ln net.Listener) *retryListener {
+	return &retryListener{Listener: ln, closed: make(chan struct{})}
+}
+
+func (l *retryListener) Accept() (net.Conn, error) {
+	var backoff time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err == nil || !temporaryAcceptError(err) {
+			return conn, err
+		}
+		backoff = min(max(2*backoff, MinAcceptBackoff), MaxAcceptBackoff)
+		logWarn("ACCEPT_RETRY", "Addr", l.Addr(), "Backoff", backoff, "Error", err)
+		select {
+		case <-time.After(backoff):
+		case <-l.closed:
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// Close also ends a pause between retries, so shutdown is not held up by it
+func (l *retryListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// temporaryAcceptError reports whether a failed accept is worth retrying: the process or system
+// is out of descriptors or memory, or the pending connection went away before it was accepted
+func temporaryAcceptError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EAGAIN, syscall.EINTR} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepAliveListener sets the TCP keep-alive period of every accepted connection, so dead
+// peers on long streams are detected on our schedule. A zero period turns keep-alive off.
+type keepAliveListener struct {
+	net.Listener
+	period time.Duration
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if l.period > 0 {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(l.period)
+		} else {
+			tc.SetKeepAlive(false)
+		}
+	}
+	return conn, nil
+}
+
+// listenUnix listens on a socket file at path. Closing the listener, which is part of
+// server.Shutdown, removes the file again.
+func listenUnix(path string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, UnixSocketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// removeStaleSocket deletes a socket file left behind by a crashed run. It refuses to touch
+// anything that is not a socket, or a socket another process is still accepting on.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	return os.Remove(path)
+}
+
+// activatedListener returns the first socket passed through the LISTEN_FDS protocol of
+// sd_listen_fds(3), or nil when the process was not socket-activated. The variables are
+// cleared so child processes do not mistake the descriptors for their own.
+func activatedListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("socket activation passed no usable descriptors, LISTEN_FDS=%q", os.Getenv("LISTEN_FDS"))
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// FileListener works on a duplicate, so the inherited descriptor is closed afterwards.
+	// The socket file belongs to systemd and is left in place on shutdown.
+	f := os.NewFile(uintptr(sdListenFDsStart), "LISTEN_FD_3")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket activation descriptor is not a listening socket: %w", err)
+	}
+	logInfo("SOCKET_ACTIVATED", "Addr", ln.Addr(), "FDs", n)
+	return ln, nil
+}
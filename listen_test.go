@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// unixSocketPath returns a socket path short enough for sun_path, which t.TempDir may exceed
+func unixSocketPath(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "es")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "echo.sock")
+}
+
+// unixClient sends every request over the socket at path, whatever the URL's host
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestUnixSocket(t *testing.T) {
+	tests := []struct {
+		name  string
+		stale bool
+	}{
+		{"fresh path", false},
+		{"stale socket file", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := unixSocketPath(t)
+			if tt.stale {
+				// A listener closed without unlinking leaves the file behind, like a crashed run
+				old, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				old.SetUnlinkOnClose(false)
+				old.Close()
+			}
+
+			cfg := DefaultConfig()
+			cfg.UnixSocket = path
+			ln, err := listen(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := newHTTPServer(cfg, NewServer(cfg).Handler())
+			go server.Serve(ln)
+
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := fi.Mode().Perm(); mode != UnixSocketMode {
+				t.Errorf("socket mode = %o, want %o", mode, UnixSocketMode)
+			}
+
+			client := unixClient(path)
+			resp, err := client.Get("http://unix/health")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("/health over the socket = %d", resp.StatusCode)
+			}
+			client.CloseIdleConnections()
+
+			if err := server.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("socket file still there after shutdown: %v", err)
+			}
+		})
+	}
+}
+
+func TestUnixSocketRefusesToReplace(t *testing.T) {
+	t.Run("regular file", func(t *testing.T) {
+		path := unixSocketPath(t)
+		if err := os.WriteFile(path, []byte("keep me"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := listenUnix(path); err == nil {
+			t.Fatal("listened over a regular file")
+		}
+		if data, _ := os.ReadFile(path); string(data) != "keep me" {
+			t.Error("the regular file was touched")
+		}
+	})
+	t.Run("socket in use", func(t *testing.T) {
+		path := unixSocketPath(t)
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		if _, err := listenUnix(path); err == nil {
+			t.Fatal("listened over a socket another listener is accepting on")
+		}
+	})
+}
+
+func TestSocketActivation(t *testing.T) {
+	// The test plays systemd: it opens the socket and hands it to the server as descriptor 3
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	f, err := ln.(*net.TCPListener).File()
+	ln.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	p := newProcess()
+	p.cmd.ExtraFiles = []*os.File{f}
+	p.cmd.Env = append(p.cmd.Env, "LISTEN_FDS=1", "LISTEN_FDNAMES=http")
+	p.start(t)
+
+	if activated := p.event(t, "SOCKET_ACTIVATED"); activated["addr"] != addr {
+		t.Errorf("SOCKET_ACTIVATED addr = %v, want the inherited %s", activated["addr"], addr)
+	}
+	if p.URL != "http://"+addr {
+		t.Errorf("server ready on %s instead of the inherited socket %s", p.URL, addr)
+	}
+	resp, body := fetch(t, newRequest(t, http.MethodGet, "http://"+addr+"/ping", nil))
+	if resp.StatusCode != http.StatusOK || string(body) != "pong" {
+		t.Errorf("/ping over the inherited socket = %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestNotSocketActivated(t *testing.T) {
+	tests := []struct {
+		name string
+		pid  string
+	}{
+		{"no LISTEN_PID", ""},
+		{"another process", "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_PID", tt.pid)
+			t.Setenv("LISTEN_FDS", "1")
+			ln, err := activatedListener()
+			if ln != nil || err != nil {
+				t.Errorf("activatedListener() = %v, %v, want the normal listener used", ln, err)
+			}
+		})
+	}
+}
+
+// capturingListener remembers the last connection it accepted, as handed to the wrapping listener
+type capturingListener struct {
+	net.Listener
+	last net.Conn
+}
+
+func (l *capturingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	l.last = conn
+	return conn, err
+}
+
+func TestKeepAliveListener(t *testing.T) {
+	tests := []struct {
+		name   string
+		period time.Duration
+		want   int
+	}{
+		{"enabled", 10 * time.Second, 1},
+		{"disabled", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcp, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tcp.Close()
+			inner := &capturingListener{Listener: tcp}
+			ln := keepAliveListener{Listener: inner, period: tt.period}
+
+			client, err := net.Dial("tcp", tcp.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if conn != inner.last {
+				t.Fatal("the accepted connection was replaced")
+			}
+
+			raw, err := conn.(*net.TCPConn).SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got int
+			var sockErr error
+			raw.Control(func(fd uintptr) {
+				got, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+			})
+			if sockErr != nil {
+				t.Fatal(sockErr)
+			}
+			if (got != 0) != (tt.want != 0) {
+				t.Errorf("SO_KEEPALIVE = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// failingListener fails its first accepts with errs before accepting from the real listener
+type failingListener struct {
+	net.Listener
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		l.mu.Unlock()
+		return nil, err
+	}
+	l.mu.Unlock()
+	return l.Listener.Accept()
+}
+
+func TestRetryListener(t *testing.T) {
+	accept := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", errno)}
+	}
+	tests := []struct {
+		name        string
+		errs        []error
+		wantServing bool
+		wantRetries int
+	}{
+		{"out of descriptors", []error{accept(syscall.EMFILE), accept(syscall.EMFILE), accept(syscall.ENFILE)}, true, 3},
+		{"aborted connection", []error{accept(syscall.ECONNABORTED)}, true, 1},
+		{"no errors", nil, true, 0},
+		{"permanent error", []error{accept(syscall.EINVAL)}, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t, LogFormatText, LevelInfo)
+			tcp, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln := newRetryListener(&failingListener{Listener: tcp, errs: tt.errs})
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Write([]byte("pong"))
+			})}
+			served := make(chan error, 1)
+			go func() { served <- server.Serve(ln) }()
+			defer server.Close()
+
+			resp, err := (&http.Client{Timeout: 5 * time.Second}).Get("http://" + tcp.Addr().String())
+			if tt.wantServing {
+				if err != nil {
+					t.Fatalf("request after accept errors: %v", err)
+				}
+				resp.Body.Close()
+			} else {
+				select {
+				case err := <-served:
+					if !errors.Is(err, syscall.EINVAL) {
+						t.Errorf("Serve returned %v, want the accept error", err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("Serve kept running after a permanent accept error")
+				}
+			}
+			if got := strings.Count(logs.String(), "ACCEPT RETRY: "); got != tt.wantRetries {
+				t.Errorf("logged %d accept retries, want %d:\n%s", got, tt.wantRetries, logs.String())
+			}
+		})
+	}
+}
+
+func TestRetryListenerCloseEndsBackoff(t *testing.T) {
+	captureLogs(t, LogFormatText, LevelInfo)
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make([]error, 20)
+	for i := range errs {
+		errs[i] = syscall.EMFILE
+	}
+	ln := newRetryListener(&failingListener{Listener: tcp, errs: errs})
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		accepted <- err
+	}()
+
+	// Twenty failures back off for several seconds in all, which Close cuts short
+	time.Sleep(50 * time.Millisecond)
+	ln.Close()
+	select {
+	case err := <-accepted:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Accept = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept still backing off after Close")
+	}
+}
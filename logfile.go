@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// logFile is an append-only log destination that can be reopened at the same path, so that after
+// logrotate renames the file, new lines go to a fresh one instead of the rotated file
+type logFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// openLogFile opens path for appending, creating it if needed
+func openLogFile(path string) (*logFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{path: path, f: f}, nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// Reopen switches to a newly opened file at the original path and closes the old one.
+// On failure the old file stays in use, so no lines are lost.
+func (l *logFile) Reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	return old.Close()
+}
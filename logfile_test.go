@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// readFile returns the contents of path, or "" if it does not exist yet
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// waitForFile polls path until it contains want, failing the test after a few seconds
+func waitForFile(t *testing.T, path, want string) string {
+	t.Helper()
+	for i := 0; i < 300; i++ {
+		if data := readFile(t, path); strings.Contains(data, want) {
+			return data
+		}
+		waitABit()
+	}
+	t.Fatalf("%s never contained %q, got:\n%s", path, want, readFile(t, path))
+	return ""
+}
+
+func TestLogFileReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "echo.log")
+	l, err := openLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.f.Close()
+
+	l.Write([]byte("before\n"))
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	// Until the reopen, lines follow the renamed file
+	l.Write([]byte("during\n"))
+	if err := l.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	l.Write([]byte("after\n"))
+
+	if got := readFile(t, path+".1"); got != "before\nduring\n" {
+		t.Errorf("rotated file = %q", got)
+	}
+	if got := readFile(t, path); got != "after\n" {
+		t.Errorf("fresh file = %q", got)
+	}
+}
+
+func TestLogFileReopenedOnSignal(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		sig  os.Signal
+	}{
+		{"SIGHUP", syscall.SIGHUP},
+		{"SIGUSR1", syscall.SIGUSR1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "echo.log")
+			p := newProcess("-log-file", path, "-access-log-format", AccessLogCommon)
+			p.run(t)
+			waitForFile(t, path, EventServerReady)
+			p.ready(findEvent(readFile(t, path), EventServerReady))
+
+			// logrotate renames the file, then signals the server
+			if err := os.Rename(path, path+".1"); err != nil {
+				t.Fatal(err)
+			}
+			p.signal(t, tt.sig)
+			waitForFile(t, path, "LOG_FILE_REOPENED")
+
+			fetch(t, newRequest(t, http.MethodGet, p.URL+"/ping", nil))
+			waitForFile(t, path, `"GET /ping HTTP/1.1" 200`)
+			if rotated := readFile(t, path+".1"); strings.Contains(rotated, "GET /ping") {
+				t.Errorf("request logged to the rotated file:\n%s", rotated)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// Log formats selected with -log-format
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Log levels selected with -log-level, from most to least verbose
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[string]int{"debug": LevelDebug, "info": LevelInfo, "warn": LevelWarn, "error": LevelError}
+
+// levelLabels are the names written to JSON logs, indexed by level; the last one is used by logFatal
+var levelLabels = []string{"debug", "info", "warn", "error", "fatal"}
+
+// parseLogLevel maps a level name such as "warn" to its level
+func parseLogLevel(name string) (int, error) {
+	level, ok := levelNames[name]
+	if !ok {
+		return 0, fmt.Errorf("log level must be one of debug, info, warn, error, got %q", name)
+	}
+	return level, nil
+}
+
+// eventLogger writes named events with key/value fields, dropping events below its level.
+// The text format keeps the familiar "UPLOAD SUCCESS: Client=1.2.3.4 BytesReceived=10"
+// lines, the JSON format emits one object per line with snake_case keys.
+type eventLogger struct {
+	json  bool
+	level atomic.Int64
+	out   *log.Logger
+}
+
+// eventLog is the process-wide event logger. setLogOutput replaces it whole, so requests still
+// running when the output changes keep a consistent logger.
+var eventLog atomic.Pointer[eventLogger]
+
+func init() {
+	setLogOutput(os.Stderr, LogFormatText, LevelInfo)
+}
+
+// newEventLogger returns a logger writing events at or above level to w in the given format
+func newEventLogger(w io.Writer, format string, level int) *eventLogger {
+	l := &eventLogger{json: format == LogFormatJSON, out: log.New(w, "", log.LstdFlags)}
+	if l.json {
+		l.out.SetFlags(0)
+	}
+	l.level.Store(int64(level))
+	return l
+}
+
+// setLogOutput switches the process-wide event logger to format and level, writing to w
+func setLogOutput(w io.Writer, format string, level int) {
+	eventLog.Store(newEventLogger(w, format, level))
+}
+
+// setLogLevel changes the level of the process-wide event logger, e.g. on a configuration reload
+func setLogLevel(level int) {
+	eventLog.Load().level.Store(int64(level))
+}
+
+// logDebug logs event with alternating key/value fields, e.g.
+// logDebug("DOWNLOAD_START", "Client", ip, "TotalSize", n).
+// Debug covers the chattiest per-request detail like health checks.
+func logDebug(event string, fields ...interface{}) {
+	eventLog.Load().log(LevelDebug, event, fields)
+}
+
+// logInfo logs routine events such as incoming requests, successes and lifecycle changes
+func logInfo(event string, fields ...interface{}) {
+	eventLog.Load().log(LevelInfo, event, fields)
+}
+
+// logWarn logs recoverable problems such as client disconnects and configuration warnings
+func logWarn(event string, fields ...interface{}) {
+	eventLog.Load().log(LevelWarn, event, fields)
+}
+
+// logError logs failed requests and server errors
+func logError(event string, fields ...interface{}) {
+	eventLog.Load().log(LevelError, event, fields)
+}
+
+// logFatal logs event regardless of level and exits the process
+func logFatal(event string, fields ...interface{}) {
+	eventLog.Load().log(LevelError+1, event, fields)
+	os.Exit(1)
+}
+
+func (l *eventLogger) log(level int, event string, fields []interface{}) {
+	if int64(level) < l.level.Load() {
+		return
+	}
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(MISSING)")
+	}
+
+	var b strings.Builder
+
+	// Fields are written by hand rather than through a map to keep them in call order
+	if l.json {
+		b.WriteString(`{"time":`)
+		writeJSONValue(&b, time.Now().Format(time.RFC3339Nano))
+		b.WriteString(`,"event":`)
+		writeJSONValue(&b, event)
+		b.WriteString(`,"level":`)
+		writeJSONValue(&b, levelLabels[level])
+		for i := 0; i < len(fields); i += 2 {
+			b.WriteByte(',')
+			writeJSONValue(&b, snakeCase(fmt.Sprint(fields[i])))
+			b.WriteByte(':')
+			writeJSONValue(&b, jsonValue(fields[i+1]))
+		}
+		b.WriteByte('}')
+		l.out.Print(b.String())
+		return
+	}
+
+	b.WriteString(strings.ReplaceAll(event, "_", " "))
+	b.WriteString(":")
+	for i := 0; i < len(fields); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", fields[i], fields[i+1])
+	}
+	l.out.Print(b.String())
+}
+
+// writeJSONValue appends v encoded as JSON, falling back to its string form if it cannot be encoded
+func writeJSONValue(b *strings.Builder, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+// jsonValue converts values that do not marshal usefully, like errors and durations, to strings
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+// snakeCase converts a CamelCase field name such as "BytesReceived" or "URLPath" to "bytes_received" or "url_path"
+func snakeCase(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
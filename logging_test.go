@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestEventLoggerFormats(t *testing.T) {
+	t.Run("text", func(t *testing.T) {
+		var buf bytes.Buffer
+		newEventLogger(&buf, LogFormatText, LevelInfo).log(LevelInfo, "UPLOAD_SUCCESS",
+			[]interface{}{"Client", "1.2.3.4", "BytesReceived", 10})
+		line := regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d UPLOAD SUCCESS: Client=1\.2\.3\.4 BytesReceived=10\n$`)
+		if !line.MatchString(buf.String()) {
+			t.Errorf("text line = %q", buf.String())
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		newEventLogger(&buf, LogFormatJSON, LevelInfo).log(LevelWarn, "UPLOAD_DISCONNECTED",
+			[]interface{}{"Client", "1.2.3.4", "BytesRead", 10, "Error", errors.New("boom"), "Duration", time.Second})
+		var entry map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("not one JSON object: %q: %v", buf.String(), err)
+		}
+		want := map[string]interface{}{
+			"event": "UPLOAD_DISCONNECTED", "level": "warn", "client": "1.2.3.4",
+			"bytes_read": float64(10), "error": "boom", "duration": "1s",
+		}
+		for k, v := range want {
+			if entry[k] != v {
+				t.Errorf("%s = %v, want %v", k, entry[k], v)
+			}
+		}
+		if _, err := time.Parse(time.RFC3339Nano, entry["time"].(string)); err != nil {
+			t.Errorf("time: %v", err)
+		}
+	})
+}
+
+func TestLogLevelFiltersDownload(t *testing.T) {
+	tests := []struct {
+		level   string
+		wantLog bool
+	}{
+		{"error", false},
+		{"warn", false},
+		{"info", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			level, err := parseLogLevel(tt.level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Logs are captured before the server starts, which never sees the logger change
+			logs := captureLogs(t, LogFormatText, level)
+			_, ts := newTestServer(t, DefaultConfig())
+			resp, _ := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/download?size=1000", nil))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			if got := logs.String() != ""; got != tt.wantLog {
+				t.Errorf("at %s level the download logged %q", tt.level, logs.String())
+			}
+		})
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	tests := map[string]string{
+		"BytesReceived": "bytes_received",
+		"URLPath":       "url_path",
+		"Client":        "client",
+		"RequestID":     "request_id",
+		"Bps2Sent":      "bps2_sent",
+	}
+	for in, want := range tests {
+		if got := snakeCase(in); got != want {
+			t.Errorf("snakeCase(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runMainEnv makes the test binary run main instead of the tests, so startProcess can test the
+// whole server process: signals, shutdown and lifecycle events
+const runMainEnv = "ECHO_STREAM_TEST_RUN_MAIN"
+
+// TestMain silences the event and access logs, which the tests that check them capture themselves
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		// systemd sets LISTEN_PID to the PID of the process it starts, which the test only
+		// learns once it has started it
+		if os.Getenv("LISTEN_FDS") != "" && os.Getenv("LISTEN_PID") == "" {
+			os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		}
+		main()
+		os.Exit(0)
+	}
+	setLogOutput(io.Discard, LogFormatText, LevelInfo)
+	accessLog.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testConfig resolves a configuration from args like the command line does, failing the test on error
+func testConfig(t *testing.T, args ...string) *Config {
+	t.Helper()
+	cfg, err := loadConfig(args, nil)
+	if err != nil {
+		t.Fatalf("loadConfig(%q): %v", args, err)
+	}
+	return cfg
+}
+
+// newTestServer serves cfg through the full middleware stack on a local port until the test ends
+func newTestServer(t *testing.T, cfg *Config) (*Server, *httptest.Server) {
+	t.Helper()
+	app := NewServer(cfg)
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newHTTPServer(cfg, app.Handler())
+	ts.Config.RegisterOnShutdown(app.Shutdown)
+	ts.Config.ConnContext = watchConnContext
+	ts.Listener = watchedListener{Listener: ts.Listener}
+	ts.Start()
+	t.Cleanup(func() {
+		ts.Close()
+		app.Shutdown()
+	})
+	return app, ts
+}
+
+// fetch sends req and returns the response with its body read in full
+func fetch(t *testing.T, req *http.Request) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", req.Method, req.URL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading body: %v", req.Method, req.URL, err)
+	}
+	return resp, body
+}
+
+// newRequest builds a request, failing the test on a malformed URL
+func newRequest(t *testing.T, method, url string, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// startSlowDownload begins a download that streams for minutes, returning once its headers have
+// arrived so it holds whatever slots it took until the test closes its body or ends
+func startSlowDownload(t *testing.T, url string, header http.Header) *http.Response {
+	t.Helper()
+	req := newRequest(t, http.MethodGet, url+"/download?size=10MB&rate=1KB", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// syncBuffer is a bytes.Buffer that log output can be written to while a test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs sends the event log to a buffer in format at level until the test ends
+func captureLogs(t *testing.T, format string, level int) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	setLogOutput(buf, format, level)
+	t.Cleanup(func() { setLogOutput(io.Discard, LogFormatText, LevelInfo) })
+	return buf
+}
+
+// waitABit pauses a polling loop
+func waitABit() {
+	time.Sleep(10 * time.Millisecond)
+}
+
+// waitForLog polls logs until it contains want, failing the test after a few seconds
+func waitForLog(t *testing.T, logs *syncBuffer, want string) {
+	t.Helper()
+	for i := 0; i < 300; i++ {
+		if strings.Contains(logs.String(), want) {
+			return
+		}
+		waitABit()
+	}
+	t.Fatalf("log never contained %q, got:\n%s", want, logs.String())
+}
+
+// serverProcess is the server running main in a child process of the test
+type serverProcess struct {
+	cmd  *exec.Cmd
+	logs *syncBuffer
+	done chan struct{}
+	err  error
+
+	// URL is the base URL of the HTTP listener, known once the server is ready
+	URL string
+}
+
+// startProcess runs the server with args on a free local port, logging JSON, and waits until it is
+// ready. The process is killed when the test ends if it is still running.
+func startProcess(t *testing.T, args ...string) *serverProcess {
+	t.Helper()
+	return newProcess(args...).start(t)
+}
+
+// newProcess prepares a server process like startProcess, for tests that need to adjust its
+// command, such as passing it file descriptors, before calling start
+func newProcess(args ...string) *serverProcess {
+	args = append([]string{"-port", "127.0.0.1:0", "-log-format", "json"}, args...)
+	p := &serverProcess{cmd: exec.Command(os.Args[0], args...), logs: &syncBuffer{}, done: make(chan struct{})}
+	p.cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	p.cmd.Stderr = p.logs
+	return p
+}
+
+// start runs the prepared process and waits until it is ready
+func (p *serverProcess) start(t *testing.T) *serverProcess {
+	t.Helper()
+	p.run(t)
+	p.ready(p.event(t, EventServerReady))
+	return p
+}
+
+// run starts the prepared process without waiting for it, for tests that find its logs elsewhere
+func (p *serverProcess) run(t *testing.T) {
+	t.Helper()
+	if err := p.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		p.err = p.cmd.Wait()
+		close(p.done)
+	}()
+	t.Cleanup(func() {
+		p.cmd.Process.Kill()
+		<-p.done
+	})
+}
+
+// ready records the address from the server's ready event
+func (p *serverProcess) ready(event map[string]interface{}) {
+	p.URL = "http://" + event["addr"].(string)
+}
+
+// event waits for the first log entry of the named event and returns its fields
+func (p *serverProcess) event(t *testing.T, name string) map[string]interface{} {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		if entry := findEvent(p.logs.String(), name); entry != nil {
+			return entry
+		}
+		select {
+		case <-p.done:
+			t.Fatalf("server exited (%v) without logging %s:\n%s", p.err, name, p.logs.String())
+		default:
+		}
+		waitABit()
+	}
+	t.Fatalf("server never logged %s:\n%s", name, p.logs.String())
+	return nil
+}
+
+// findEvent returns the fields of the first JSON log line of the named event in logs, or nil
+func findEvent(logs, name string) map[string]interface{} {
+	sc := bufio.NewScanner(strings.NewReader(logs))
+	for sc.Scan() {
+		var entry map[string]interface{}
+		if json.Unmarshal(sc.Bytes(), &entry) == nil && entry["event"] == name {
+			return entry
+		}
+	}
+	return nil
+}
+
+// signal sends sig to the server process
+func (p *serverProcess) signal(t *testing.T, sig os.Signal) {
+	t.Helper()
+	if err := p.cmd.Process.Signal(sig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// wait blocks until the server process exits, failing the test if that takes longer than timeout
+func (p *serverProcess) wait(t *testing.T, timeout time.Duration) {
+	t.Helper()
+	select {
+	case <-p.done:
+		if p.err != nil {
+			t.Fatalf("server exited with %v:\n%s", p.err, p.logs.String())
+		}
+	case <-time.After(timeout):
+		t.Fatalf("server still running after %s:\n%s", timeout, p.logs.String())
+	}
+}
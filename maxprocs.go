@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cgroupCPUMax is the cgroup v2 file holding the CPU quota and period of this container
+const cgroupCPUMax = "/sys/fs/cgroup/cpu.max"
+
+// applyMaxProcs sets GOMAXPROCS from -maxprocs, or else from a GOMAXPROCS environment variable
+// the runtime already honored, or else from the cgroup CPU quota. It returns the value in effect
+// and where it came from.
+func applyMaxProcs(cfg *Config) (int, string) {
+	switch {
+	case cfg.MaxProcs > 0:
+		runtime.GOMAXPROCS(cfg.MaxProcs)
+		return cfg.MaxProcs, "flag"
+	case os.Getenv("GOMAXPROCS") != "":
+		return runtime.GOMAXPROCS(0), "env"
+	}
+	if n, ok := cgroupCPUQuota(cgroupCPUMax); ok && n < runtime.NumCPU() {
+		runtime.GOMAXPROCS(n)
+		return n, "cgroup"
+	}
+	return runtime.GOMAXPROCS(0), "default"
+}
+
+// cgroupCPUQuota reads a cpu.max file such as "150000 100000" and returns the quota in whole CPUs,
+// rounded up so a fractional limit still gets a thread. "max" means no limit and reports false.
+func cgroupCPUQuota(path string) (int, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0, false
+	}
+	quota, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || quota <= 0 {
+		return 0, false
+	}
+	period, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || period <= 0 {
+		return 0, false
+	}
+	return max(1, int(math.Ceil(quota/period))), true
+}
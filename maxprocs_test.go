@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestApplyMaxProcs(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	tests := []struct {
+		name       string
+		maxprocs   int
+		env        string
+		want       int
+		wantSource string
+	}{
+		{"flag", 3, "", 3, "flag"},
+		{"flag over the environment", 2, "5", 2, "flag"},
+		{"environment", 0, "5", 5, "env"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GOMAXPROCS", tt.env)
+			if tt.env != "" {
+				// The runtime reads the variable at startup, so do what it would have done
+				runtime.GOMAXPROCS(5)
+			}
+			cfg := DefaultConfig()
+			cfg.MaxProcs = tt.maxprocs
+			n, source := applyMaxProcs(cfg)
+			if n != tt.want || source != tt.wantSource {
+				t.Errorf("applyMaxProcs = %d, %q, want %d, %q", n, source, tt.want, tt.wantSource)
+			}
+			if got := runtime.GOMAXPROCS(0); got != tt.want {
+				t.Errorf("runtime.GOMAXPROCS = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCgroupCPUQuota(t *testing.T) {
+	tests := []struct {
+		contents string
+		want     int
+		ok       bool
+	}{
+		{"200000 100000\n", 2, true},
+		{"150000 100000\n", 2, true},
+		{"50000 100000\n", 1, true},
+		{"1000 100000\n", 1, true},
+		{"max 100000\n", 0, false},
+		{"0 100000\n", 0, false},
+		{"200000\n", 0, false},
+		{"abc 100000\n", 0, false},
+		{"200000 0\n", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contents, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cpu.max")
+			if err := os.WriteFile(path, []byte(tt.contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, ok := cgroupCPUQuota(path)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("cgroupCPUQuota(%q) = %d, %v, want %d, %v", tt.contents, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+	if _, ok := cgroupCPUQuota(filepath.Join(t.TempDir(), "missing")); ok {
+		t.Error("a missing cpu.max reported a quota")
+	}
+}
+
+func TestMaxProcsFlagAndEnv(t *testing.T) {
+	tests := []struct {
+		args []string
+		env  map[string]string
+		want int
+	}{
+		{nil, nil, 0},
+		{[]string{"-maxprocs", "4"}, nil, 4},
+		{nil, map[string]string{"ECHO_MAXPROCS": "2"}, 2},
+		{[]string{"-maxprocs", "4"}, map[string]string{"ECHO_MAXPROCS": "2"}, 4},
+	}
+	for _, tt := range tests {
+		cfg, err := loadConfig(tt.args, tt.env)
+		if err != nil {
+			t.Fatalf("%v %v: %v", tt.args, tt.env, err)
+		}
+		if cfg.MaxProcs != tt.want {
+			t.Errorf("%v %v: MaxProcs = %d, want %d", tt.args, tt.env, cfg.MaxProcs, tt.want)
+		}
+	}
+	if _, err := loadConfig([]string{"-maxprocs", "-1"}, nil); err == nil {
+		t.Error("negative -maxprocs accepted")
+	}
+}
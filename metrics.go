@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are kept as plain atomic counters and rendered by hand in the Prometheus
+// text exposition format, or in OpenMetrics when the scraper asks for it, so the
+// server stays free of third-party dependencies.
+
+// DurationBuckets are the upper bounds in seconds of the request duration histogram
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// OpenMetricsType is the media type scrapers send in Accept to get the OpenMetrics format
+const OpenMetricsType = "application/openmetrics-text"
+
+// maxExemplarID is the longest request ID that fits the 128 character label limit of
+// an OpenMetrics exemplar next to the request_id label name
+const maxExemplarID = 128 - len("request_id")
+
+// Metrics collects server-wide counters; it is safe for concurrent use
+type Metrics struct {
+	start time.Time
+
+	uploadBytes       atomic.Int64
+	downloadBytes     atomic.Int64
+	uploadsInFlight   atomic.Int64
+	downloadsInFlight atomic.Int64
+
+	mu        sync.RWMutex
+	endpoints map[string]*endpointMetrics
+}
+
+// endpointMetrics holds the request counter and duration histogram of one endpoint
+type endpointMetrics struct {
+	requests atomic.Uint64
+	buckets  []atomic.Uint64 // cumulative counts, one per DurationBuckets entry
+	sumNanos atomic.Int64
+
+	// exemplars keep the latest request to land in each bucket, plus one for +Inf
+	exemplars []atomic.Pointer[exemplar]
+}
+
+// exemplar ties a histogram bucket to one request that was observed in it
+type exemplar struct {
+	requestID string
+	value     float64
+	at        time.Time
+}
+
+// NewMetrics returns an empty metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{start: time.Now(), endpoints: make(map[string]*endpointMetrics)}
+}
+
+// endpoint returns the metrics of the named endpoint, creating them on first use
+func (m *Metrics) endpoint(name string) *endpointMetrics {
+	m.mu.RLock()
+	e, ok := m.endpoints[name]
+	m.mu.RUnlock()
+	if ok {
+		return e
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok = m.endpoints[name]; !ok {
+		e = &endpointMetrics{
+			buckets:   make([]atomic.Uint64, len(DurationBuckets)),
+			exemplars: make([]atomic.Pointer[exemplar], len(DurationBuckets)+1),
+		}
+		m.endpoints[name] = e
+	}
+	return e
+}
+
+// observe records one request to endpoint that started at start, keeping reqID as the
+// exemplar of the bucket it lands in; use it with defer
+func (m *Metrics) observe(endpoint string, start time.Time, reqID string) {
+	d := time.Since(start)
+	e := m.endpoint(endpoint)
+	e.requests.Add(1)
+	e.sumNanos.Add(int64(d))
+	bucket := len(DurationBuckets)
+	for i, le := range DurationBuckets {
+		if d.Seconds() <= le {
+			e.buckets[i].Add(1)
+			bucket = min(bucket, i)
+		}
+	}
+	if reqID != "" && len(reqID) <= maxExemplarID {
+		e.exemplars[bucket].Store(&exemplar{requestID: reqID, value: d.Seconds(), at: start.Add(d)})
+	}
+}
+
+// endpointNames returns the names of all endpoints seen so far, sorted
+func (m *Metrics) endpointNames() []string {
+	m.mu.RLock()
+	names := make([]string, 0, len(m.endpoints))
+	for name := range m.endpoints {
+		names = append(names, name)
+	}
+	m.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// WritePrometheus renders all metrics in the Prometheus text exposition format
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	m.write(w, false)
+}
+
+// WriteOpenMetrics renders all metrics in the OpenMetrics text format, with request ID
+// exemplars on the histogram buckets and the closing # EOF
+func (m *Metrics) WriteOpenMetrics(w io.Writer) {
+	m.write(w, true)
+	fmt.Fprintf(w, "# EOF\n")
+}
+
+// write renders every metric family; OpenMetrics names counter families without the
+// _total suffix their samples carry and appends exemplars to the buckets
+func (m *Metrics) write(w io.Writer, openMetrics bool) {
+	family := func(name, kind, help string) {
+		if openMetrics && kind == "counter" {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	}
+	exemplarOf := func(e *endpointMetrics, bucket int) string {
+		x := e.exemplars[bucket].Load()
+		if !openMetrics || x == nil {
+			return ""
+		}
+		return fmt.Sprintf(" # {request_id=%q} %g %.3f", x.requestID, x.value,
+			float64(x.at.UnixMilli())/1000)
+	}
+
+	family("echo_upload_bytes_total", "counter", "Total bytes received by /upload.")
+	fmt.Fprintf(w, "echo_upload_bytes_total %d\n", m.uploadBytes.Load())
+
+	family("echo_download_bytes_total", "counter", "Total bytes sent by /download.")
+	fmt.Fprintf(w, "echo_download_bytes_total %d\n", m.downloadBytes.Load())
+
+	family("echo_uploads_in_flight", "gauge", "Uploads currently in progress.")
+	fmt.Fprintf(w, "echo_uploads_in_flight %d\n", m.uploadsInFlight.Load())
+
+	family("echo_downloads_in_flight", "gauge", "Downloads currently in progress.")
+	fmt.Fprintf(w, "echo_downloads_in_flight %d\n", m.downloadsInFlight.Load())
+
+	names := m.endpointNames()
+
+	family("echo_requests_total", "counter", "Total requests by endpoint.")
+	for _, name := range names {
+		fmt.Fprintf(w, "echo_requests_total{endpoint=%q} %d\n", name, m.endpoint(name).requests.Load())
+	}
+
+	family("echo_request_duration_seconds", "histogram", "Request duration by endpoint.")
+	for _, name := range names {
+		e := m.endpoint(name)
+		count := e.requests.Load()
+		for i, le := range DurationBuckets {
+			fmt.Fprintf(w, "echo_request_duration_seconds_bucket{endpoint=%q,le=%q} %d%s\n",
+				name, strconv.FormatFloat(le, 'g', -1, 64), e.buckets[i].Load(), exemplarOf(e, i))
+		}
+		fmt.Fprintf(w, "echo_request_duration_seconds_bucket{endpoint=%q,le=\"+Inf\"} %d%s\n",
+			name, count, exemplarOf(e, len(DurationBuckets)))
+		fmt.Fprintf(w, "echo_request_duration_seconds_sum{endpoint=%q} %g\n", name, time.Duration(e.sumNanos.Load()).Seconds())
+		fmt.Fprintf(w, "echo_request_duration_seconds_count{endpoint=%q} %d\n", name, count)
+	}
+}
+
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Vary", "Accept")
+	if strings.Contains(r.Header.Get("Accept"), OpenMetricsType) {
+		w.Header().Set("Content-Type", OpenMetricsType+"; version=1.0.0; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		s.metrics.WriteOpenMetrics(w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	s.metrics.WritePrometheus(w)
+}
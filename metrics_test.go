@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsFormats(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	req := newRequest(t, http.MethodGet, ts.URL+"/ping", nil)
+	req.Header.Set(RequestIDHeader, "metrics-exemplar")
+	fetch(t, req)
+
+	tests := []struct {
+		name        string
+		accept      string
+		wantType    string
+		openMetrics bool
+	}{
+		{"no Accept", "", "text/plain; version=0.0.4", false},
+		{"plain text", "text/plain", "text/plain; version=0.0.4", false},
+		{"anything", "*/*", "text/plain; version=0.0.4", false},
+		{"OpenMetrics", OpenMetricsType, OpenMetricsType + "; version=1.0.0", true},
+		{"Prometheus scraper preferring OpenMetrics",
+			"application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1",
+			OpenMetricsType + "; version=1.0.0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/metrics", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			resp, body := fetch(t, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if got := resp.Header.Get("Vary"); got != "Accept" {
+				t.Errorf("Vary = %q, want Accept", got)
+			}
+
+			text := string(body)
+			checks := []struct {
+				what string
+				ok   bool
+			}{
+				{"ends with # EOF", strings.HasSuffix(text, "\n# EOF\n")},
+				{"counter families drop _total", strings.Contains(text, "# TYPE echo_requests counter\n")},
+				{"exemplars on buckets", strings.Contains(text, `# {request_id="metrics-exemplar"}`)},
+			}
+			for _, c := range checks {
+				if c.ok != tt.openMetrics {
+					t.Errorf("%s: %v, want %v", c.what, c.ok, tt.openMetrics)
+				}
+			}
+			// Either way the samples themselves keep their names
+			if !strings.Contains(text, `echo_requests_total{endpoint="ping"} 1`) {
+				t.Errorf("no ping request counted in:\n%s", text)
+			}
+		})
+	}
+}
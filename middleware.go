@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// middleware wraps a handler with cross-cutting behavior such as logging, CORS or limits,
+// so the handlers themselves only implement their endpoint
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h in mws; the first middleware is the outermost and sees the request first
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// requestLog names the event logged for requests to an endpoint and its level
+type requestLog struct {
+	event string
+	level int
+}
+
+// requestLogs keeps the per-endpoint event names; paths not listed are logged as REQUEST.
+// Health checks are chatty and only logged at debug, /ping is never logged so it does not
+// skew latency measurements, and /metrics, /stats and /version are polled by tooling.
+var requestLogs = map[string]requestLog{
+	"/":            {"INDEX_REQUEST", LevelInfo},
+	"/upload":      {"UPLOAD_REQUEST", LevelInfo},
+	"/download":    {"DOWNLOAD_REQUEST", LevelInfo},
+	"/delay":       {"DELAY_REQUEST", LevelInfo},
+	"/status":      {"STATUS_REQUEST", LevelInfo},
+	"/echo":        {"ECHO_REQUEST", LevelInfo},
+	"/ws":          {"WS_REQUEST", LevelInfo},
+	"/events":      {"EVENTS_REQUEST", LevelInfo},
+	"/redirect":    {"REDIRECT_REQUEST", LevelInfo},
+	"/cookies":     {"COOKIES_REQUEST", LevelInfo},
+	"/admin/drain": {"ADMIN_REQUEST", LevelInfo},
+	"/health":      {"HEALTH_CHECK", LevelDebug},
+	"/livez":       {"HEALTH_CHECK", LevelDebug},
+	"/readyz":      {"HEALTH_CHECK", LevelDebug},
+	"/ping":        {},
+	"/metrics":     {},
+	"/stats":       {},
+	"/version":     {},
+}
+
+// logRequests logs every incoming request before it is handled, and at debug level its status,
+// size and duration once it is done
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl, ok := requestLogs[r.URL.Path]
+		if !ok {
+			rl = requestLog{"REQUEST", LevelInfo}
+		}
+		if rl.event == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		clientIP, reqID := s.getClientIP(r), requestIDFromContext(r.Context())
+		eventLog.Load().log(rl.level, rl.event, []interface{}{"Client", clientIP, "RequestID", reqID,
+			"Method", r.Method, "URL", r.URL.Path, "Query", r.URL.RawQuery, "ContentLength", r.ContentLength,
+			"UserAgent", r.UserAgent()})
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		logDebug("REQUEST_DONE", "Client", clientIP, "RequestID", reqID, "Status", rec.statusCode(),
+			"BytesSent", rec.bytes, "Duration", time.Since(start))
+	})
+}
+
+// statusRecorder remembers the status and body size of a response for logging after the handler
+// returns. Flush and Hijack pass through, so streaming and WebSockets work behind it, and Unwrap
+// lets http.NewResponseController reach the rest of the underlying writer.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps io.Copy into the response on net/http's sendfile path
+func (w *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, src)
+	w.bytes += n
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands over the connection; a handler hijacking before writing a status is upgrading it,
+// so the status is recorded as 101
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// statusCode is the status sent, net/http's implicit 200 when the handler never set one
+func (w *statusRecorder) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// allowMethods answers 405 with an Allow header to requests using any method but methods, so a
+// client sending the wrong one finds out instead of getting a download for its upload
+func (s *Server) allowMethods(methods ...string) middleware {
+	allow := strings.Join(methods, ", ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !slices.Contains(methods, r.Method) {
+				logWarn("METHOD_NOT_ALLOWED", "Client", s.getClientIP(r), "RequestID", requestIDFromContext(r.Context()),
+					"Method", r.Method, "URL", r.URL.Path, "Allow", allow)
+				w.Header().Set("Allow", allow)
+				http.Error(w, fmt.Sprintf("method %s not allowed, use %s", r.Method, allow), http.StatusMethodNotAllowed)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// observe records the request count and duration of endpoint in the metrics
+func (s *Server) observe(endpoint string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer s.metrics.observe(endpoint, time.Now(), requestIDFromContext(r.Context()))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
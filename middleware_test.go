@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tagging returns a middleware that appends name to the X-Order header before and after next runs
+func tagging(name string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Order", name+">")
+			next.ServeHTTP(w, r)
+			w.Header().Add("X-Order", "<"+name)
+		})
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		mws  []middleware
+		want string
+	}{
+		{"none", nil, "handler"},
+		{"one", []middleware{tagging("a")}, "a>,handler,<a"},
+		{"two", []middleware{tagging("a"), tagging("b")}, "a>,b>,handler,<b,<a"},
+		{"three", []middleware{tagging("a"), tagging("b"), tagging("c")}, "a>,b>,c>,handler,<c,<b,<a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Order", "handler")
+			})
+			rec := httptest.NewRecorder()
+			chain(h, tt.mws...).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if got := strings.Join(rec.Header().Values("X-Order"), ","); got != tt.want {
+				t.Errorf("order = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	logs := captureLogs(t, LogFormatText, LevelInfo)
+	_, ts := newTestServer(t, DefaultConfig())
+	for _, path := range []string{"/ping", "/download?size=10", "/stats"} {
+		fetch(t, newRequest(t, http.MethodGet, ts.URL+path, nil))
+	}
+	waitForLog(t, logs, "DOWNLOAD REQUEST:")
+	if strings.Contains(logs.String(), "/ping") || strings.Contains(logs.String(), "/stats") {
+		t.Errorf("unlogged endpoints were logged:\n%s", logs.String())
+	}
+}
+
+func TestStatusRecorder(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    func(w http.ResponseWriter)
+		wantStatus int
+		wantBytes  int64
+	}{
+		{"implicit 200", func(w http.ResponseWriter) { io.WriteString(w, "hello") }, http.StatusOK, 5},
+		{"no body", func(w http.ResponseWriter) {}, http.StatusOK, 0},
+		{"explicit status", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusTeapot)
+			io.WriteString(w, "short and stout")
+		}, http.StatusTeapot, 15},
+		{"first status wins", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusNotFound)
+			w.WriteHeader(http.StatusOK)
+		}, http.StatusNotFound, 0},
+		{"several writes", func(w http.ResponseWriter) {
+			io.WriteString(w, "abc")
+			w.(http.Flusher).Flush()
+			io.WriteString(w, "defg")
+		}, http.StatusOK, 7},
+		{"io.Copy through ReadFrom", func(w http.ResponseWriter) {
+			io.Copy(w, strings.NewReader(strings.Repeat("x", 1000)))
+		}, http.StatusOK, 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := httptest.NewRecorder()
+			rec := &statusRecorder{ResponseWriter: inner}
+			tt.handler(rec)
+			if got := rec.statusCode(); got != tt.wantStatus {
+				t.Errorf("statusCode() = %d, want %d", got, tt.wantStatus)
+			}
+			if rec.bytes != tt.wantBytes {
+				t.Errorf("bytes = %d, want %d", rec.bytes, tt.wantBytes)
+			}
+			if int64(inner.Body.Len()) != tt.wantBytes {
+				t.Errorf("underlying writer got %d bytes, want %d", inner.Body.Len(), tt.wantBytes)
+			}
+		})
+	}
+}
+
+func TestStatusRecorderPassesThroughHijack(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		conn, brw, err := rec.Hijack()
+		if err != nil {
+			t.Errorf("Hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 204 No Content\r\n\r\n")
+		brw.Flush()
+		if got := rec.statusCode(); got != http.StatusSwitchingProtocols {
+			t.Errorf("statusCode() after hijacking = %d, want %d", got, http.StatusSwitchingProtocols)
+		}
+	}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want the hijacked connection's 204", resp.StatusCode)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		method     string
+		path       string
+		wantStatus int
+		wantAllow  string
+	}{
+		{http.MethodGet, "/upload", http.StatusMethodNotAllowed, "POST, PUT"},
+		{http.MethodDelete, "/upload", http.StatusMethodNotAllowed, "POST, PUT"},
+		{http.MethodPost, "/upload", http.StatusOK, ""},
+		{http.MethodPut, "/upload", http.StatusOK, ""},
+		{http.MethodPost, "/download?size=10", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodPut, "/download?size=10", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodGet, "/download?size=10", http.StatusOK, ""},
+		{http.MethodHead, "/download?size=10", http.StatusOK, ""},
+		{http.MethodPost, "/health", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodDelete, "/livez", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodPost, "/readyz", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodGet, "/health", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			logs := captureLogs(t, LogFormatText, LevelInfo)
+			resp, body := fetch(t, newRequest(t, tt.method, ts.URL+tt.path, strings.NewReader("payload")))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if got := resp.Header.Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if tt.wantStatus != http.StatusMethodNotAllowed {
+				return
+			}
+			if !strings.Contains(string(body), "use "+tt.wantAllow) {
+				t.Errorf("body = %q, want it to name the allowed methods", body)
+			}
+			if !strings.Contains(logs.String(), "METHOD NOT ALLOWED: ") {
+				t.Errorf("no METHOD_NOT_ALLOWED logged:\n%s", logs.String())
+			}
+		})
+	}
+}
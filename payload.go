@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"os"
+	"sync"
+)
+
+// Download payload patterns selected with the pattern query parameter
+const (
+	PatternZero         = "zero"
+	PatternRandom       = "random"
+	PatternIncrementing = "incrementing"
+	PatternText         = "text"
+)
+
+// DefaultPatternText is repeated by pattern=text when no text parameter is given
+const DefaultPatternText = "echo-stream\n"
+
+// MaxPatternText bounds the text parameter, which is meant to be a short marker
+const MaxPatternText = 256
+
+// textBlockSize is roughly how large a text block grows, so short texts are not copied a byte at a time
+const textBlockSize = 4096
+
+// RandomBlockSize is larger than the 32KB deflate window so random downloads stay incompressible
+const RandomBlockSize = 1024 * 1024 // 1MB
+
+var (
+	randomBlockOnce sync.Once
+	randomBlockData []byte
+)
+
+// randomBlock returns the shared random block, generating it on first use
+func randomBlock() []byte {
+	randomBlockOnce.Do(func() {
+		randomBlockData = make([]byte, RandomBlockSize)
+		if _, err := rand.Read(randomBlockData); err != nil {
+			panic(fmt.Sprintf("crypto/rand failed: %v", err))
+		}
+	})
+	return randomBlockData
+}
+
+// incrementingBlock is the shared block of pattern=incrementing, bytes 0 to 255
+var incrementingBlock = sync.OnceValue(func() []byte {
+	block := make([]byte, 256)
+	for i := range block {
+		block[i] = byte(i)
+	}
+	return block
+})
+
+// defaultTextBlock is the shared block of pattern=text without a text parameter
+var defaultTextBlock = sync.OnceValue(func() []byte {
+	block, _ := buildTextBlock(DefaultPatternText)
+	return block
+})
+
+// downloadBuffers keeps write buffers of -buffer-size between downloads, so a busy server does
+// not allocate one per request. It holds pointers so that Put does not allocate either.
+var downloadBuffers sync.Pool
+
+// getDownloadBuffer returns a zeroed buffer of size, taken from downloadBuffers when size is the
+// pooled -buffer-size. Other sizes, such as a bufsize query, get a fresh buffer.
+func getDownloadBuffer(size, pooled int) *[]byte {
+	if size == pooled {
+		// A buffer left over from before a reload changed -buffer-size is dropped
+		if bp, ok := downloadBuffers.Get().(*[]byte); ok && len(*bp) == size {
+			clear(*bp)
+			return bp
+		}
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+// putDownloadBuffer returns a buffer from getDownloadBuffer to the pool if it has the pooled size
+func putDownloadBuffer(bp *[]byte, pooled int) {
+	if len(*bp) == pooled {
+		downloadBuffers.Put(bp)
+	}
+}
+
+// SeededBlockCacheSize is how many seeded random blocks are kept, so a load test repeating a
+// few seeds does not generate a fresh block for every request
+const SeededBlockCacheSize = 8
+
+// seededBlocks is a small LRU cache of seeded random blocks; the front of order is the most
+// recently used seed
+var seededBlocks = struct {
+	sync.Mutex
+	order  *list.List
+	blocks map[int64]*list.Element
+}{order: list.New(), blocks: map[int64]*list.Element{}}
+
+// seededBlock is an entry of seededBlocks
+type seededBlock struct {
+	seed  int64
+	block []byte
+}
+
+// seededRandomBlock returns a pseudo-random block that is identical for the same seed,
+// so clients can regenerate and compare downloads. It uses math/rand and is not
+// cryptographically secure. Blocks are shared and must not be modified.
+func seededRandomBlock(seed int64) []byte {
+	if block := cachedSeededBlock(seed); block != nil {
+		return block
+	}
+
+	// Generated without the lock, so requests for other seeds are not held up meanwhile
+	block := make([]byte, RandomBlockSize)
+	mathrand.New(mathrand.NewSource(seed)).Read(block)
+
+	seededBlocks.Lock()
+	defer seededBlocks.Unlock()
+	if e, ok := seededBlocks.blocks[seed]; ok {
+		return e.Value.(*seededBlock).block
+	}
+	seededBlocks.blocks[seed] = seededBlocks.order.PushFront(&seededBlock{seed: seed, block: block})
+	if seededBlocks.order.Len() > SeededBlockCacheSize {
+		oldest := seededBlocks.order.Remove(seededBlocks.order.Back()).(*seededBlock)
+		delete(seededBlocks.blocks, oldest.seed)
+	}
+	return block
+}
+
+// cachedSeededBlock returns the cached block for seed, or nil when it is not cached
+func cachedSeededBlock(seed int64) []byte {
+	seededBlocks.Lock()
+	defer seededBlocks.Unlock()
+	if e, ok := seededBlocks.blocks[seed]; ok {
+		seededBlocks.order.MoveToFront(e)
+		return e.Value.(*seededBlock).block
+	}
+	return nil
+}
+
+// payloadBlock returns the block that is repeated to build a download body.
+// A nil block means the body is all zeros, which needs no copying. text is only used by
+// the text pattern. Blocks may be shared between requests and must not be modified.
+func payloadBlock(pattern, text string) ([]byte, error) {
+	switch pattern {
+	case "", PatternZero:
+		return nil, nil
+	case PatternRandom:
+		return randomBlock(), nil
+	case PatternIncrementing:
+		return incrementingBlock(), nil
+	case PatternText:
+		return textBlock(text)
+	default:
+		return nil, fmt.Errorf("unknown pattern %q", pattern)
+	}
+}
+
+// textBlock repeats text, made printable, into a block whose length is a multiple of the text so
+// the pattern stays continuous across blocks. Bytes other than printable ASCII and newlines
+// become '.'.
+func textBlock(text string) ([]byte, error) {
+	if text == "" || text == DefaultPatternText {
+		return defaultTextBlock(), nil
+	}
+	return buildTextBlock(text)
+}
+
+// buildTextBlock builds a new text block for textBlock
+func buildTextBlock(text string) ([]byte, error) {
+	if len(text) > MaxPatternText {
+		return nil, fmt.Errorf("text must be at most %d bytes", MaxPatternText)
+	}
+	unit := []byte(text)
+	for i, c := range unit {
+		if (c < ' ' || c > '~') && c != '\n' {
+			unit[i] = '.'
+		}
+	}
+	return bytes.Repeat(unit, max(1, textBlockSize/len(unit))), nil
+}
+
+// fillPayload fills buf with the payload bytes found at offset in the body,
+// so the pattern stays continuous across chunk boundaries
+func fillPayload(buf, block []byte, offset int) {
+	if block == nil {
+		return
+	}
+	for n := 0; n < len(buf); {
+		n += copy(buf[n:], block[(offset+n)%len(block):])
+	}
+}
+
+// fillFromFile fills buf with the bytes found at offset in a body that repeats the file of the
+// given size, the file-backed counterpart of fillPayload
+func fillFromFile(buf []byte, f *os.File, size int64, offset int) error {
+	for n := 0; n < len(buf); {
+		pos := (int64(offset) + int64(n)) % size
+		m, err := f.ReadAt(buf[n:n+int(min(int64(len(buf)-n), size-pos))], pos)
+		n += m
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFromFile writes length bytes of a body that repeats the file of the given size, starting at
+// offset. Each pass is an io.Copy from the file itself, so net/http can hand it to sendfile.
+func copyFromFile(w io.Writer, f *os.File, size int64, offset, length int, sent func(int)) error {
+	for written := 0; written < length; {
+		pos := (int64(offset) + int64(written)) % size
+		if _, err := f.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		n, err := io.Copy(w, io.LimitReader(f, min(int64(length-written), size-pos)))
+		written += int(n)
+		sent(int(n))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestPing(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		name  string
+		start string
+	}{
+		{"unstamped", ""},
+		{"stamped", "1700000000000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/ping", nil)
+			if tt.start != "" {
+				req.Header.Set("X-Request-Start", tt.start)
+			}
+			resp, body := fetch(t, req)
+			if resp.StatusCode != http.StatusOK || string(body) != "pong" {
+				t.Fatalf("got %d %q, want 200 pong", resp.StatusCode, body)
+			}
+			if resp.ContentLength != 4 {
+				t.Errorf("Content-Length = %d, want 4", resp.ContentLength)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", got)
+			}
+			end := resp.Header.Get("X-Request-End")
+			if tt.start == "" {
+				if end != "" {
+					t.Errorf("X-Request-End = %q on an unstamped request", end)
+				}
+				return
+			}
+			if got := resp.Header.Get("X-Request-Start"); got != tt.start {
+				t.Errorf("X-Request-Start = %q, want %q", got, tt.start)
+			}
+			if us, err := strconv.ParseInt(end, 10, 64); err != nil || us <= 1700000000000000 {
+				t.Errorf("X-Request-End = %q, want a later Unix microsecond timestamp", end)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// MaxPrewarmBuffers caps the download buffers prewarm pools, whatever -max-concurrent allows
+const MaxPrewarmBuffers = 64
+
+// prewarm does the work a first download would otherwise pay for: generating the shared random
+// block from crypto/rand and the other pattern blocks every download of that pattern reuses,
+// and pooling a download buffer for each download expected to run at once, -max-concurrent
+// or else one per CPU. The pool may drop buffers on a later GC, so those only spare the first
+// downloads their allocation. /readyz fails until it returns.
+func (s *Server) prewarm(cfg *Config) {
+	start := time.Now()
+	for _, pattern := range []string{PatternRandom, PatternIncrementing, PatternText} {
+		if _, err := payloadBlock(pattern, ""); err != nil {
+			logWarn("PREWARM_ERROR", "Pattern", pattern, "Error", err)
+		}
+	}
+
+	buffers := runtime.GOMAXPROCS(0)
+	if cfg.MaxConcurrent > 0 {
+		buffers = cfg.MaxConcurrent
+	}
+	buffers = min(buffers, MaxPrewarmBuffers)
+	pooled := make([]*[]byte, buffers)
+	for i := range pooled {
+		pooled[i] = getDownloadBuffer(cfg.BufferSize, cfg.BufferSize)
+	}
+	// Put back only once all are taken, or each Get would return the buffer just put
+	for _, bp := range pooled {
+		putDownloadBuffer(bp, cfg.BufferSize)
+	}
+
+	s.warming.Store(false)
+	logInfo("PREWARM_COMPLETE", "RandomBlock", RandomBlockSize, "Buffers", buffers, "BufferSize", cfg.BufferSize,
+		"Duration", time.Since(start))
+}
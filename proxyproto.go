@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol modes selected with -proxy-protocol. An L4 load balancer such as an AWS NLB or
+// HAProxy in TCP mode prepends the header to every connection, carrying the client address the
+// server would otherwise never see.
+const (
+	ProxyProtocolOptional = "optional"
+	ProxyProtocolRequired = "required"
+)
+
+// ProxyHeaderTimeout bounds how long a new connection may take to send its PROXY header
+const ProxyHeaderTimeout = 5 * time.Second
+
+// proxyV1Prefix starts a version 1 header, a text line of at most proxyV1MaxLine bytes
+const (
+	proxyV1Prefix  = "PROXY "
+	proxyV1MaxLine = 107
+)
+
+// proxyV2Signature starts a version 2 header, followed by 4 bytes of version, command, family
+// and address length
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errNoProxyHeader = errors.New("connection did not start with a PROXY protocol header")
+
+// proxyListener reads the PROXY protocol header of every accepted connection so its RemoteAddr
+// is the client behind the load balancer. Headers are only honored from peers trustsPeer accepts.
+type proxyListener struct {
+	net.Listener
+	required   bool
+	trustsPeer func(ip string) bool
+}
+
+func newProxyListener(ln net.Listener, mode string, trustsPeer func(ip string) bool) proxyListener {
+	return proxyListener{Listener: ln, required: mode == ProxyProtocolRequired, trustsPeer: trustsPeer}
+}
+
+// Accept returns at once; the header is read by the connection's own goroutine on first use,
+// so one slow load balancer connection cannot stall the accept loop
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, br: bufio.NewReader(conn), listener: l}, nil
+}
+
+// proxyConn is an accepted connection whose PROXY header is parsed before anything else reads it
+type proxyConn struct {
+	net.Conn
+	br       *bufio.Reader
+	listener proxyListener
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+// RemoteAddr is the client address from the header, or the socket peer when there was none
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	return c.remote
+}
+
+// readHeader parses the header, closing the connection when it is malformed, missing in required
+// mode or sent by a peer that is not a trusted proxy
+func (c *proxyConn) readHeader() {
+	peer := c.Conn.RemoteAddr()
+	c.remote = peer
+
+	c.Conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	addr, err := readProxyHeader(c.br)
+	switch {
+	case (errors.Is(err, errNoProxyHeader) || isTimeout(err)) && !c.listener.required:
+		// A client that is not behind the load balancer, or is waiting for the server to speak first
+		return
+	case err == nil && !c.listener.trustsPeer(normalizeIP(peer.String())):
+		err = errors.New("PROXY protocol header from an untrusted peer")
+	}
+	if err != nil {
+		c.err = err
+		logWarn("PROXY_PROTOCOL_ERROR", "Peer", normalizeIP(peer.String()), "Error", err)
+		c.Conn.Close()
+		return
+	}
+	if addr != nil {
+		c.remote = addr
+	}
+}
+
+// readProxyHeader consumes a version 1 or 2 header from br and returns the client address it
+// names, or nil for the LOCAL and UNKNOWN forms that carry none. Bytes that are not a header
+// are left in br and reported as errNoProxyHeader.
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	// Peek one byte further at a time while the input still looks like a signature, so a client
+	// sending a short first message is never waited on for bytes it has no reason to send
+	isPrefix := func(sig []byte) (bool, error) {
+		for n := 1; n <= len(sig); n++ {
+			b, err := br.Peek(n)
+			if err != nil {
+				return false, err
+			}
+			if !bytes.Equal(b, sig[:n]) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	if v1, err := isPrefix([]byte(proxyV1Prefix)); err != nil {
+		return nil, err
+	} else if v1 {
+		return readProxyV1(br)
+	}
+	if v2, err := isPrefix(proxyV2Signature); err != nil {
+		return nil, err
+	} else if v2 {
+		return readProxyV2(br)
+	}
+	return nil, errNoProxyHeader
+}
+
+// readProxyV1 parses "PROXY TCP4 <src> <dst> <sport> <dport>\r\n" or "PROXY UNKNOWN ...\r\n"
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLine {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY v1 header longer than %d bytes", proxyV1MaxLine)
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses the binary header: signature, version and command, family and protocol,
+// address length, then the addresses and any TLVs, which are skipped
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY v2 version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	switch cmd := hdr[12] & 0x0F; cmd {
+	case 0x0:
+		// LOCAL: a health check from the load balancer itself
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", cmd)
+	}
+
+	// The high nibble is the address family, the low one TCP or UDP
+	switch family := hdr[13] >> 4; family {
+	case 0x1:
+		if len(body) < 12 {
+			return nil, errors.New("PROXY v2 IPv4 addresses truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2:
+		if len(body) < 36 {
+			return nil, errors.New("PROXY v2 IPv6 addresses truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		// AF_UNSPEC and AF_UNIX carry no IP worth reporting
+		return nil, nil
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a version 2 header with command cmd, the given family and protocol byte and
+// the raw address block
+func proxyV2(cmd, family byte, addrs []byte) []byte {
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, 0x20|cmd, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+// proxyV2TCP4 is a PROXY v2 header for a TCP over IPv4 connection from src:sport
+func proxyV2TCP4(src string, sport uint16) []byte {
+	addrs := append(net.ParseIP(src).To4(), 192, 0, 2, 1)
+	addrs = binary.BigEndian.AppendUint16(addrs, sport)
+	addrs = binary.BigEndian.AppendUint16(addrs, 80)
+	return proxyV2(0x1, 0x11, addrs)
+}
+
+// proxyV2TCP6 is a PROXY v2 header for a TCP over IPv6 connection from src:sport
+func proxyV2TCP6(src string, sport uint16) []byte {
+	addrs := append(net.ParseIP(src).To16(), net.ParseIP("2001:db8::1").To16()...)
+	addrs = binary.BigEndian.AppendUint16(addrs, sport)
+	addrs = binary.BigEndian.AppendUint16(addrs, 80)
+	return proxyV2(0x1, 0x21, addrs)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		preamble []byte
+		want     string
+		wantErr  bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 198.51.100.7 192.0.2.1 40000 80\r\n"), "198.51.100.7:40000", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 40000 80\r\n"), "[2001:db8::7]:40000", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 wrong family", []byte("PROXY TCP6 198.51.100.7 192.0.2.1 40000 80\r\n"), "", true},
+		{"v1 bad port", []byte("PROXY TCP4 198.51.100.7 192.0.2.1 70000 80\r\n"), "", true},
+		{"v1 missing fields", []byte("PROXY TCP4 198.51.100.7\r\n"), "", true},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), "", true},
+		{"v2 TCP4", proxyV2TCP4("198.51.100.7", 40000), "198.51.100.7:40000", false},
+		{"v2 TCP6", proxyV2TCP6("2001:db8::7", 40000), "[2001:db8::7]:40000", false},
+		{"v2 with TLVs", proxyV2(0x1, 0x11, append(proxyV2TCP4("198.51.100.7", 40000)[16:], 0x04, 0x00, 0x01, 0xff)),
+			"198.51.100.7:40000", false},
+		{"v2 LOCAL", proxyV2(0x0, 0x00, nil), "", false},
+		{"v2 AF_UNSPEC", proxyV2(0x1, 0x00, nil), "", false},
+		{"v2 truncated addresses", proxyV2(0x1, 0x11, []byte{198, 51, 100, 7}), "", true},
+		{"v2 bad command", proxyV2(0x2, 0x11, proxyV2TCP4("198.51.100.7", 40000)[16:]), "", true},
+		{"v2 bad version", append(append(append([]byte{}, proxyV2Signature...), 0x11, 0x11), 0, 0), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReader(io.MultiReader(bytes.NewReader(tt.preamble), strings.NewReader("GET / HTTP/1.1\r\n")))
+			addr, err := readProxyHeader(br)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readProxyHeader: %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("address = %q, want %q", got, tt.want)
+			}
+			// The header is consumed and nothing after it
+			if rest, _ := br.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("left %q after the header", rest)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderNoHeader(t *testing.T) {
+	for _, input := range []string{"GET / HTTP/1.1\r\n", "PROXY-ish", "\r\n\r\nnot v2"} {
+		br := bufio.NewReader(strings.NewReader(input))
+		if _, err := readProxyHeader(br); err != errNoProxyHeader {
+			t.Errorf("%q: %v, want errNoProxyHeader", input, err)
+		}
+		if rest, _ := io.ReadAll(br); string(rest) != input {
+			t.Errorf("%q: left %q", input, rest)
+		}
+	}
+}
+
+func TestProxyProtocolClientIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		trusted  string
+		preamble []byte
+		wantIP   string
+		wantDrop bool
+	}{
+		{"v1", ProxyProtocolOptional, "127.0.0.1", []byte("PROXY TCP4 198.51.100.7 192.0.2.1 40000 80\r\n"), "198.51.100.7", false},
+		{"v2", ProxyProtocolOptional, "127.0.0.1", proxyV2TCP4("198.51.100.7", 40000), "198.51.100.7", false},
+		{"v2 IPv6", ProxyProtocolRequired, "127.0.0.1", proxyV2TCP6("2001:db8::7", 40000), "2001:db8::7", false},
+		{"v2 LOCAL keeps the peer", ProxyProtocolRequired, "127.0.0.1", proxyV2(0x0, 0x00, nil), "127.0.0.1", false},
+		{"optional without a header", ProxyProtocolOptional, "127.0.0.1", nil, "127.0.0.1", false},
+		{"required without a header", ProxyProtocolRequired, "127.0.0.1", nil, "", true},
+		{"malformed header", ProxyProtocolOptional, "127.0.0.1", []byte("PROXY TCP4 nonsense\r\n"), "", true},
+		{"untrusted peer", ProxyProtocolOptional, "10.0.0.0/8", []byte("PROXY TCP4 198.51.100.7 192.0.2.1 40000 80\r\n"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLogs(t, LogFormatText, LevelInfo)
+			cfg := testConfig(t, "-debug-client-ip", "-trusted-proxies", tt.trusted, "-proxy-protocol", tt.mode)
+			app := NewServer(cfg)
+			ts := httptest.NewUnstartedServer(app.Handler())
+			ts.Listener = newProxyListener(ts.Listener, cfg.ProxyProtocol, app.trustsProxy)
+			ts.Start()
+			defer ts.Close()
+
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			conn.Write(tt.preamble)
+			fmt.Fprintf(conn, "GET /ping HTTP/1.1\r\nHost: test\r\n\r\n")
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if tt.wantDrop {
+				if err == nil {
+					t.Errorf("connection answered with %d, want it closed", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Header.Get(DetectedClientIPHeader); got != tt.wantIP {
+				t.Errorf("%s = %q, want %q", DetectedClientIPHeader, got, tt.wantIP)
+			}
+		})
+	}
+}
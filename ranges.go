@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	errRangeUnsatisfiable = errors.New("range not satisfiable")
+	errMultipleRanges     = errors.New("multiple ranges are not supported")
+)
+
+// parseRange parses a single-range "bytes=start-end" header against a body of size bytes,
+// returning the inclusive range to send. ok is false when the header is absent or
+// malformed, in which case the full body should be served.
+func parseRange(header string, size int) (start, end int, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return 0, 0, false, nil
+	}
+	if strings.Contains(spec, ",") {
+		return 0, 0, false, errMultipleRanges
+	}
+
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	// Suffix range "-N" asks for the last N bytes
+	if first == "" {
+		n, perr := strconv.Atoi(last)
+		if perr != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 {
+			return 0, 0, false, errRangeUnsatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true, nil
+	}
+
+	start, perr := strconv.Atoi(first)
+	if perr != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	if start >= size {
+		return 0, 0, false, errRangeUnsatisfiable
+	}
+
+	// Open-ended range "N-" runs to the end of the body
+	end = size - 1
+	if last != "" {
+		end, perr = strconv.Atoi(last)
+		if perr != nil || end < start {
+			return 0, 0, false, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		start, end int
+		ok         bool
+		err        error
+	}{
+		{"", 0, 0, false, nil},
+		{"bytes=0-99", 0, 99, true, nil},
+		{"bytes=100-", 100, 999, true, nil},
+		{"bytes=-10", 990, 999, true, nil},
+		{"bytes=-5000", 0, 999, true, nil},
+		{"bytes=900-5000", 900, 999, true, nil},
+		{"bytes=1000-", 0, 0, false, errRangeUnsatisfiable},
+		{"bytes=-0", 0, 0, false, errRangeUnsatisfiable},
+		{"bytes=0-1,5-6", 0, 0, false, errMultipleRanges},
+		{"bytes=50-10", 0, 0, false, nil},
+		{"bytes=abc", 0, 0, false, nil},
+		{"items=0-1", 0, 0, false, nil},
+	}
+	for _, tt := range tests {
+		start, end, ok, err := parseRange(tt.header, 1000)
+		if start != tt.start || end != tt.end || ok != tt.ok || err != tt.err {
+			t.Errorf("parseRange(%q, 1000) = %d, %d, %v, %v, want %d, %d, %v, %v",
+				tt.header, start, end, ok, err, tt.start, tt.end, tt.ok, tt.err)
+		}
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	full := make([]byte, 1000)
+	fillPayload(full, incrementingBlock(), 0)
+
+	tests := []struct {
+		name         string
+		header       string
+		wantCode     int
+		wantBody     []byte
+		contentRange string
+	}{
+		{"valid range", "bytes=10-19", http.StatusPartialContent, full[10:20], "bytes 10-19/1000"},
+		{"open-ended range", "bytes=990-", http.StatusPartialContent, full[990:], "bytes 990-999/1000"},
+		{"suffix range", "bytes=-5", http.StatusPartialContent, full[995:], "bytes 995-999/1000"},
+		{"unsatisfiable range", "bytes=1000-", http.StatusRequestedRangeNotSatisfiable, nil, "bytes */1000"},
+		{"no range", "", http.StatusOK, full, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?size=1000&pattern=incrementing", nil)
+			if tt.header != "" {
+				req.Header.Set("Range", tt.header)
+			}
+			resp, body := fetch(t, req)
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if got := resp.Header.Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.contentRange)
+			}
+			if tt.wantBody != nil && !bytes.Equal(body, tt.wantBody) {
+				t.Errorf("body is %d bytes not matching the requested slice", len(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanics turns a panicking handler into a logged 500 instead of a bare stack trace and a
+// dropped connection. http.ErrAbortHandler is how handlers cut a response off on purpose, so it
+// passes through, and so does every panic with -debug-panics after it has been logged.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(v)
+			}
+
+			logError("PANIC", "Client", s.getClientIP(r), "RequestID", requestIDFromContext(r.Context()),
+				"URL", r.URL.Path, "Panic", v, "Stack", string(debug.Stack()))
+			if s.config().DebugPanics {
+				panic(v)
+			}
+			// Once the response has started the status cannot change, so the client gets a cut-off body
+			if rec.status != 0 || rec.bytes > 0 {
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
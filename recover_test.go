@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		wantStatus int
+		wantBody   string
+		wantCutOff bool
+		wantLog    bool
+	}{
+		{
+			name:       "panic before the response",
+			handler:    func(http.ResponseWriter, *http.Request) { panic("boom") },
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   "internal server error\n",
+			wantLog:    true,
+		},
+		{
+			name:       "panic with an error",
+			handler:    func(http.ResponseWriter, *http.Request) { panic(errors.New("broken")) },
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   "internal server error\n",
+			wantLog:    true,
+		},
+		{
+			name: "panic midway through the body",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.Write([]byte("partial"))
+				w.(http.Flusher).Flush()
+				panic("boom")
+			},
+			wantStatus: http.StatusOK,
+			wantCutOff: true,
+			wantLog:    true,
+		},
+		{
+			name: "deliberate abort",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.Write([]byte("partial"))
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			},
+			wantStatus: http.StatusOK,
+			wantCutOff: true,
+		},
+		{
+			name:       "no panic",
+			handler:    func(w http.ResponseWriter, _ *http.Request) { io.WriteString(w, "fine") },
+			wantStatus: http.StatusOK,
+			wantBody:   "fine",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t, LogFormatText, LevelInfo)
+			s := NewServer(DefaultConfig())
+			ts := httptest.NewServer(requestID(s.recoverPanics(tt.handler)))
+			defer ts.Close()
+
+			req := newRequest(t, http.MethodGet, ts.URL+"/explode", nil)
+			req.Header.Set(RequestIDHeader, "panic-test")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantCutOff != (err != nil) {
+				t.Errorf("reading body: %v, want cut off %v", err, tt.wantCutOff)
+			}
+			if !tt.wantCutOff && string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+
+			logged := strings.Contains(logs.String(), "PANIC: Client=127.0.0.1 RequestID=panic-test URL=/explode")
+			if logged != tt.wantLog {
+				t.Errorf("PANIC logged %v, want %v:\n%s", logged, tt.wantLog, logs.String())
+			}
+		})
+	}
+}
+
+func TestRecoverPanicsKeepsServing(t *testing.T) {
+	s := NewServer(DefaultConfig())
+	calls := 0
+	ts := httptest.NewServer(s.recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("first request")
+		}
+		io.WriteString(w, "second")
+	})))
+	defer ts.Close()
+
+	for _, want := range []int{http.StatusInternalServerError, http.StatusOK} {
+		if resp, _ := fetch(t, newRequest(t, http.MethodGet, ts.URL, nil)); resp.StatusCode != want {
+			t.Errorf("status = %d, want %d", resp.StatusCode, want)
+		}
+	}
+}
+
+func TestDebugPanicsRepanics(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DebugPanics = true
+	s := NewServer(cfg)
+	h := s.recoverPanics(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { panic("boom") }))
+
+	defer func() {
+		if v := recover(); v != "boom" {
+			t.Errorf("recovered %v, want the handler's panic", v)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	t.Error("panic was swallowed with DebugPanics set")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// MaxRedirects caps the count parameter of /redirect
+const MaxRedirects = 20
+
+// redirectCodes are the status codes /redirect can answer with
+var redirectCodes = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+func (s *Server) redirectHandler(w http.ResponseWriter, r *http.Request) {
+	clientIP := s.getClientIP(r)
+	reqID := requestIDFromContext(r.Context())
+
+	count := 1
+	if v := r.URL.Query().Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > MaxRedirects {
+			logError("REDIRECT_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidCount", v)
+			http.Error(w, fmt.Sprintf("count must be between 0 and %d", MaxRedirects), http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+
+	code := http.StatusFound
+	if v := r.URL.Query().Get("code"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || !redirectCodes[n] {
+			logError("REDIRECT_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidCode", v)
+			http.Error(w, "code must be one of 301, 302, 307, 308", http.StatusBadRequest)
+			return
+		}
+		code = n
+	}
+
+	if count == 0 {
+		logInfo("REDIRECT_SUCCESS", "Client", clientIP, "RequestID", reqID)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("redirects followed"))
+		return
+	}
+
+	// Each hop keeps the chosen code, so 307 and 308 chains preserve the method and body all the way
+	next := url.Values{"count": {strconv.Itoa(count - 1)}}
+	if code != http.StatusFound {
+		next.Set("code", strconv.Itoa(code))
+	}
+	logDebug("REDIRECT_HOP", "Client", clientIP, "RequestID", reqID, "Remaining", count, "Code", code)
+	http.Redirect(w, r, "/redirect?"+next.Encode(), code)
+}
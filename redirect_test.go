@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedirect(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+
+	t.Run("single hop", func(t *testing.T) {
+		for _, code := range []int{301, 302, 307, 308} {
+			client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+			resp, err := client.Get(fmt.Sprintf("%s/redirect?count=1&code=%d", ts.URL, code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != code {
+				t.Errorf("code=%d: status = %d", code, resp.StatusCode)
+			}
+			want := "/redirect?count=0"
+			if code != http.StatusFound {
+				want = fmt.Sprintf("/redirect?code=%d&count=0", code)
+			}
+			if got := resp.Header.Get("Location"); got != want {
+				t.Errorf("code=%d: Location = %q, want %q", code, got, want)
+			}
+		}
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		hops   int
+	}{
+		{"no redirects", http.MethodGet, "count=0", 0},
+		{"default single redirect", http.MethodGet, "", 1},
+		{"chain", http.MethodGet, "count=5", 5},
+		{"307 chain keeps the method", http.MethodPost, "count=3&code=307", 3},
+		{"longest chain", http.MethodGet, fmt.Sprintf("count=%d", MaxRedirects), MaxRedirects},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var via []*http.Request
+			client := &http.Client{CheckRedirect: func(req *http.Request, v []*http.Request) error {
+				via = v
+				if len(v) > MaxRedirects {
+					return fmt.Errorf("followed %d redirects", len(v))
+				}
+				if req.Method != tt.method {
+					return fmt.Errorf("redirected as %s", req.Method)
+				}
+				return nil
+			}}
+			req := newRequest(t, tt.method, ts.URL+"/redirect?"+tt.query, strings.NewReader(""))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("landed on %d, want 200", resp.StatusCode)
+			}
+			if len(via) != tt.hops {
+				t.Errorf("followed %d redirects, want %d", len(via), tt.hops)
+			}
+		})
+	}
+
+	for _, bad := range []string{"count=-1", fmt.Sprintf("count=%d", MaxRedirects+1), "count=x", "code=303", "code=200"} {
+		if resp, _ := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/redirect?"+bad, nil)); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", bad, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import "net/http"
+
+// sensitiveHeaders are redacted from /echo unless -echo-sensitive-headers is set
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+const redacted = "[REDACTED]"
+
+// requestSummary is the JSON response of /echo
+type requestSummary struct {
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Query      map[string][]string `json:"query"`
+	Headers    map[string][]string `json:"headers"`
+	Host       string              `json:"host"`
+	Proto      string              `json:"proto"`
+	RemoteAddr string              `json:"remote_addr"`
+	ClientIP   string              `json:"client_ip"`
+	TLS        bool                `json:"tls"`
+}
+
+// reflectHandler returns what the server saw of the request, to debug clients and the proxies in between
+func (s *Server) reflectHandler(w http.ResponseWriter, r *http.Request) {
+	headers := r.Header.Clone()
+	if !s.config().EchoSensitive {
+		for _, name := range sensitiveHeaders {
+			if len(headers.Values(name)) > 0 {
+				headers[name] = []string{redacted}
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, requestSummary{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      r.URL.Query(),
+		Headers:    headers,
+		Host:       r.Host,
+		Proto:      r.Proto,
+		RemoteAddr: r.RemoteAddr,
+		ClientIP:   s.getClientIP(r),
+		TLS:        r.TLS != nil,
+	})
+}
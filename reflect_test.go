@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestReflect(t *testing.T) {
+	tests := []struct {
+		name       string
+		sensitive  bool
+		wantAuth   string
+		wantCookie string
+	}{
+		{"redacted by default", false, redacted, redacted},
+		{"sensitive headers included", true, "Bearer secret", "session=abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, "-trusted-proxies", "127.0.0.1")
+			cfg.EchoSensitive = tt.sensitive
+			_, ts := newTestServer(t, cfg)
+
+			req := newRequest(t, http.MethodPut, ts.URL+"/echo?a=1&a=2&b=x", nil)
+			req.Host = "echo.example"
+			req.Header.Set("X-Custom", "value")
+			req.Header.Set("Authorization", "Bearer secret")
+			req.Header.Set("Cookie", "session=abc")
+			req.Header.Set("X-Forwarded-For", "198.51.100.4")
+			resp, body := fetch(t, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+			var got requestSummary
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("decoding %q: %v", body, err)
+			}
+
+			if got.Method != http.MethodPut || got.Path != "/echo" || got.Host != "echo.example" ||
+				got.Proto != "HTTP/1.1" || got.TLS {
+				t.Errorf("request line reflected as %+v", got)
+			}
+			if want := map[string][]string{"a": {"1", "2"}, "b": {"x"}}; !reflect.DeepEqual(got.Query, want) {
+				t.Errorf("query = %v, want %v", got.Query, want)
+			}
+			if got.ClientIP != "198.51.100.4" || got.RemoteAddr == "" {
+				t.Errorf("client_ip = %q, remote_addr = %q", got.ClientIP, got.RemoteAddr)
+			}
+			if v := got.Headers["X-Custom"]; len(v) != 1 || v[0] != "value" {
+				t.Errorf("X-Custom = %v", v)
+			}
+			if v := got.Headers["Authorization"]; len(v) != 1 || v[0] != tt.wantAuth {
+				t.Errorf("Authorization = %v, want %q", v, tt.wantAuth)
+			}
+			if v := got.Headers["Cookie"]; len(v) != 1 || v[0] != tt.wantCookie {
+				t.Errorf("Cookie = %v, want %q", v, tt.wantCookie)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// loadEnvFile reads the ECHO_* variables listed in path, one KEY=VALUE per line. Blank lines and
+// lines starting with # are skipped, and values may be wrapped in single or double quotes.
+// The process environment is left untouched, so a variable removed from the file stops applying.
+func loadEnvFile(path string) (envVars, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars := envVars{}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !strings.HasPrefix(key, "ECHO_") {
+			return nil, fmt.Errorf("%s:%d: expected ECHO_NAME=value, got %q", path, line, text)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[key] = value
+	}
+	return vars, sc.Err()
+}
+
+// resolveConfig loads the configuration like loadConfig, with the -env-file variables applied on
+// top of the environment. Flags still take precedence over both.
+func resolveConfig(args []string) (*Config, error) {
+	cfg, err := loadConfig(args, nil)
+	if err != nil || cfg.EnvFile == "" {
+		return cfg, err
+	}
+	vars, err := loadEnvFile(cfg.EnvFile)
+	if err != nil {
+		return nil, err
+	}
+	return loadConfig(args, vars)
+}
+
+// applyLimits builds the limiters for cfg, replacing only those whose settings differ from old.
+// With old nil every limiter is built. Requests in flight keep the limiter they started with.
+func (s *Server) applyLimits(cfg, old *Config) {
+	if old == nil || cfg.MaxPerClient != old.MaxPerClient {
+		s.perClient.Store(newClientLimiter(cfg.MaxPerClient))
+	}
+	if old == nil || cfg.MaxConcurrent != old.MaxConcurrent {
+		s.inflight.Store(newConcurrencyLimiter(cfg.MaxConcurrent))
+	}
+	if old == nil || cfg.MaxEgress != old.MaxEgress {
+		s.egress.Store(newEgressLimiter(cfg.MaxEgress))
+	}
+	if old == nil || cfg.RateLimit != old.RateLimit || cfg.RateBurst != old.RateBurst {
+		l := newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+		s.rateLimit.Swap(l).retire()
+		if l != nil {
+			go l.sweep(s.shutdown)
+		}
+	}
+}
+
+// Reload applies the runtime-adjustable settings of next: sizes, limits and the log level.
+// Listeners, TLS, timeouts, auth and the other settings keep their startup values until a restart.
+func (s *Server) Reload(next *Config) {
+	old := s.config()
+	cfg := *old
+	cfg.BufferSize = next.BufferSize
+	cfg.MaxUploadSize = next.MaxUploadSize
+	cfg.MaxDownloadSize = next.MaxDownloadSize
+	cfg.DefaultDownloadSize = next.DefaultDownloadSize
+	cfg.MaxPerClient = next.MaxPerClient
+	cfg.MaxConcurrent = next.MaxConcurrent
+	cfg.RateLimit = next.RateLimit
+	cfg.RateBurst = next.RateBurst
+	cfg.MaxEgress = next.MaxEgress
+	cfg.MaxRequestDuration = next.MaxRequestDuration
+	cfg.LogLevel = next.LogLevel
+
+	s.applyLimits(&cfg, old)
+	s.cfg.Store(&cfg)
+
+	// Logged before the level changes, so raising it to warn still records the reload
+	logInfo("CONFIG_RELOADED", "BufferSize", cfg.BufferSize, "MaxUpload", cfg.MaxUploadSize,
+		"MaxDownload", cfg.MaxDownloadSize, "DefaultDownload", cfg.DefaultDownloadSize,
+		"MaxPerClient", cfg.MaxPerClient, "MaxConcurrent", cfg.MaxConcurrent, "RateLimit", cfg.RateLimit,
+		"RateBurst", cfg.RateBurst, "MaxEgress", cfg.MaxEgress, "MaxRequestDuration", cfg.MaxRequestDuration,
+		"LogLevel", cfg.LogLevel)
+	level, _ := parseLogLevel(cfg.LogLevel)
+	setLogLevel(level)
+}
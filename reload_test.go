@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestLoadEnvFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    envVars
+		wantErr bool
+	}{
+		{
+			name:    "variables, comments and quotes",
+			content: "# limits\nECHO_MAX_DOWNLOAD=1MB\n\n ECHO_RATE_LIMIT = 5 \nECHO_LOG_LEVEL=\"debug\"\nECHO_AUTH_TOKEN='a b'\n",
+			want: envVars{"ECHO_MAX_DOWNLOAD": "1MB", "ECHO_RATE_LIMIT": "5", "ECHO_LOG_LEVEL": "debug",
+				"ECHO_AUTH_TOKEN": "a b"},
+		},
+		{name: "empty", content: "", want: envVars{}},
+		{name: "not an ECHO variable", content: "PATH=/bin\n", wantErr: true},
+		{name: "no value", content: "ECHO_RATE_LIMIT\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "echo.env")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadEnvFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadEnvFile: %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadEnvFile = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSIGHUPReloadsEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "echo.env")
+	writeEnv := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeEnv("ECHO_MAX_DOWNLOAD=1MB\nECHO_DEFAULT_DOWNLOAD=1KB\n")
+	p := startProcess(t, "-env-file", path)
+
+	status := func() int {
+		t.Helper()
+		resp, _ := fetch(t, newRequest(t, http.MethodGet, p.URL+"/download?size=2MB", nil))
+		return resp.StatusCode
+	}
+	if got := status(); got != http.StatusBadRequest {
+		t.Fatalf("2MB download under a 1MB limit: status %d, want %d", got, http.StatusBadRequest)
+	}
+
+	// A download in flight across the reload must not be dropped
+	slow, err := http.Get(p.URL + "/download?size=1MB&rate=1KB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Body.Close()
+	if slow.StatusCode != http.StatusOK {
+		t.Fatalf("slow download: status %d", slow.StatusCode)
+	}
+
+	writeEnv("ECHO_MAX_DOWNLOAD=10MB\nECHO_DEFAULT_DOWNLOAD=1KB\n")
+	p.signal(t, syscall.SIGHUP)
+	reloaded := p.event(t, "CONFIG_RELOADED")
+	if reloaded["max_download"] != float64(10_000_000) {
+		t.Errorf("reload logged max_download %v, want 10000000", reloaded["max_download"])
+	}
+
+	if got := status(); got != http.StatusOK {
+		t.Errorf("2MB download after raising the limit: status %d, want %d", got, http.StatusOK)
+	}
+	if _, err := slow.Body.Read(make([]byte, 1)); err != nil {
+		t.Errorf("download started before the reload: %v", err)
+	}
+}
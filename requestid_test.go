@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRequestID(t *testing.T) {
+	logs := captureLogs(t, LogFormatText, LevelInfo)
+	_, ts := newTestServer(t, DefaultConfig())
+
+	tests := []struct {
+		name     string
+		supplied string
+		echoed   bool
+	}{
+		{"supplied", "trace-1234", true},
+		{"absent", "", false},
+		{"with spaces", "not valid", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, http.MethodGet, ts.URL+"/download?size=10", nil)
+			if tt.supplied != "" {
+				req.Header.Set(RequestIDHeader, tt.supplied)
+			}
+			resp, _ := fetch(t, req)
+			got := resp.Header.Get(RequestIDHeader)
+			if tt.echoed && got != tt.supplied {
+				t.Errorf("%s = %q, want the supplied %q", RequestIDHeader, got, tt.supplied)
+			}
+			if !tt.echoed && !uuidPattern.MatchString(got) {
+				t.Errorf("%s = %q, want a generated UUID", RequestIDHeader, got)
+			}
+			// The request's log lines carry the same ID
+			waitForLog(t, logs, "RequestID="+got)
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// subsystem is a listener serving next to the HTTP server, such as the raw TCP or UDP echo.
+// Shutdown closes it, which makes its loop return and marks it done.
+type subsystem struct {
+	name   string
+	closer io.Closer
+	done   chan struct{}
+}
+
+// startSubsystem runs loop in the background until closer is closed by Shutdown, logging
+// SUBSYSTEM_STOPPED once it returns so each part of the server can be seen stopping
+func (s *Server) startSubsystem(name string, closer io.Closer, loop func()) {
+	sub := &subsystem{name: name, closer: closer, done: make(chan struct{})}
+	s.subsystemsMu.Lock()
+	s.subsystems = append(s.subsystems, sub)
+	stopped := s.stopped
+	s.subsystemsMu.Unlock()
+	if stopped {
+		closer.Close()
+	}
+
+	go func() {
+		defer close(sub.done)
+		loop()
+		logInfo("SUBSYSTEM_STOPPED", "Name", name)
+	}()
+}
+
+// stopSubsystems closes every registered subsystem, and any registered later
+func (s *Server) stopSubsystems() {
+	s.subsystemsMu.Lock()
+	defer s.subsystemsMu.Unlock()
+	s.stopped = true
+	for _, sub := range s.subsystems {
+		sub.closer.Close()
+	}
+}
+
+// waitSubsystems blocks until every subsystem loop has returned, or fails with the ones still
+// running once ctx is done
+func (s *Server) waitSubsystems(ctx context.Context) error {
+	s.subsystemsMu.Lock()
+	subs := append([]*subsystem(nil), s.subsystems...)
+	s.subsystemsMu.Unlock()
+
+	var running []string
+	for _, sub := range subs {
+		select {
+		case <-sub.done:
+		case <-ctx.Done():
+			running = append(running, sub.name)
+		}
+	}
+	if len(running) > 0 {
+		return fmt.Errorf("%w with %s still running", ctx.Err(), strings.Join(running, ", "))
+	}
+	return nil
+}
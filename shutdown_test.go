@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		inFlight bool
+	}{
+		{"idle server stops gracefully", 5 * time.Second, false},
+		{"short timeout cuts off a download", 300 * time.Millisecond, true},
+		{"longer timeout cuts off a download", time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startProcess(t, "-shutdown-timeout", tt.timeout.String())
+			if tt.inFlight {
+				if resp := startSlowDownload(t, p.URL, nil); resp.StatusCode != http.StatusOK {
+					t.Fatalf("download status = %d", resp.StatusCode)
+				}
+			}
+
+			start := time.Now()
+			p.signal(t, syscall.SIGTERM)
+			p.wait(t, tt.timeout+5*time.Second)
+			elapsed := time.Since(start)
+
+			stopped := p.event(t, EventServerStopped)
+			if stopped["graceful"] != !tt.inFlight {
+				t.Errorf("graceful = %v, want %v", stopped["graceful"], !tt.inFlight)
+			}
+			if !tt.inFlight {
+				return
+			}
+			timedOut := p.event(t, "SERVER_SHUTDOWN_TIMEOUT")
+			if timedOut["timeout"] != tt.timeout.String() || timedOut["forced_connections"] != 1.0 {
+				t.Errorf("SERVER_SHUTDOWN_TIMEOUT = %v, want timeout %s with 1 forced connection", timedOut, tt.timeout)
+			}
+			if elapsed < tt.timeout {
+				t.Errorf("shutdown took %s, less than the %s timeout", elapsed, tt.timeout)
+			}
+		})
+	}
+}
+
+func TestDrainDelayFailsHealthWhileServing(t *testing.T) {
+	p := startProcess(t, "-drain-delay", "2s")
+
+	// A download paced to finish within the drain delay
+	resp, err := http.Get(p.URL + "/download?size=2000&rate=4KB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	p.signal(t, syscall.SIGTERM)
+	p.event(t, "SERVER_DRAINING")
+	for _, path := range []string{"/health", "/readyz"} {
+		health, body := fetch(t, newRequest(t, http.MethodGet, p.URL+path, nil))
+		if health.StatusCode != http.StatusServiceUnavailable || string(body) != "draining" {
+			t.Errorf("%s while draining: %d %q, want 503 draining", path, health.StatusCode, body)
+		}
+	}
+	if live, _ := fetch(t, newRequest(t, http.MethodGet, p.URL+"/livez", nil)); live.StatusCode != http.StatusOK {
+		t.Errorf("/livez while draining: %d, want 200", live.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || len(body) != 2000 {
+		t.Errorf("download during the drain got %d bytes (%v), want 2000", len(body), err)
+	}
+	p.wait(t, 10*time.Second)
+	if stopped := p.event(t, EventServerStopped); stopped["graceful"] != true {
+		t.Errorf("graceful = %v after draining", stopped["graceful"])
+	}
+}
+
+func TestShutdownClosesAllListeners(t *testing.T) {
+	p := startProcess(t, "-tcp-port", "127.0.0.1:0")
+	ready := p.event(t, EventServerReady)
+	tcpAddr := ready["tcp_echo"].(string)
+
+	// An idle keep-alive connection to HTTP and an open TCP echo connection
+	conns := map[string]net.Conn{}
+	for name, addr := range map[string]string{"http": strings.TrimPrefix(p.URL, "http://"), "tcp_echo": tcpAddr} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		defer conn.Close()
+		conns[name] = conn
+	}
+	fmt.Fprintf(conns["http"], "GET /ping HTTP/1.1\r\nHost: test\r\n\r\n")
+	if resp, err := http.ReadResponse(bufio.NewReader(conns["http"]), nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("ping before shutdown: %v", err)
+	}
+	io.WriteString(conns["tcp_echo"], "hello")
+	if _, err := io.ReadFull(conns["tcp_echo"], make([]byte, 5)); err != nil {
+		t.Fatalf("echo before shutdown: %v", err)
+	}
+
+	p.signal(t, syscall.SIGTERM)
+	p.wait(t, 10*time.Second)
+
+	tests := []struct {
+		name string
+		addr string
+	}{
+		{"http", strings.TrimPrefix(p.URL, "http://")},
+		{"tcp_echo", tcpAddr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(p.logs.String(), `"event":"SUBSYSTEM_STOPPED","level":"info","name":"`+tt.name+`"`) {
+				t.Errorf("no SUBSYSTEM_STOPPED for %s:\n%s", tt.name, p.logs.String())
+			}
+			conns[tt.name].SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conns[tt.name].Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("open connection: read %v, want EOF", err)
+			}
+			if conn, err := net.Dial("tcp", tt.addr); err == nil {
+				conn.Close()
+				t.Error("listener still accepts connections")
+			}
+		})
+	}
+	if stopped := p.event(t, EventServerStopped); stopped["graceful"] != true {
+		t.Errorf("graceful = %v", stopped["graceful"])
+	}
+}
+
+func TestMaxLifetimeShutsDown(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantDrain bool
+	}{
+		{"lifetime", []string{"-max-lifetime", "1s"}, false},
+		{"lifetime with a drain delay", []string{"-max-lifetime", "1s", "-drain-delay", "500ms"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := time.Now()
+			p := startProcess(t, tt.args...)
+			scheduled := p.event(t, "MAX_LIFETIME")
+			at, err := time.Parse(time.RFC3339, scheduled["shutdown_at"].(string))
+			if err != nil {
+				t.Fatalf("shutdown_at: %v", err)
+			}
+			if at.Before(started.Add(-time.Second)) || at.After(time.Now().Add(2*time.Second)) {
+				t.Errorf("shutdown_at = %s, want about a second after %s", at, started)
+			}
+
+			// A download started before the lifetime is up still completes
+			resp, err := http.Get(p.URL + "/download?size=2000&rate=2KB")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			p.wait(t, 10*time.Second)
+			body, err := io.ReadAll(resp.Body)
+			if err != nil || len(body) != 2000 {
+				t.Errorf("download got %d bytes (%v), want 2000", len(body), err)
+			}
+			p.event(t, "MAX_LIFETIME_REACHED")
+			if drained := findEvent(p.logs.String(), "SERVER_DRAINING") != nil; drained != tt.wantDrain {
+				t.Errorf("drained %v, want %v", drained, tt.wantDrain)
+			}
+			if stopped := p.event(t, EventServerStopped); stopped["graceful"] != true {
+				t.Errorf("graceful = %v", stopped["graceful"])
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits maps the accepted suffixes, lower-cased, to their multipliers: decimal for KB, MB
+// and GB, binary for KiB, MiB and GiB
+var sizeUnits = map[string]int{
+	"":    1,
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+}
+
+var errSizeOverflow = errors.New("size overflows")
+
+// parseSize parses a byte count such as "1048576", "10MB" or "1GiB". Suffixes are case-insensitive
+// and may be separated from the number by a space.
+func parseSize(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+	digits, unit := s[:i], strings.ToLower(strings.TrimSpace(s[i:]))
+	if digits == "" {
+		return 0, fmt.Errorf("size %q must start with a number", s)
+	}
+	mult, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("size %q has unknown unit %q, expected B, KB, MB, GB, KiB, MiB or GiB", s, s[i:])
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n > math.MaxInt/mult {
+		return 0, fmt.Errorf("%w: %q", errSizeOverflow, s)
+	}
+	return n * mult, nil
+}
+
+// sizeValue is a flag.Value accepting the same sizes as parseSize
+type sizeValue struct {
+	p *int
+}
+
+func (v sizeValue) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.Itoa(*v.p)
+}
+
+func (v sizeValue) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*v.p = n
+	return nil
+}
+
+// positiveQuerySize parses the named query parameter as a positive size, returning 0 when absent
+func positiveQuerySize(r *http.Request, name string) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := parseSize(v)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %d", name, n)
+	}
+	return n, nil
+}
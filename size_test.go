@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"0", 0},
+		{"104857600", 104857600},
+		{"512B", 512},
+		{"1KB", 1000},
+		{"100MB", 100 * 1000 * 1000},
+		{"1GB", 1000 * 1000 * 1000},
+		{"1KiB", 1024},
+		{"100MiB", 100 << 20},
+		{"2GiB", 2 << 30},
+		{"10mb", 10 * 1000 * 1000},
+		{"10 MiB", 10 << 20},
+		{" 64kib ", 64 << 10},
+		{strconv.Itoa(math.MaxInt), math.MaxInt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseSize(tt.in)
+			if err != nil {
+				t.Fatalf("parseSize(%q): %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseSize(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSizeInvalid(t *testing.T) {
+	tests := []struct {
+		in       string
+		overflow bool
+	}{
+		{in: ""},
+		{in: "MB"},
+		{in: "-1"},
+		{in: "1.5MB"},
+		{in: "10TB"},
+		{in: "10 M"},
+		{in: "1e6"},
+		{in: "0x10"},
+		{in: "99999999999999999999", overflow: true},
+		{in: strconv.Itoa(math.MaxInt) + "KB", overflow: true},
+		{in: strconv.Itoa(math.MaxInt/(1<<30)+1) + "GiB", overflow: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			n, err := parseSize(tt.in)
+			if err == nil {
+				t.Fatalf("parseSize(%q) = %d, want an error", tt.in, n)
+			}
+			if got := errors.Is(err, errSizeOverflow); got != tt.overflow {
+				t.Errorf("parseSize(%q): %v, overflow %v, want %v", tt.in, err, got, tt.overflow)
+			}
+		})
+	}
+}
+
+func TestSizeFlagsAndEnv(t *testing.T) {
+	cfg := testConfig(t, "-max-download", "1GB", "-max-upload", "64MiB")
+	if cfg.MaxDownloadSize != 1000*1000*1000 || cfg.MaxUploadSize != 64<<20 {
+		t.Errorf("max download %d, max upload %d", cfg.MaxDownloadSize, cfg.MaxUploadSize)
+	}
+
+	t.Setenv("ECHO_MAX_DOWNLOAD", "2GB")
+	cfg = testConfig(t)
+	if cfg.MaxDownloadSize != 2*1000*1000*1000 {
+		t.Errorf("ECHO_MAX_DOWNLOAD=2GB: max download %d", cfg.MaxDownloadSize)
+	}
+
+	if _, err := loadConfig([]string{"-max-upload", "lots"}, nil); err == nil {
+		t.Error("-max-upload lots: no error")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// serverStats is the JSON response of /stats
+type serverStats struct {
+	UptimeSeconds     float64           `json:"uptime_seconds"`
+	UploadsInFlight   int64             `json:"uploads_in_flight"`
+	DownloadsInFlight int64             `json:"downloads_in_flight"`
+	UploadBytes       int64             `json:"upload_bytes_total"`
+	DownloadBytes     int64             `json:"download_bytes_total"`
+	Requests          map[string]uint64 `json:"requests"`
+	Runtime           runtimeStats      `json:"runtime"`
+}
+
+// runtimeStats are the Go runtime figures in /stats, for capacity planning
+type runtimeStats struct {
+	Goroutines          int     `json:"goroutines"`
+	GOMAXPROCS          int     `json:"gomaxprocs"`
+	HeapAllocBytes      uint64  `json:"heap_alloc_bytes"`
+	HeapObjects         uint64  `json:"heap_objects"`
+	SysBytes            uint64  `json:"sys_bytes"`
+	NumGC               uint32  `json:"num_gc"`
+	GCPauseTotalSeconds float64 `json:"gc_pause_total_seconds"`
+}
+
+// readRuntimeStats samples the runtime. ReadMemStats briefly stops the world, so this only runs
+// when /stats is requested rather than in the background.
+func readRuntimeStats() runtimeStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return runtimeStats{
+		Goroutines:          runtime.NumGoroutine(),
+		GOMAXPROCS:          runtime.GOMAXPROCS(0),
+		HeapAllocBytes:      mem.HeapAlloc,
+		HeapObjects:         mem.HeapObjects,
+		SysBytes:            mem.Sys,
+		NumGC:               mem.NumGC,
+		GCPauseTotalSeconds: time.Duration(mem.PauseTotalNs).Seconds(),
+	}
+}
+
+// Stats returns a snapshot of the live counters
+func (m *Metrics) Stats() serverStats {
+	stats := serverStats{
+		UptimeSeconds:     time.Since(m.start).Seconds(),
+		UploadsInFlight:   m.uploadsInFlight.Load(),
+		DownloadsInFlight: m.downloadsInFlight.Load(),
+		UploadBytes:       m.uploadBytes.Load(),
+		DownloadBytes:     m.downloadBytes.Load(),
+		Requests:          make(map[string]uint64),
+		Runtime:           readRuntimeStats(),
+	}
+	for _, name := range m.endpointNames() {
+		stats.Requests[name] = m.endpoint(name).requests.Load()
+	}
+	return stats
+}
+
+// statsHandler serves the live counters as JSON for dashboards; /metrics has the same data for Prometheus
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.metrics.Stats())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// getStats fetches and decodes /stats
+func getStats(t *testing.T, url string) serverStats {
+	t.Helper()
+	resp, body := fetch(t, newRequest(t, http.MethodGet, url+"/stats", nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/stats status = %d", resp.StatusCode)
+	}
+	var stats serverStats
+	if err := json.Unmarshal(body, &stats); err != nil {
+		t.Fatalf("decoding %q: %v", body, err)
+	}
+	return stats
+}
+
+func TestStatsCounters(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	before := getStats(t, ts.URL)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodGet, "/download?size=12345", ""},
+		{http.MethodPost, "/upload", strings.Repeat("u", 678)},
+	}
+	for _, tt := range tests {
+		req := newRequest(t, tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Accept-Encoding", "identity")
+		fetch(t, req)
+	}
+
+	after := getStats(t, ts.URL)
+	if got := after.DownloadBytes - before.DownloadBytes; got != 12345 {
+		t.Errorf("download_bytes_total grew by %d, want 12345", got)
+	}
+	if got := after.UploadBytes - before.UploadBytes; got != 678 {
+		t.Errorf("upload_bytes_total grew by %d, want 678", got)
+	}
+	for _, endpoint := range []string{"download", "upload"} {
+		if got := after.Requests[endpoint] - before.Requests[endpoint]; got != 1 {
+			t.Errorf("requests[%s] grew by %d, want 1", endpoint, got)
+		}
+	}
+	if after.UploadsInFlight != 0 || after.DownloadsInFlight != 0 {
+		t.Errorf("in flight = %d uploads, %d downloads after both finished", after.UploadsInFlight,
+			after.DownloadsInFlight)
+	}
+	if after.UptimeSeconds < before.UptimeSeconds {
+		t.Errorf("uptime went from %f to %f", before.UptimeSeconds, after.UptimeSeconds)
+	}
+}
+
+func TestStatsInFlight(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	resp := startSlowDownload(t, ts.URL, nil)
+	if got := getStats(t, ts.URL).DownloadsInFlight; got != 1 {
+		t.Errorf("downloads_in_flight = %d during a download, want 1", got)
+	}
+	resp.Body.Close()
+	for i := 0; getStats(t, ts.URL).DownloadsInFlight != 0; i++ {
+		if i == 100 {
+			t.Fatal("downloads_in_flight never went back to 0")
+		}
+		waitABit()
+	}
+}
+
+func TestStatsRuntime(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	runtime.GC()
+
+	resp, body := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/stats", nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/stats status = %d", resp.StatusCode)
+	}
+	var raw struct {
+		Runtime map[string]float64 `json:"runtime"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		t.Fatalf("decoding %q: %v", body, err)
+	}
+	for _, field := range []string{"goroutines", "gomaxprocs", "heap_alloc_bytes", "heap_objects", "sys_bytes", "num_gc"} {
+		if v, ok := raw.Runtime[field]; !ok || v <= 0 {
+			t.Errorf("runtime.%s = %v (present %v), want a positive value", field, v, ok)
+		}
+	}
+	if v, ok := raw.Runtime["gc_pause_total_seconds"]; !ok || v < 0 {
+		t.Errorf("runtime.gc_pause_total_seconds = %v (present %v)", v, ok)
+	}
+	if got := int(raw.Runtime["gomaxprocs"]); got != runtime.GOMAXPROCS(0) {
+		t.Errorf("gomaxprocs = %d, want %d", got, runtime.GOMAXPROCS(0))
+	}
+
+	// Sampled per request, so goroutines serving downloads show up
+	before := getStats(t, ts.URL).Runtime.Goroutines
+	for i := 0; i < 5; i++ {
+		startSlowDownload(t, ts.URL, nil)
+	}
+	if after := getStats(t, ts.URL).Runtime.Goroutines; after < before+5 {
+		t.Errorf("goroutines %d with 5 downloads open, %d before", after, before)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	clientIP := s.getClientIP(r)
+	reqID := requestIDFromContext(r.Context())
+	codeStr := r.URL.Query().Get("code")
+
+	code, err := strconv.Atoi(codeStr)
+	if err != nil || code < 100 || code > 599 {
+		logError("STATUS_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidCode", codeStr)
+		http.Error(w, "code must be an HTTP status between 100 and 599", http.StatusBadRequest)
+		return
+	}
+	// net/http treats 101 as a final response, and without an Upgrade it is a protocol violation
+	if code == http.StatusSwitchingProtocols {
+		logError("STATUS_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidCode", codeStr)
+		http.Error(w, "code 101 needs a protocol upgrade and cannot be requested", http.StatusBadRequest)
+		return
+	}
+
+	logInfo("STATUS_SUCCESS", "Client", clientIP, "RequestID", reqID, "Code", code)
+
+	// The remaining 1xx codes are informational, so net/http follows them with the final 200
+	// when the handler returns
+	if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified {
+		w.WriteHeader(code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "%d %s", code, http.StatusText(code))
+}
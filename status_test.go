@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	tests := []struct {
+		code     string
+		wantCode int
+		wantBody string
+	}{
+		{"204", http.StatusNoContent, ""},
+		{"301", http.StatusMovedPermanently, "301 Moved Permanently"},
+		{"500", http.StatusInternalServerError, "500 Internal Server Error"},
+		{"103", http.StatusOK, ""},
+		{"101", http.StatusBadRequest, ""},
+		{"99", http.StatusBadRequest, ""},
+		{"600", http.StatusBadRequest, ""},
+		{"teapot", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			resp, err := client.Get(ts.URL + "/status?code=" + tt.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if code, _ := strconv.Atoi(tt.code); code == resp.StatusCode && string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// DefaultTCPIdleTimeout is how long a TCP echo connection may stay silent before it is closed
+const DefaultTCPIdleTimeout = 60 * time.Second
+
+// serveTCP echoes every connection accepted on ln until Shutdown closes it
+func (s *Server) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logError("TCP_ACCEPT_ERROR", "Error", err)
+			continue
+		}
+		s.connOpened()
+		go s.echoTCP(conn)
+	}
+}
+
+// echoTCP copies everything read from conn back to it until the client closes,
+// the connection idles for the configured timeout, or the server shuts down
+func (s *Server) echoTCP(conn net.Conn) {
+	cfg := s.config()
+	defer s.connClosed()
+	defer conn.Close()
+
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	logInfo("TCP_CONNECT", "Client", clientIP, "Addr", conn.LocalAddr())
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.shutdown:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	start := time.Now()
+	idle := idleConn{conn: conn, timeout: cfg.TCPIdleTimeout}
+	n, err := io.Copy(idle, idle)
+	switch {
+	case err == nil:
+		logInfo("TCP_CLOSED", "Client", clientIP, "BytesEchoed", n, "Duration", time.Since(start))
+	case isTimeout(err):
+		logWarn("TCP_IDLE_TIMEOUT", "Client", clientIP, "BytesEchoed", n, "Timeout", cfg.TCPIdleTimeout)
+	case errors.Is(err, net.ErrClosed):
+		logInfo("TCP_SHUTDOWN", "Client", clientIP, "BytesEchoed", n)
+	default:
+		logError("TCP_ERROR", "Client", clientIP, "BytesEchoed", n, "Error", err)
+	}
+}
+
+// idleConn extends the read deadline before every read and the write deadline before every
+// write, so only inactivity times out, including a client that sends but never reads its echo
+type idleConn struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (c idleConn) Read(p []byte) (int, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.conn.Read(p)
+}
+
+func (c idleConn) Write(p []byte) (int, error) {
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.conn.Write(p)
+}
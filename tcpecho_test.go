@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTCPEcho serves the TCP echo of app on a local port until the test ends
+func startTCPEcho(t *testing.T, app *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.startSubsystem("tcp_echo", ln, func() { app.serveTCP(ln) })
+	t.Cleanup(app.Shutdown)
+	return ln.Addr().String()
+}
+
+func TestTCPEcho(t *testing.T) {
+	addr := startTCPEcho(t, NewServer(DefaultConfig()))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, payload := range [][]byte{
+		[]byte("hello\n"),
+		{0, 1, 2, 255},
+		bytes.Repeat([]byte("0123456789"), 100000),
+	} {
+		// Reading concurrently keeps a large echo from filling both socket buffers
+		got := make(chan []byte)
+		go func() {
+			buf := make([]byte, len(payload))
+			io.ReadFull(conn, buf)
+			got <- buf
+		}()
+		if _, err := conn.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+		if echoed := <-got; !bytes.Equal(echoed, payload) {
+			t.Errorf("echo of %d bytes differs", len(payload))
+		}
+	}
+}
+
+func TestTCPEchoClosesConnections(t *testing.T) {
+	tests := []struct {
+		name  string
+		idle  time.Duration
+		close bool
+	}{
+		{"idle timeout", 50 * time.Millisecond, false},
+		{"shutdown", time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.TCPIdleTimeout = tt.idle
+			app := NewServer(cfg)
+			conn, err := net.Dial("tcp", startTCPEcho(t, app))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if tt.close {
+				app.Shutdown()
+			}
+			if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("read on the closed echo = %v, want EOF", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			app.Shutdown()
+			if err := app.waitSubsystems(ctx); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestTCPEchoTimesOutUnreadEcho(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TCPIdleTimeout = 100 * time.Millisecond
+	conn, err := net.Dial("tcp", startTCPEcho(t, NewServer(cfg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A client that keeps sending but never reads stalls the echo's writes, which must time out
+	// and drop the connection even though reads keep succeeding
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	chunk := make([]byte, 64*1024)
+	for {
+		if _, err := conn.Write(chunk); err != nil {
+			if isTimeout(err) {
+				t.Fatal("the server never dropped a client that does not read")
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// PacerBurst bounds how much a throttled transfer sends in one go, as a fraction of a second
+const PacerBurst = 100 * time.Millisecond
+
+// RampFullRate is the rate in bytes per second a ramp climbs to when no rate cap is set (1 Gbit/s)
+const RampFullRate = 125 * 1000 * 1000
+
+// pacer spreads a transfer over time so its average rate stays at rate bytes per second.
+// A nil pacer never waits.
+type pacer struct {
+	rate  int
+	start time.Time
+
+	// ramp is the window over which the rate climbs linearly from zero to rate;
+	// rampOnly stops pacing once the window is over
+	ramp     time.Duration
+	rampOnly bool
+}
+
+// newPacer returns a pacer for rate bytes per second, or nil when rate is not positive
+func newPacer(rate int) *pacer {
+	if rate <= 0 {
+		return nil
+	}
+	return &pacer{rate: rate, start: time.Now()}
+}
+
+// newRampPacer returns a pacer whose rate grows linearly from zero to rate over ramp, then stays
+// at rate. Without a rate it climbs to RampFullRate and stops pacing after the ramp.
+func newRampPacer(rate int, ramp time.Duration) *pacer {
+	if ramp <= 0 {
+		return newPacer(rate)
+	}
+	p := &pacer{rate: rate, start: time.Now(), ramp: ramp}
+	if rate <= 0 {
+		p.rate, p.rampOnly = RampFullRate, true
+	}
+	return p
+}
+
+// limit caps a chunk of n bytes to one burst so throttled output stays smooth
+func (p *pacer) limit(n int) int {
+	if p == nil {
+		return n
+	}
+	burst := int(int64(p.rate) * int64(PacerBurst) / int64(time.Second))
+	if burst < 1 {
+		burst = 1
+	}
+	if n > burst {
+		return burst
+	}
+	return n
+}
+
+// wait blocks until total bytes are allowed at the configured rate,
+// returning early with the context error if ctx is done
+func (p *pacer) wait(ctx context.Context, total int) error {
+	if p == nil {
+		return nil
+	}
+	return sleepContext(ctx, time.Until(p.start.Add(p.elapsed(total))))
+}
+
+// elapsed returns how long after the start total bytes are allowed
+func (p *pacer) elapsed(total int) time.Duration {
+	rate, bytes := float64(p.rate), float64(total)
+	if p.ramp == 0 {
+		return time.Duration(bytes / rate * float64(time.Second))
+	}
+
+	// During the ramp the allowance is the area under the rate line, rate*t^2/(2*ramp)
+	ramp := p.ramp.Seconds()
+	rampBytes := rate * ramp / 2
+	switch {
+	case bytes <= rampBytes:
+		return time.Duration(math.Sqrt(2*ramp*bytes/rate) * float64(time.Second))
+	case p.rampOnly:
+		return p.ramp
+	default:
+		return p.ramp + time.Duration((bytes-rampBytes)/rate*float64(time.Second))
+	}
+}
+
+// sleepContext sleeps for d or until ctx is done, whichever comes first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// egressLimiter is a token bucket shared by all downloads to cap the server's total send rate.
+// Each chunk reserves its bytes up front and waits its turn, so concurrent downloads slow down
+// evenly instead of being rejected. A nil egressLimiter never waits.
+type egressLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newEgressLimiter returns a limiter for rate bytes per second, or nil when rate is not positive
+func newEgressLimiter(rate int) *egressLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(1, float64(rate)*PacerBurst.Seconds())
+	return &egressLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// limit caps a chunk of n bytes to the bucket size
+func (l *egressLimiter) limit(n int) int {
+	if l == nil || n <= int(l.burst) {
+		return n
+	}
+	return int(l.burst)
+}
+
+// wait reserves n bytes and blocks until they may be sent, returning early if ctx is done
+func (l *egressLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	return sleepContext(ctx, d)
+}
+
+// throttledReader paces reads from an underlying reader to a fixed rate
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	pace  *pacer
+	total int
+}
+
+// newThrottledReader limits reads from r to rate bytes per second until ctx is done
+func newThrottledReader(ctx context.Context, r io.Reader, rate int) io.Reader {
+	return &throttledReader{ctx: ctx, r: r, pace: newPacer(rate)}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p[:t.pace.limit(len(p))])
+	t.total += n
+	if err != nil {
+		return n, err
+	}
+	if werr := t.pace.wait(t.ctx, t.total); werr != nil {
+		return n, werr
+	}
+	return n, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPacerElapsed(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  int
+		total int
+		want  time.Duration
+	}{
+		{"half a second", 1000, 500, 500 * time.Millisecond},
+		{"two seconds", 1000, 2000, 2 * time.Second},
+		{"nothing sent", 1000, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newPacer(tt.rate).elapsed(tt.total); got != tt.want {
+				t.Errorf("elapsed(%d) at %d B/s = %s, want %s", tt.total, tt.rate, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPacerLimitsBursts(t *testing.T) {
+	p := newPacer(10000)
+	if got := p.limit(32768); got != 1000 {
+		t.Errorf("limit at 10000 B/s = %d, want one 100ms burst of 1000", got)
+	}
+	var unlimited *pacer
+	if got := unlimited.limit(32768); got != 32768 {
+		t.Errorf("nil pacer limit = %d, want 32768", got)
+	}
+}
+
+func TestRampPacerElapsed(t *testing.T) {
+	// Ramping to 1000 B/s over 2s allows 1000 bytes during the ramp, rate*t^2/(2*ramp) by time t
+	tests := []struct {
+		name  string
+		rate  int
+		total int
+		want  time.Duration
+	}{
+		{"quarter of the ramp bytes", 1000, 250, time.Second},
+		{"end of the ramp", 1000, 1000, 2 * time.Second},
+		{"full rate after the ramp", 1000, 3000, 4 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newRampPacer(tt.rate, 2*time.Second).elapsed(tt.total); got != tt.want {
+				t.Errorf("elapsed(%d) = %s, want %s", tt.total, got, tt.want)
+			}
+		})
+	}
+	if got := newRampPacer(0, 2*time.Second).elapsed(100 * RampFullRate); got != 2*time.Second {
+		t.Errorf("rampup alone paces until %s, want it to stop pacing after the ramp", got)
+	}
+}
+
+func TestRampedDownloadSpeedsUp(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	resp, err := http.Get(ts.URL + "/download?size=10MB&rate=200KB&rampup=1s&bufsize=1KiB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Count the bytes arriving in the first and last quarter of the ramp, windows of equal length
+	const window = 250 * time.Millisecond
+	start := time.Now()
+	var early, late int
+	buf := make([]byte, 1024)
+	for time.Since(start) < 4*window {
+		n, err := resp.Body.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch since := time.Since(start); {
+		case since < window:
+			early += n
+		case since >= 3*window:
+			late += n
+		}
+	}
+	if early >= late {
+		t.Errorf("%d bytes in the first window, %d in the last, want the ramp to speed up", early, late)
+	}
+}
+
+func TestThroughputGuard(t *testing.T) {
+	type step struct {
+		n int
+		d time.Duration
+	}
+	tests := []struct {
+		name     string
+		min      int
+		steps    []step
+		wantTrip int // index of the step that trips the guard, -1 for none
+	}{
+		{"fast enough", 1000, []step{{1000, 500 * time.Millisecond}, {1000, 500 * time.Millisecond}}, -1},
+		{"too slow once the grace is up", 1000, []step{{100, 500 * time.Millisecond}, {100, 500 * time.Millisecond}}, 1},
+		{"slow start made up for", 1000, []step{{0, 900 * time.Millisecond}, {5000, 100 * time.Millisecond}}, -1},
+		{"window resets after a check", 1000, []step{{2000, time.Second}, {10, time.Second}}, 1},
+		{"disabled", 0, []step{{0, time.Hour}}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newThroughputGuard(tt.min, time.Second)
+			tripped := -1
+			for i, s := range tt.steps {
+				if err := g.observe(s.n, s.d); err != nil {
+					if !errors.Is(err, errTooSlow) {
+						t.Fatalf("step %d: %v, want errTooSlow", i, err)
+					}
+					tripped = i
+					break
+				}
+			}
+			if tripped != tt.wantTrip {
+				t.Errorf("tripped at step %d, want %d", tripped, tt.wantTrip)
+			}
+		})
+	}
+}
+
+func TestTooSlowClientsCutOff(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MinThroughput = 1000 * 1000
+	cfg.MinThroughputGrace = 200 * time.Millisecond
+	_, ts := newTestServer(t, cfg)
+	logs := captureLogs(t, LogFormatText, LevelInfo)
+
+	// A client keeping up is left alone
+	resp, body := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/download?size=10MB", nil))
+	if resp.StatusCode != http.StatusOK || len(body) != 10*1000*1000 {
+		t.Fatalf("fast download: status %d, %d bytes", resp.StatusCode, len(body))
+	}
+
+	tests := []struct {
+		name    string
+		request string
+		client  func(conn net.Conn)
+		event   string
+	}{
+		{
+			name:    "download to a stalled reader",
+			request: "GET /download?size=50MB HTTP/1.1\r\nHost: test\r\n\r\n",
+			client:  func(net.Conn) {},
+			event:   "DOWNLOAD TOO SLOW:",
+		},
+		{
+			name:    "download to a trickling reader",
+			request: "GET /download?size=50MB HTTP/1.1\r\nHost: test\r\n\r\n",
+			client: func(conn net.Conn) {
+				buf := make([]byte, 1000)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+					time.Sleep(50 * time.Millisecond)
+				}
+			},
+			event: "DOWNLOAD TOO SLOW:",
+		},
+		{
+			name:    "upload from a trickling writer",
+			request: "POST /upload HTTP/1.1\r\nHost: test\r\nContent-Length: 100000\r\n\r\n",
+			client: func(conn net.Conn) {
+				for {
+					if _, err := conn.Write([]byte("x")); err != nil {
+						return
+					}
+					time.Sleep(50 * time.Millisecond)
+				}
+			},
+			event: "UPLOAD TOO SLOW:",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			id := fmt.Sprintf("too-slow-%d", i)
+			request := strings.Replace(tt.request, "\r\n\r\n", "\r\nX-Request-ID: "+id+"\r\n\r\n", 1)
+			if _, err := io.WriteString(conn, request); err != nil {
+				t.Fatal(err)
+			}
+			go tt.client(conn)
+
+			waitForLog(t, logs, tt.event+" Client=127.0.0.1 RequestID="+id)
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// SelfSignedValidity is how long the certificate generated by -tls-self-signed stays valid
+const SelfSignedValidity = 24 * time.Hour
+
+// DefaultTLSMinVersion is the oldest TLS version accepted unless -tls-min-version says otherwise
+const DefaultTLSMinVersion = "1.2"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion maps a version such as "1.2" to its crypto/tls constant
+func parseTLSVersion(v string) (uint16, error) {
+	version, ok := tlsVersions[v]
+	if !ok {
+		return 0, fmt.Errorf("TLS version must be one of 1.0, 1.1, 1.2, 1.3, got %q", v)
+	}
+	return version, nil
+}
+
+// parseCipherSuites maps a comma-separated list of Go cipher suite names, such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, to their IDs; an empty list keeps the Go defaults.
+// Suites Go considers insecure are refused.
+func parseCipherSuites(list string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// allowsHTTP2 reports whether suites include one of the AES-128-GCM suites HTTP/2 requires of TLS 1.2
+func allowsHTTP2(suites []uint16) bool {
+	for _, id := range suites {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+// selfSignedCert generates an in-memory ECDSA certificate for localhost and 127.0.0.1.
+// It is only meant for smoke-testing HTTPS and must not be used in production.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"echo-stream self-signed"}},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(SelfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// ClientCertSubjectHeader carries the subject of the verified client certificate under -tls-client-ca
+const ClientCertSubjectHeader = "X-Client-Cert-Subject"
+
+// loadClientCAs reads the PEM certificates in path into the pool client certificates are verified against
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no PEM certificates found")
+	}
+	return pool, nil
+}
+
+// exposeClientCert tells mutual TLS clients which certificate the server verified them with
+func (s *Server) exposeClientCert(next http.Handler) http.Handler {
+	if s.config().TLSClientCA == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			w.Header().Set(ClientCertSubjectHeader, r.TLS.PeerCertificates[0].Subject.String())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelfSignedCert(t *testing.T) {
+	cert, err := selfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil || !bytes.Equal(cert.Leaf.Raw, cert.Certificate[0]) {
+		t.Fatal("Leaf is not the issued certificate")
+	}
+	if err := cert.Leaf.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+	if err := cert.Leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+
+	app := NewServer(DefaultConfig())
+	ts := httptest.NewUnstartedServer(app.Handler())
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get(ts.URL + "/download?size=1MiB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || n != 1<<20 {
+		t.Errorf("got status %d with %d bytes, want 200 with %d", resp.StatusCode, n, 1<<20)
+	}
+	if state := resp.TLS; state == nil || !bytes.Equal(state.PeerCertificates[0].Raw, cert.Certificate[0]) {
+		t.Error("server did not present the self-signed certificate")
+	}
+}
+
+// testCA is a certificate authority for issuing client certificates in tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA creates a CA and, when path is not empty, writes its certificate there as PEM
+func newTestCA(t *testing.T, name, path string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "" {
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue signs a client certificate for cn
+func (ca *testCA) issue(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsGet fetches path from the HTTPS server at p with a client using conf, which trusts any server
+// certificate so the self-signed one passes
+func tlsGet(p *serverProcess, path string, conf *tls.Config) (*http.Response, error) {
+	conf.InsecureSkipVerify = true
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+	resp, err := client.Get(strings.Replace(p.URL, "http://", "https://", 1) + path)
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestClientCertAuth(t *testing.T) {
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	trusted := newTestCA(t, "trusted CA", caPath)
+	untrusted := newTestCA(t, "untrusted CA", "")
+	p := startProcess(t, "-tls-self-signed", "-tls-client-ca", caPath)
+
+	tests := []struct {
+		name        string
+		certs       []tls.Certificate
+		wantOK      bool
+		wantSubject string
+	}{
+		{"signed by the configured CA", []tls.Certificate{trusted.issue(t, "good-client")}, true, "CN=good-client"},
+		{"signed by another CA", []tls.Certificate{untrusted.issue(t, "bad-client")}, false, ""},
+		{"no certificate", nil, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tlsGet(p, "/ping", &tls.Config{Certificates: tt.certs})
+			if !tt.wantOK {
+				if err == nil {
+					t.Fatalf("request succeeded with status %d, want the handshake refused", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status = %d", resp.StatusCode)
+			}
+			if got := resp.Header.Get(ClientCertSubjectHeader); got != tt.wantSubject {
+				t.Errorf("%s = %q, want %q", ClientCertSubjectHeader, got, tt.wantSubject)
+			}
+		})
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		client uint16
+		wantOK bool
+	}{
+		{"TLS 1.0 under the default minimum", nil, tls.VersionTLS10, false},
+		{"TLS 1.1 under the default minimum", nil, tls.VersionTLS11, false},
+		{"TLS 1.2 under the default minimum", nil, tls.VersionTLS12, true},
+		{"TLS 1.0 under a 1.2 minimum", []string{"-tls-min-version", "1.2"}, tls.VersionTLS10, false},
+		{"TLS 1.2 under a 1.3 minimum", []string{"-tls-min-version", "1.3"}, tls.VersionTLS12, false},
+		{"TLS 1.3 under a 1.3 minimum", []string{"-tls-min-version", "1.3"}, tls.VersionTLS13, true},
+		{"TLS 1.0 under a 1.0 minimum", []string{"-tls-min-version", "1.0"}, tls.VersionTLS10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startProcess(t, append([]string{"-tls-self-signed"}, tt.args...)...)
+			resp, err := tlsGet(p, "/ping", &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tt.client})
+			if !tt.wantOK {
+				if err == nil {
+					t.Fatalf("request succeeded over %s", tls.VersionName(resp.TLS.Version))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.TLS.Version != tt.client {
+				t.Errorf("negotiated %s, want %s", tls.VersionName(resp.TLS.Version), tls.VersionName(tt.client))
+			}
+		})
+	}
+}
+
+func TestTLSCipherSuites(t *testing.T) {
+	const allowlist = "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"
+	p := startProcess(t, "-tls-self-signed", "-tls-cipher-suites", allowlist)
+	policy := p.event(t, "TLS_POLICY")
+	if policy["min_version"] != DefaultTLSMinVersion || policy["cipher_suites"] != allowlist {
+		t.Errorf("TLS_POLICY = %v", policy)
+	}
+
+	tests := []struct {
+		suite  uint16
+		wantOK bool
+	}{
+		{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, true},
+		{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, true},
+		{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, false},
+		{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA, false},
+	}
+	for _, tt := range tests {
+		t.Run(tls.CipherSuiteName(tt.suite), func(t *testing.T) {
+			// The allowlist applies up to TLS 1.2; TLS 1.3 suites are not configurable
+			resp, err := tlsGet(p, "/ping", &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tt.suite}})
+			if (err == nil) != tt.wantOK {
+				t.Fatalf("request error %v, want success %v", err, tt.wantOK)
+			}
+			if err == nil && resp.TLS.CipherSuite != tt.suite {
+				t.Errorf("negotiated %s", tls.CipherSuiteName(resp.TLS.CipherSuite))
+			}
+		})
+	}
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{"defaults", nil, false},
+		{"TLS 1.3 minimum", []string{"-tls-min-version", "1.3"}, false},
+		{"unknown version", []string{"-tls-min-version", "1.4"}, true},
+		{"unknown suite", []string{"-tls-cipher-suites", "TLS_MADE_UP"}, true},
+		{"insecure suite", []string{"-tls-cipher-suites", "TLS_RSA_WITH_RC4_128_SHA"}, true},
+		{"suites HTTP/2 accepts", []string{"-tls-cipher-suites", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, false},
+		{"suites HTTP/2 refuses", []string{"-tls-cipher-suites", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}, true},
+		{"suites HTTP/2 refuses under a 1.3 minimum", []string{"-tls-min-version", "1.3", "-tls-cipher-suites",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(append([]string{"-tls-self-signed"}, tt.args...), nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadConfig: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// DefaultUDPMaxDatagram is the largest datagram the UDP echo reads, the most UDP can carry
+const DefaultUDPMaxDatagram = 65535
+
+// serveUDP writes every datagram received on pc back to its sender until Shutdown closes it.
+// Datagrams longer than the configured maximum are truncated by the kernel when read.
+func (s *Server) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, s.config().UDPMaxDatagram)
+	packets, bytesEchoed := 0, int64(0)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				logInfo("UDP_SHUTDOWN", "Packets", packets, "BytesEchoed", bytesEchoed)
+				return
+			}
+			logError("UDP_READ_ERROR", "Error", err)
+			continue
+		}
+		logDebug("UDP_PACKET", "Client", addr, "Bytes", n)
+
+		if _, err := pc.WriteTo(buf[:n], addr); err != nil {
+			logError("UDP_WRITE_ERROR", "Client", addr, "Error", err)
+			continue
+		}
+		packets++
+		bytesEchoed += int64(n)
+	}
+}
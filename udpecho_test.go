@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPEcho(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.UDPMaxDatagram = 1000
+	app := NewServer(cfg)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.startSubsystem("udp_echo", pc, func() { app.serveUDP(pc) })
+	t.Cleanup(app.Shutdown)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name     string
+		datagram []byte
+		want     int
+	}{
+		{"text", []byte("ping"), 4},
+		{"binary", []byte{0, 0xFF, 0x7F}, 3},
+		{"at the limit", bytes.Repeat([]byte{'a'}, 1000), 1000},
+		{"truncated", bytes.Repeat([]byte{'b'}, 1500), 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := conn.Write(tt.datagram); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 2000)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], tt.datagram[:tt.want]) {
+				t.Errorf("echoed %d bytes, want the first %d sent", n, tt.want)
+			}
+		})
+	}
+
+	// Shutdown closes the socket, ending the echo loop
+	app.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := app.waitSubsystems(ctx); err != nil {
+		t.Error(err)
+	}
+}
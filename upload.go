@@ -0,0 +1,500 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// uploadResult is the JSON response of /upload
+type uploadResult struct {
+	BytesReceived  int64   `json:"bytes_received"`
+	DurationMs     float64 `json:"duration_ms"`
+	ThroughputMbps float64 `json:"throughput_mbps"`
+	Checksum       string  `json:"checksum,omitempty"`
+
+	Parts []uploadPart `json:"parts,omitempty"`
+}
+
+// uploadPart describes one part of a multipart/form-data upload
+type uploadPart struct {
+	Name     string `json:"name"`
+	Filename string `json:"filename,omitempty"`
+	Bytes    int64  `json:"bytes"`
+}
+
+var errInvalidMultipart = errors.New("invalid multipart body")
+
+// Response trailers carrying the upload figures, for clients that read them instead of the body
+const (
+	UploadBytesTrailer      = "X-Upload-Bytes"
+	UploadThroughputTrailer = "X-Upload-Throughput-Mbps"
+)
+
+// declareUploadTrailers announces the upload trailers; it must run before the status is written
+func declareUploadTrailers(w http.ResponseWriter) {
+	w.Header().Set("Trailer", UploadBytesTrailer+", "+UploadThroughputTrailer)
+}
+
+// setUploadTrailers fills in the trailers declared by declareUploadTrailers
+func setUploadTrailers(w http.ResponseWriter, bytes int64, elapsed time.Duration) {
+	w.Header().Set(UploadBytesTrailer, strconv.FormatInt(bytes, 10))
+	w.Header().Set(UploadThroughputTrailer, strconv.FormatFloat(throughputMbps(bytes, elapsed), 'f', 3, 64))
+}
+
+// throughputMbps converts a byte count moved in elapsed to megabits per second. A transfer too
+// quick for the clock to measure reports 0 rather than an infinity JSON cannot encode.
+func throughputMbps(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / 1e6 / elapsed.Seconds()
+}
+
+// newUploadHash returns the hash selected by the hash query parameter, or nil when none was requested
+func newUploadHash(name string) (hash.Hash, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown hash %q", name)
+	}
+}
+
+func (s *Server) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	s.metrics.uploadsInFlight.Add(1)
+	defer s.metrics.uploadsInFlight.Add(-1)
+
+	clientIP := s.getClientIP(r)
+	reqID := requestIDFromContext(r.Context())
+
+	// Answering before the body is read tells a client waiting on "Expect: 100-continue" not to
+	// send it; net/http only sends the 100 Continue once the handler starts reading
+	if r.URL.Query().Get("reject") == "true" && strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		logInfo("UPLOAD_REJECTED", "Client", clientIP, "RequestID", reqID, "ContentLength", r.ContentLength)
+		http.Error(w, "upload rejected before the body was sent", http.StatusExpectationFailed)
+		return
+	}
+
+	// Optional drain rate in bytes per second to simulate a constrained receiver
+	rate, err := positiveQuerySize(r, "rate")
+	if err != nil {
+		logError("UPLOAD_ERROR", "Client", clientIP, "RequestID", reqID,
+			"InvalidRate", r.URL.Query().Get("rate"))
+		http.Error(w, "rate must be a positive number of bytes per second", http.StatusBadRequest)
+		return
+	}
+
+	// Hashing costs CPU, so it only happens when a digest is requested
+	digest, err := newUploadHash(r.URL.Query().Get("hash"))
+	if err != nil {
+		logError("UPLOAD_ERROR", "Client", clientIP, "RequestID", reqID,
+			"InvalidHash", r.URL.Query().Get("hash"))
+		http.Error(w, "hash must be one of md5, sha1, sha256", http.StatusBadRequest)
+		return
+	}
+
+	// Optional lower cap for this request, to test size limits without a restart
+	limit := cfg.MaxUploadSize
+	max, err := positiveQuerySize(r, "max")
+	if err != nil || max > cfg.MaxUploadSize {
+		logError("UPLOAD_ERROR", "Client", clientIP, "RequestID", reqID,
+			"InvalidMax", r.URL.Query().Get("max"), "MaxUpload", cfg.MaxUploadSize)
+		http.Error(w, fmt.Sprintf("max must be a size between 1 and %d bytes", cfg.MaxUploadSize), http.StatusBadRequest)
+		return
+	}
+	if max > 0 {
+		limit = max
+	}
+
+	// Limit request body size to prevent abuse
+	r.Body = http.MaxBytesReader(w, r.Body, int64(limit))
+	defer r.Body.Close()
+
+	// Aborts are judged on the raw body, since a truncated gzip stream fails with the same
+	// io.ErrUnexpectedEOF as a client that hung up
+	raw := &recordingReader{r: r.Body}
+	var body io.Reader = raw
+	if guard := newThroughputGuard(cfg.MinThroughput, cfg.MinThroughputGrace); guard != nil {
+		body = guardedReader{r: body, guard: guard}
+	}
+	if rate > 0 {
+		body = newThrottledReader(r.Context(), body, rate)
+	}
+
+	// Compressed uploads are counted after decompression, and the size limit is applied
+	// again to the decompressed stream so a small payload cannot expand without bound
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			logError("UPLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidGzip", err)
+			http.Error(w, "invalid gzip body", http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = http.MaxBytesReader(w, io.NopCloser(gz), int64(limit))
+	}
+
+	// Echo mode streams the body straight back instead of discarding it, hashing what it echoes
+	if r.URL.Query().Get("echo") == "true" {
+		if digest != nil {
+			body = io.TeeReader(body, digest)
+		}
+		s.echoUpload(w, r, body, raw, digest, clientIP)
+		return
+	}
+
+	// Form uploads are split into their parts, whose contents are counted and hashed
+	// without the multipart framing
+	boundary, isMultipart := multipartBoundary(r)
+	if isMultipart && boundary == "" {
+		logError("UPLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "Message", "multipart body without boundary")
+		http.Error(w, "multipart/form-data requires a boundary", http.StatusBadRequest)
+		return
+	}
+	if digest != nil && !isMultipart {
+		body = io.TeeReader(body, digest)
+	}
+
+	// Stream request body directly to discard
+	start := time.Now()
+	var parts []uploadPart
+	var bytesRead int64
+	if isMultipart {
+		parts, bytesRead, err = discardParts(body, boundary, digest)
+	} else {
+		bytesRead, err = io.Copy(io.Discard, body)
+	}
+	s.metrics.uploadBytes.Add(bytesRead)
+	if err != nil && timedOut(r) {
+		logWarn("UPLOAD_TIMEOUT", "Client", clientIP, "RequestID", reqID, "BytesRead", bytesRead,
+			"MaxDuration", cfg.MaxRequestDuration)
+		http.Error(w, "upload exceeded the maximum request duration", http.StatusRequestTimeout)
+		return
+	}
+	if errors.Is(err, errTooSlow) {
+		logWarn("UPLOAD_TOO_SLOW", "Client", clientIP, "RequestID", reqID, "BytesRead", bytesRead, "Error", err)
+		w.Header().Set("Connection", "close")
+		http.Error(w, "upload below the minimum throughput", http.StatusRequestTimeout)
+		dropConnection(w)
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		logWarn("UPLOAD_TOO_LARGE", "Client", clientIP, "RequestID", reqID, "BytesRead", bytesRead,
+			"Limit", tooLarge.Limit)
+		writeUploadTooLarge(w, r, tooLarge.Limit)
+		return
+	}
+	if errors.Is(err, errInvalidMultipart) {
+		logError("UPLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "Error", err, "BytesRead", bytesRead,
+			"Parts", len(parts))
+		http.Error(w, "invalid multipart body", http.StatusBadRequest)
+		return
+	}
+	if err != nil && clientAborted(r, raw.err) {
+		// Nobody is left to read a response
+		logWarn("UPLOAD_DISCONNECTED", "Client", clientIP, "RequestID", reqID, "BytesRead", bytesRead,
+			"Error", err)
+		return
+	}
+	if err != nil && invalidGzip(err) {
+		logError("UPLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidGzip", err, "BytesRead", bytesRead)
+		http.Error(w, "invalid gzip body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logError("UPLOAD_ERROR", "Client", clientIP, "RequestID", reqID, "Error", err, "BytesRead", bytesRead)
+		http.Error(w, "upload failed", http.StatusInternalServerError)
+		return
+	}
+	elapsed := time.Since(start)
+
+	checksum := ""
+	if digest != nil {
+		checksum = hex.EncodeToString(digest.Sum(nil))
+		w.Header().Set("X-Checksum", checksum)
+	}
+
+	for i, p := range parts {
+		logDebug("UPLOAD_PART", "Client", clientIP, "RequestID", reqID, "Part", i, "Name", p.Name,
+			"Filename", p.Filename, "Bytes", p.Bytes)
+	}
+	logInfo("UPLOAD_SUCCESS", "Client", clientIP, "RequestID", reqID, "BytesReceived", bytesRead,
+		"Parts", len(parts), "Duration", elapsed, "EffectiveRateBps", int64(float64(bytesRead)/elapsed.Seconds()))
+
+	// The same figures go out as trailers, set once the body has been written
+	declareUploadTrailers(w)
+	defer setUploadTrailers(w, bytesRead, elapsed)
+
+	// Structured results for tooling, plain "ok" for everyone else
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, uploadResult{
+			BytesReceived:  bytesRead,
+			DurationMs:     float64(elapsed) / float64(time.Millisecond),
+			ThroughputMbps: throughputMbps(bytesRead, elapsed),
+			Checksum:       checksum,
+			Parts:          parts,
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// multipartBoundary reports whether r carries a multipart/form-data body, and its boundary
+func multipartBoundary(r *http.Request) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return "", false
+	}
+	return params["boundary"], true
+}
+
+// discardParts reads a multipart body part by part, discarding the contents while counting them
+// and feeding them to digest when it is not nil. It reads from body itself rather than through
+// r.MultipartReader so the gzip, throttling and throughput wrappers still apply. Failures of
+// body are returned as is; anything else is a malformed body and wraps errInvalidMultipart.
+func discardParts(body io.Reader, boundary string, digest hash.Hash) ([]uploadPart, int64, error) {
+	src := &recordingReader{r: body}
+	mr := multipart.NewReader(src, boundary)
+
+	var dst io.Writer = io.Discard
+	if digest != nil {
+		dst = digest
+	}
+	var parts []uploadPart
+	total := int64(0)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return parts, total, nil
+		}
+		if err != nil {
+			return parts, total, src.cause(err)
+		}
+		n, err := io.Copy(dst, p)
+		total += n
+		parts = append(parts, uploadPart{Name: p.FormName(), Filename: p.FileName(), Bytes: n})
+		if err != nil {
+			return parts, total, src.cause(err)
+		}
+	}
+}
+
+// recordingReader remembers the first read error other than io.EOF, so a multipart
+// failure can be traced back to the connection or to the body format
+type recordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// cause returns the underlying read error behind a multipart error, or err marked as malformed
+func (r *recordingReader) cause(err error) error {
+	if r.err != nil {
+		return r.err
+	}
+	return fmt.Errorf("%w: %v", errInvalidMultipart, err)
+}
+
+// clientAborted reports whether a failed upload means the client went away mid-body, as opposed to
+// sending too much or sending it malformed. bodyErr is the error of the raw request body, before
+// any decompression.
+func clientAborted(r *http.Request, bodyErr error) bool {
+	return errors.Is(bodyErr, io.ErrUnexpectedEOF) || errors.Is(bodyErr, syscall.ECONNRESET) ||
+		errors.Is(bodyErr, syscall.EPIPE) || errors.Is(r.Context().Err(), context.Canceled)
+}
+
+// invalidGzip reports whether err comes from a corrupt gzip stream. A truncated one ends in
+// io.ErrUnexpectedEOF, which only reaches here when the raw body itself was read in full.
+func invalidGzip(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.As(err, &corrupt) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// dropConnection sends the response written so far and closes the connection. Closing the body
+// would otherwise first wait for the rest of it, which is what a client trickling data wants.
+// HTTP/2 resets the stream instead of draining, so there it does nothing.
+func dropConnection(w http.ResponseWriter) {
+	if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+		conn.Close()
+	}
+}
+
+// uploadLimitError is the JSON body of a 413 for an upload over its size limit
+type uploadLimitError struct {
+	Error         string `json:"error"`
+	LimitBytes    int64  `json:"limit_bytes"`
+	LimitExceeded bool   `json:"limit_exceeded"`
+}
+
+// writeUploadTooLarge answers 413 with the limit that was exceeded, in the X-Upload-Limit header and
+// the body, which is JSON for clients asking for it
+func writeUploadTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	w.Header().Set("X-Upload-Limit", strconv.FormatInt(limit, 10))
+	msg := fmt.Sprintf("upload exceeds the limit of %d bytes", limit)
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusRequestEntityTooLarge, uploadLimitError{Error: msg, LimitBytes: limit, LimitExceeded: true})
+		return
+	}
+	http.Error(w, msg, http.StatusRequestEntityTooLarge)
+}
+
+// echoUpload copies the upload body back to the client as it arrives
+func (s *Server) echoUpload(w http.ResponseWriter, r *http.Request, body io.Reader, raw *recordingReader, digest hash.Hash,
+	clientIP string) {
+	cfg := s.config()
+	reqID := requestIDFromContext(r.Context())
+	rc := http.NewResponseController(w)
+
+	// HTTP/1.x closes the request body once the response starts unless full duplex is enabled
+	if err := rc.EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logWarn("UPLOAD_ECHO_WARNING", "Client", clientIP, "RequestID", reqID, "Error", err)
+	}
+
+	// Read before writing the status so a client sending "Expect: 100-continue" gets its
+	// 100 Continue; net/http closes the body if the response starts first
+	start := time.Now()
+	first := make([]byte, cfg.BufferSize)
+	n, err := body.Read(first)
+	if err != nil && err != io.EOF && timedOut(r) {
+		logWarn("UPLOAD_TIMEOUT", "Client", clientIP, "RequestID", reqID, "BytesEchoed", 0,
+			"MaxDuration", cfg.MaxRequestDuration)
+		http.Error(w, "upload exceeded the maximum request duration", http.StatusRequestTimeout)
+		return
+	}
+	if errors.Is(err, errTooSlow) {
+		logWarn("UPLOAD_TOO_SLOW", "Client", clientIP, "RequestID", reqID, "BytesEchoed", 0, "Error", err)
+		w.Header().Set("Connection", "close")
+		http.Error(w, "upload below the minimum throughput", http.StatusRequestTimeout)
+		dropConnection(w)
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		logWarn("UPLOAD_TOO_LARGE", "Client", clientIP, "RequestID", reqID, "BytesEchoed", 0,
+			"Limit", tooLarge.Limit)
+		writeUploadTooLarge(w, r, tooLarge.Limit)
+		return
+	}
+	if err != nil && err != io.EOF && clientAborted(r, raw.err) {
+		logWarn("UPLOAD_DISCONNECTED", "Client", clientIP, "RequestID", reqID, "BytesEchoed", 0, "Error", err)
+		return
+	}
+	if err != nil && err != io.EOF && invalidGzip(err) {
+		logError("UPLOAD_ECHO_ERROR", "Client", clientIP, "RequestID", reqID, "InvalidGzip", err, "BytesEchoed", 0)
+		http.Error(w, "invalid gzip body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil && err != io.EOF {
+		logError("UPLOAD_ECHO_ERROR", "Client", clientIP, "RequestID", reqID, "Error", err, "BytesEchoed", 0)
+		http.Error(w, "upload failed", http.StatusInternalServerError)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	declareUploadTrailers(w)
+	if digest != nil {
+		// The digest is only known once the whole body has been echoed
+		w.Header().Add("Trailer", "X-Checksum")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	out := flushWriter{w: w, rc: rc}
+	bytesEchoed := int64(0)
+	if n > 0 {
+		_, err = out.Write(first[:n])
+		bytesEchoed += int64(n)
+	}
+	if err == nil {
+		var copied int64
+		copied, err = io.Copy(out, body)
+		bytesEchoed += copied
+	} else if err == io.EOF {
+		err = nil
+	}
+	s.metrics.uploadBytes.Add(bytesEchoed)
+	if err != nil && timedOut(r) {
+		logWarn("UPLOAD_TIMEOUT", "Client", clientIP, "RequestID", reqID, "BytesEchoed", bytesEchoed,
+			"MaxDuration", cfg.MaxRequestDuration)
+		return
+	}
+	if errors.Is(err, errTooSlow) {
+		logWarn("UPLOAD_TOO_SLOW", "Client", clientIP, "RequestID", reqID, "BytesEchoed", bytesEchoed,
+			"Error", err)
+		return
+	}
+	if err != nil && clientAborted(r, raw.err) {
+		logWarn("UPLOAD_DISCONNECTED", "Client", clientIP, "RequestID", reqID, "BytesEchoed", bytesEchoed,
+			"Error", err)
+		return
+	}
+	if err != nil {
+		// Headers are already sent, so the echo is cut off for the client not to take it as complete
+		logError("UPLOAD_ECHO_ERROR", "Client", clientIP, "RequestID", reqID, "Error", err,
+			"BytesEchoed", bytesEchoed)
+		abortResponse(w)
+		return
+	}
+
+	elapsed := time.Since(start)
+	setUploadTrailers(w, bytesEchoed, elapsed)
+	if digest != nil {
+		w.Header().Set("X-Checksum", hex.EncodeToString(digest.Sum(nil)))
+	}
+	logInfo("UPLOAD_ECHO_SUCCESS", "Client", clientIP, "RequestID", reqID,
+		"BytesEchoed", bytesEchoed, "Duration", elapsed)
+}
+
+// flushWriter flushes after every write so echoed data is not held in server buffers
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if err := f.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+	return n, nil
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUploadResponseShapes(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	payload := bytes.Repeat([]byte("x"), 4096)
+
+	tests := []struct {
+		name   string
+		accept string
+		json   bool
+	}{
+		{"no accept header", "", false},
+		{"plain text", "text/plain", false},
+		{"json", "application/json", true},
+		{"json among others", "text/html, application/json;q=0.9", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, http.MethodPost, ts.URL+"/upload", bytes.NewReader(payload))
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			resp, body := fetch(t, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+			if !tt.json {
+				if string(body) != "ok" {
+					t.Errorf("body = %q, want %q", body, "ok")
+				}
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			var result uploadResult
+			if err := json.Unmarshal(body, &result); err != nil {
+				t.Fatalf("decoding %q: %v", body, err)
+			}
+			if result.BytesReceived != int64(len(payload)) {
+				t.Errorf("bytes_received = %d, want %d", result.BytesReceived, len(payload))
+			}
+			if result.DurationMs < 0 || result.ThroughputMbps < 0 {
+				t.Errorf("negative duration or throughput: %+v", result)
+			}
+		})
+	}
+}
+
+func TestUploadEcho(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	payload := bytes.Repeat([]byte("echo-stream round trip\n"), 10000)
+
+	tests := []struct {
+		name        string
+		contentType string
+	}{
+		{"binary", "application/octet-stream"},
+		{"text", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, http.MethodPost, ts.URL+"/upload?echo=true", bytes.NewReader(payload))
+			req.Header.Set("Content-Type", tt.contentType)
+			resp, body := fetch(t, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if !bytes.Equal(body, payload) {
+				t.Errorf("echoed %d bytes that differ from the %d uploaded", len(body), len(payload))
+			}
+		})
+	}
+}
+
+func TestUploadChecksum(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	const payload = "The quick brown fox jumps over the lazy dog"
+
+	tests := []struct {
+		hash string
+		want string
+	}{
+		{"md5", "9e107d9d372bb6826bd81d3542a419d6"},
+		{"sha1", "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12"},
+		{"sha256", "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hash, func(t *testing.T) {
+			req := newRequest(t, http.MethodPost, ts.URL+"/upload?hash="+tt.hash, strings.NewReader(payload))
+			req.Header.Set("Accept", "application/json")
+			resp, body := fetch(t, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+			if got := resp.Header.Get("X-Checksum"); got != tt.want {
+				t.Errorf("X-Checksum = %q, want %q", got, tt.want)
+			}
+			var result uploadResult
+			if err := json.Unmarshal(body, &result); err != nil {
+				t.Fatalf("decoding %q: %v", body, err)
+			}
+			if result.Checksum != tt.want {
+				t.Errorf("checksum = %q, want %q", result.Checksum, tt.want)
+			}
+		})
+	}
+
+	t.Run("no hash", func(t *testing.T) {
+		resp, _ := fetch(t, newRequest(t, http.MethodPost, ts.URL+"/upload", strings.NewReader(payload)))
+		if got := resp.Header.Get("X-Checksum"); got != "" {
+			t.Errorf("X-Checksum = %q without a hash parameter", got)
+		}
+	})
+	t.Run("unknown hash", func(t *testing.T) {
+		resp, _ := fetch(t, newRequest(t, http.MethodPost, ts.URL+"/upload?hash=crc32", strings.NewReader(payload)))
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestUploadEchoChecksum(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	// Larger than one buffer, so the digest covers the first read and the rest of the echo
+	payload := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog\n"), 5000)
+
+	tests := []struct {
+		hash string
+		new  func() hash.Hash
+	}{
+		{"md5", md5.New},
+		{"sha1", sha1.New},
+		{"sha256", sha256.New},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hash, func(t *testing.T) {
+			resp, body := fetch(t, newRequest(t, http.MethodPost, ts.URL+"/upload?echo=true&hash="+tt.hash, bytes.NewReader(payload)))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+			if !bytes.Equal(body, payload) {
+				t.Fatalf("echoed %d bytes that differ from the %d uploaded", len(body), len(payload))
+			}
+			h := tt.new()
+			h.Write(payload)
+			want := hex.EncodeToString(h.Sum(nil))
+			if got := resp.Trailer.Get("X-Checksum"); got != want {
+				t.Errorf("X-Checksum trailer = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// gzipped compresses p for a Content-Encoding: gzip upload
+func gzipped(t *testing.T, p []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzipUpload(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxUploadSize = 1 << 20
+	_, ts := newTestServer(t, cfg)
+
+	tests := []struct {
+		name       string
+		payload    []byte
+		wantStatus int
+	}{
+		{"small", []byte("hello, gzip"), http.StatusOK},
+		{"compressible", bytes.Repeat([]byte("a"), 500000), http.StatusOK},
+		// Compresses to about 2KB on the wire, but expands past the upload limit
+		{"bomb", bytes.Repeat([]byte{0}, 2<<20), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, http.MethodPost, ts.URL+"/upload", bytes.NewReader(gzipped(t, tt.payload)))
+			req.Header.Set("Content-Encoding", "gzip")
+			req.Header.Set("Accept", "application/json")
+			resp, body := fetch(t, req)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var result uploadResult
+			if err := json.Unmarshal(body, &result); err != nil {
+				t.Fatalf("decoding %q: %v", body, err)
+			}
+			if result.BytesReceived != int64(len(tt.payload)) {
+				t.Errorf("bytes_received = %d, want the uncompressed %d", result.BytesReceived, len(tt.payload))
+			}
+		})
+	}
+}
+
+func TestUploadMaxParam(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxUploadSize = 1 << 20
+	_, ts := newTestServer(t, cfg)
+
+	tests := []struct {
+		max        string
+		size       int
+		wantStatus int
+	}{
+		{"1KB", 500, http.StatusOK},
+		{"1KiB", 1024, http.StatusOK},
+		{"1KB", 2000, http.StatusRequestEntityTooLarge},
+		{"100", 101, http.StatusRequestEntityTooLarge},
+		{"1MiB", 1 << 20, http.StatusOK},
+		{"2MiB", 10, http.StatusBadRequest},
+		{"0", 10, http.StatusBadRequest},
+		{"small", 10, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("max=%s/%d bytes", tt.max, tt.size), func(t *testing.T) {
+			req := newRequest(t, http.MethodPost, ts.URL+"/upload?max="+tt.max, bytes.NewReader(make([]byte, tt.size)))
+			resp, body := fetch(t, req)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+		})
+	}
+}
+
+func TestUploadTooLargeReportsLimit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxUploadSize = 4096
+	_, ts := newTestServer(t, cfg)
+	over := make([]byte, 10000)
+
+	tests := []struct {
+		name      string
+		query     string
+		gzip      bool
+		json      bool
+		wantLimit int64
+	}{
+		{name: "json", json: true, wantLimit: 4096},
+		{name: "json with a per-request max", query: "?max=1000", json: true, wantLimit: 1000},
+		{name: "json gzip", gzip: true, json: true, wantLimit: 4096},
+		{name: "plain text", wantLimit: 4096},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := over
+			if tt.gzip {
+				payload = gzipped(t, over)
+			}
+			req := newRequest(t, http.MethodPost, ts.URL+"/upload"+tt.query, bytes.NewReader(payload))
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			if tt.json {
+				req.Header.Set("Accept", "application/json")
+			}
+			resp, body := fetch(t, req)
+			if resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Fatalf("status = %d, want 413: %s", resp.StatusCode, body)
+			}
+			if got := resp.Header.Get("X-Upload-Limit"); got != fmt.Sprint(tt.wantLimit) {
+				t.Errorf("X-Upload-Limit = %q, want %d", got, tt.wantLimit)
+			}
+			wantMsg := fmt.Sprintf("upload exceeds the limit of %d bytes", tt.wantLimit)
+			if !tt.json {
+				if got := strings.TrimSpace(string(body)); got != wantMsg {
+					t.Errorf("body = %q, want %q", got, wantMsg)
+				}
+				return
+			}
+			var got uploadLimitError
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("decoding %q: %v", body, err)
+			}
+			want := uploadLimitError{Error: wantMsg, LimitBytes: tt.wantLimit, LimitExceeded: true}
+			if got != want {
+				t.Errorf("body = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestUploadClientDisconnect(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	logs := captureLogs(t, LogFormatText, LevelInfo)
+
+	tests := []struct {
+		name string
+		path string
+		gzip bool
+	}{
+		{"plain", "/upload", false},
+		{"echo", "/upload?echo=true", false},
+		{"gzip", "/upload", true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			id := fmt.Sprintf("disconnect-%d", i)
+			body := make([]byte, 1000)
+			encoding := ""
+			if tt.gzip {
+				body = gzipped(t, bytes.Repeat([]byte("abc"), 100000))[:500]
+				encoding = "Content-Encoding: gzip\r\n"
+			}
+			// Promise far more than is sent, then hang up mid-body
+			fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: test\r\nX-Request-ID: %s\r\n%sContent-Length: 100000\r\n\r\n",
+				tt.path, id, encoding)
+			conn.Write(body)
+			conn.Close()
+
+			waitForLog(t, logs, "UPLOAD DISCONNECTED: Client=127.0.0.1 RequestID="+id)
+		})
+	}
+}
+
+func TestUploadTruncatedGzip(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	full := gzipped(t, bytes.Repeat([]byte("abc"), 100000))
+
+	// The request itself is complete, only the gzip stream inside it is cut short
+	req := newRequest(t, http.MethodPost, ts.URL+"/upload", bytes.NewReader(full[:len(full)/2]))
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, body := fetch(t, req)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400: %s", resp.StatusCode, body)
+	}
+
+	// An echo has already sent its headers when the stream breaks, so it is cut off instead
+	req = newRequest(t, http.MethodPost, ts.URL+"/upload?echo=true", bytes.NewReader(full[:len(full)/2]))
+	req.Header.Set("Content-Encoding", "gzip")
+	echo, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Body.Close()
+	if _, err := io.ReadAll(echo.Body); err == nil {
+		t.Error("echo of a truncated gzip upload ended cleanly")
+	}
+}
+
+// multipartBody encodes parts, each a form field or, with a filename, a file
+func multipartBody(t *testing.T, parts []uploadPart) (io.Reader, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		var w io.Writer
+		var err error
+		if p.Filename != "" {
+			w, err = mw.CreateFormFile(p.Name, p.Filename)
+		} else {
+			w, err = mw.CreateFormField(p.Name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(bytes.Repeat([]byte("m"), int(p.Bytes)))
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf, mw.FormDataContentType()
+}
+
+func TestMultipartUpload(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxUploadSize = 8 << 20
+	_, ts := newTestServer(t, cfg)
+
+	tests := []struct {
+		name  string
+		parts []uploadPart
+	}{
+		{"two files", []uploadPart{
+			{Name: "first", Filename: "a.bin", Bytes: 1000},
+			{Name: "second", Filename: "b.bin", Bytes: 250000},
+		}},
+		{"a field and two files", []uploadPart{
+			{Name: "note", Bytes: 5},
+			{Name: "files", Filename: "big.bin", Bytes: 5 << 20},
+			{Name: "files", Filename: "empty.bin", Bytes: 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := multipartBody(t, tt.parts)
+			req := newRequest(t, http.MethodPost, ts.URL+"/upload", body)
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Accept", "application/json")
+			resp, respBody := fetch(t, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, respBody)
+			}
+
+			var result uploadResult
+			if err := json.Unmarshal(respBody, &result); err != nil {
+				t.Fatalf("decoding %q: %v", respBody, err)
+			}
+			if !reflect.DeepEqual(result.Parts, tt.parts) {
+				t.Errorf("parts = %+v, want %+v", result.Parts, tt.parts)
+			}
+			// The total counts the part contents, not the multipart framing
+			total := int64(0)
+			for _, p := range tt.parts {
+				total += p.Bytes
+			}
+			if result.BytesReceived != total {
+				t.Errorf("bytes_received = %d, want %d", result.BytesReceived, total)
+			}
+		})
+	}
+}
+
+func TestMultipartUploadInvalid(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxUploadSize = 1 << 20
+	_, ts := newTestServer(t, cfg)
+	tooLarge, tooLargeType := multipartBody(t, []uploadPart{{Name: "f", Filename: "huge.bin", Bytes: 2 << 20}})
+
+	tests := []struct {
+		name        string
+		body        io.Reader
+		contentType string
+		wantStatus  int
+	}{
+		{"no boundary", strings.NewReader("data"), "multipart/form-data", http.StatusBadRequest},
+		{"wrong boundary", strings.NewReader("--other\r\n\r\ndata\r\n--other--\r\n"), "multipart/form-data; boundary=expected",
+			http.StatusBadRequest},
+		{"over the upload limit", tooLarge, tooLargeType, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, http.MethodPost, ts.URL+"/upload", tt.body)
+			req.Header.Set("Content-Type", tt.contentType)
+			resp, body := fetch(t, req)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+		})
+	}
+}
+
+func TestUploadTrailers(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	payload := bytes.Repeat([]byte("t"), 300000)
+
+	tests := []struct {
+		name   string
+		path   string
+		accept string
+	}{
+		{"plain", "/upload", ""},
+		{"json", "/upload", "application/json"},
+		{"echo", "/upload?echo=true", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest(t, http.MethodPost, ts.URL+tt.path, bytes.NewReader(payload))
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			// The trailers are announced up front, and only have values once the body is consumed
+			for _, name := range []string{UploadBytesTrailer, UploadThroughputTrailer} {
+				if v, ok := resp.Trailer[name]; !ok || len(v) != 0 {
+					t.Errorf("trailer %s before the body = %q (declared %v), want declared and empty", name, v, ok)
+				}
+			}
+			if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := resp.Trailer.Get(UploadBytesTrailer); got != fmt.Sprint(len(payload)) {
+				t.Errorf("%s = %q, want %d", UploadBytesTrailer, got, len(payload))
+			}
+			mbps, err := strconv.ParseFloat(resp.Trailer.Get(UploadThroughputTrailer), 64)
+			if err != nil || mbps <= 0 {
+				t.Errorf("%s = %q, want a positive rate", UploadThroughputTrailer, resp.Trailer.Get(UploadThroughputTrailer))
+			}
+		})
+	}
+}
+
+// readCounter counts the bytes read through it
+type readCounter struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestUploadExpectContinue(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 10 * time.Second}}
+	const size = 100000
+
+	tests := []struct {
+		name       string
+		query      string
+		expect     bool
+		wantStatus int
+		wantSent   bool
+	}{
+		{"accepted", "", true, http.StatusOK, true},
+		{"rejected", "?reject=true", true, http.StatusExpectationFailed, false},
+		{"reject without the expectation", "?reject=true", false, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &readCounter{r: bytes.NewReader(make([]byte, size))}
+			req := newRequest(t, http.MethodPost, ts.URL+"/upload"+tt.query, body)
+			req.ContentLength = size
+			if tt.expect {
+				req.Header.Set("Expect", "100-continue")
+			}
+			start := time.Now()
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if sent := body.n.Load() == size; sent != tt.wantSent {
+				t.Errorf("client sent %d of %d body bytes, want the body sent %v", body.n.Load(), size, tt.wantSent)
+			}
+			// The client got its answer instead of waiting out ExpectContinueTimeout
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("request took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestUploadExpectContinueOnTheWire(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{"accepted", "", http.StatusOK},
+		{"rejected", "?reject=true", http.StatusExpectationFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprintf(conn, "POST /upload%s HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n", tt.query)
+
+			// Nothing of the body has been sent, so the first response decides whether it will be
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if resp.StatusCode != tt.wantStatus {
+					t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusContinue {
+				t.Fatalf("status = %d, want 100 Continue", resp.StatusCode)
+			}
+			io.WriteString(conn, "hello")
+			if resp, err = http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusOK {
+				t.Errorf("after sending the body: %v, status %d", err, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestThroughputMbps(t *testing.T) {
+	tests := []struct {
+		bytes   int64
+		elapsed time.Duration
+		want    float64
+	}{
+		{1000000, time.Second, 8},
+		{125000, 100 * time.Millisecond, 10},
+		{1000, 0, 0},
+		{0, 0, 0},
+		{1000, -time.Millisecond, 0},
+	}
+	for _, tt := range tests {
+		got := throughputMbps(tt.bytes, tt.elapsed)
+		if got != tt.want {
+			t.Errorf("throughputMbps(%d, %s) = %v, want %v", tt.bytes, tt.elapsed, got, tt.want)
+		}
+		if _, err := json.Marshal(got); err != nil {
+			t.Errorf("throughputMbps(%d, %s) cannot be encoded: %v", tt.bytes, tt.elapsed, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		name                       string
+		version, commit, buildTime string
+	}{
+		{"defaults", "dev", "unknown", "unknown"},
+		{"set with -ldflags", "1.2.3", "0123abc", "2024-01-02T03:04:05Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := [3]string{version, commit, buildTime}
+			version, commit, buildTime = tt.version, tt.commit, tt.buildTime
+			t.Cleanup(func() { version, commit, buildTime = saved[0], saved[1], saved[2] })
+			_, ts := newTestServer(t, DefaultConfig())
+
+			resp, body := fetch(t, newRequest(t, http.MethodGet, ts.URL+"/version", nil))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			var got map[string]string
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("decoding %q: %v", body, err)
+			}
+			want := map[string]string{"version": tt.version, "commit": tt.commit, "build_time": tt.buildTime}
+			if len(got) != len(want) {
+				t.Errorf("keys = %v, want exactly %v", got, want)
+			}
+			for k, v := range want {
+				if got[k] != v {
+					t.Errorf("%s = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestVersionLoggedAtStartup(t *testing.T) {
+	p := startProcess(t)
+	if starting := p.event(t, "SERVER_STARTING"); starting["version"] != version || starting["commit"] != commit {
+		t.Errorf("SERVER_STARTING = %v, want version %s commit %s", starting, version, commit)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal RFC 6455 server, just enough to echo messages without pulling in a dependency.
+// Frames are echoed one by one, so fragmented messages come back fragmented the same way.
+
+// DefaultWSIdleTimeout is how long a WebSocket may go without a frame before it is closed
+const DefaultWSIdleTimeout = 60 * time.Second
+
+// wsGUID is the fixed key suffix from RFC 6455 section 1.3
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// WebSocket close codes sent by the server
+const (
+	wsCloseGoingAway = 1001
+	wsCloseProtocol  = 1002
+	wsCloseTooBig    = 1009
+)
+
+// wsMaxControlFrame is the largest payload allowed in close, ping and pong frames
+const wsMaxControlFrame = 125
+
+// wsFrame is a single decoded frame; payload is already unmasked
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+var errWSTooBig = errors.New("websocket frame exceeds size limit")
+
+// wsConn serializes writes so the shutdown close frame cannot interleave with an echo
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	mu   sync.Mutex
+}
+
+func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config()
+	clientIP := s.getClientIP(r)
+	reqID := requestIDFromContext(r.Context())
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		logError("WS_ERROR", "Client", clientIP, "RequestID", reqID, "Message", "not a websocket upgrade")
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		logError("WS_ERROR", "Client", clientIP, "RequestID", reqID,
+			"Version", r.Header.Get("Sec-WebSocket-Version"))
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		logError("WS_ERROR", "Client", clientIP, "RequestID", reqID, "Message", "hijack failed", "Error", err)
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	s.connOpened()
+	defer s.connClosed()
+	defer conn.Close()
+
+	// The server's read and write timeouts no longer apply once the connection is ours
+	conn.SetDeadline(time.Time{})
+
+	accept := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(accept[:]))
+	if err := brw.Flush(); err != nil {
+		logError("WS_ERROR", "Client", clientIP, "RequestID", reqID, "Message", "handshake failed",
+			"Error", err)
+		return
+	}
+
+	ws := &wsConn{conn: conn, br: brw.Reader}
+	start := time.Now()
+
+	// On shutdown say goodbye and unblock the pending read
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.shutdown:
+			ws.writeClose(wsCloseGoingAway, "server shutting down")
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	messages, bytesEchoed := 0, int64(0)
+	for {
+		conn.SetReadDeadline(time.Now().Add(cfg.WSIdleTimeout))
+		f, err := ws.readFrame(cfg.MaxUploadSize)
+		if err != nil {
+			switch {
+			case errors.Is(err, errWSTooBig):
+				ws.writeClose(wsCloseTooBig, "message too big")
+				logError("WS_ERROR", "Client", clientIP, "RequestID", reqID, "Error", err)
+			case errors.Is(err, io.EOF):
+				logWarn("WS_DISCONNECTED", "Client", clientIP, "RequestID", reqID,
+					"Messages", messages, "BytesEchoed", bytesEchoed)
+			case errors.Is(err, net.ErrClosed), isTimeout(err):
+				select {
+				case <-s.shutdown:
+					logInfo("WS_SHUTDOWN", "Client", clientIP, "RequestID", reqID,
+						"Messages", messages, "BytesEchoed", bytesEchoed)
+				default:
+					ws.writeClose(wsCloseGoingAway, "idle timeout")
+					logWarn("WS_IDLE_TIMEOUT", "Client", clientIP, "RequestID", reqID,
+						"Timeout", cfg.WSIdleTimeout)
+				}
+			default:
+				ws.writeClose(wsCloseProtocol, "protocol error")
+				logError("WS_ERROR", "Client", clientIP, "RequestID", reqID, "Error", err)
+			}
+			return
+		}
+
+		switch f.opcode {
+		case wsText, wsBinary, wsContinuation:
+			err = ws.writeFrame(f.fin, f.opcode, f.payload)
+			if f.fin {
+				messages++
+			}
+			bytesEchoed += int64(len(f.payload))
+		case wsPing:
+			err = ws.writeFrame(true, wsPong, f.payload)
+		case wsPong:
+		case wsClose:
+			// Echo the status code back to complete the closing handshake
+			ws.writeFrame(true, wsClose, f.payload)
+			logInfo("WS_CLOSED", "Client", clientIP, "RequestID", reqID, "Messages", messages,
+				"BytesEchoed", bytesEchoed, "Duration", time.Since(start))
+			return
+		default:
+			ws.writeClose(wsCloseProtocol, "unknown opcode")
+			logError("WS_ERROR", "Client", clientIP, "RequestID", reqID, "Opcode", f.opcode)
+			return
+		}
+		if err != nil {
+			logError("WS_WRITE_ERROR", "Client", clientIP, "RequestID", reqID, "Error", err)
+			return
+		}
+	}
+}
+
+// readFrame reads one client frame, rejecting unmasked frames and payloads above max bytes
+func (c *wsConn) readFrame(max int) (wsFrame, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return wsFrame{}, err
+	}
+	f := wsFrame{fin: hdr[0]&0x80 != 0, opcode: hdr[0] & 0x0F}
+	if hdr[0]&0x70 != 0 {
+		return f, errors.New("reserved bits set without a negotiated extension")
+	}
+	if hdr[1]&0x80 == 0 {
+		return f, errors.New("client frames must be masked")
+	}
+
+	length := uint64(hdr[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if f.opcode >= wsClose && (length > wsMaxControlFrame || !f.fin) {
+		return f, errors.New("invalid control frame")
+	}
+	if length > uint64(max) {
+		return f, errWSTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return f, err
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.payload); err != nil {
+		return f, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+// writeFrame sends an unmasked server frame
+func (c *wsConn) writeFrame(fin bool, opcode byte, payload []byte) error {
+	hdr := make([]byte, 2, 10)
+	hdr[0] = opcode
+	if fin {
+		hdr[0] |= 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xFFFF:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.conn.Write(hdr); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// writeClose sends a close frame with a status code and reason
+func (c *wsConn) writeClose(code uint16, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	return c.writeFrame(true, wsClose, append(payload, reason...))
+}
+
+// headerHasToken reports whether the comma-separated header name contains token, ignoring case
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isTimeout reports whether err is a network timeout such as an expired deadline
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsTestClient is the client side of a WebSocket, just enough to drive the echo endpoint
+type wsTestClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// dialWS opens a WebSocket to the /ws endpoint of the test server at url
+func dialWS(t *testing.T, url string) *wsTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status = %d", resp.StatusCode)
+	}
+	// The accept value for this key is the example from RFC 6455 section 1.3
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept = %q", got)
+	}
+	return &wsTestClient{conn: conn, br: br}
+}
+
+// send writes a single masked frame
+func (c *wsTestClient) send(t *testing.T, opcode byte, payload []byte) {
+	t.Helper()
+	hdr := []byte{0x80 | opcode, 0x80}
+	switch n := len(payload); {
+	case n < 126:
+		hdr[1] |= byte(n)
+	case n <= 0xFFFF:
+		hdr[1] |= 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] |= 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ mask[i%4]
+	}
+	if _, err := c.conn.Write(append(append(hdr, mask...), masked...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive reads a single unmasked server frame
+func (c *wsTestClient) receive(t *testing.T) (opcode byte, payload []byte) {
+	t.Helper()
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := uint64(hdr[1] & 0x7F)
+	if length >= 126 {
+		ext := make([]byte, 2)
+		if length == 127 {
+			ext = make([]byte, 8)
+		}
+		if _, err := io.ReadFull(c.br, ext); err != nil {
+			t.Fatal(err)
+		}
+		length = 0
+		for _, b := range ext {
+			length = length<<8 | uint64(b)
+		}
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return hdr[0] & 0x0F, payload
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	_, ts := newTestServer(t, DefaultConfig())
+	ws := dialWS(t, ts.URL)
+
+	tests := []struct {
+		name    string
+		opcode  byte
+		payload []byte
+		want    byte
+	}{
+		{"text", wsText, []byte("hello, websocket"), wsText},
+		{"empty", wsText, nil, wsText},
+		{"binary 16-bit length", wsBinary, bytes.Repeat([]byte{0xAB}, 1000), wsBinary},
+		{"binary 64-bit length", wsBinary, bytes.Repeat([]byte{0xCD}, 70000), wsBinary},
+		{"ping", wsPing, []byte("are you there"), wsPong},
+	}
+	for _, tt := range tests {
+		ws.send(t, tt.opcode, tt.payload)
+		opcode, payload := ws.receive(t)
+		if opcode != tt.want || !bytes.Equal(payload, tt.payload) {
+			t.Errorf("%s: got opcode %#x with %d bytes, want %#x with %d", tt.name, opcode, len(payload),
+				tt.want, len(tt.payload))
+		}
+	}
+
+	// The closing handshake echoes the status code
+	closing := binary.BigEndian.AppendUint16(nil, 1000)
+	ws.send(t, wsClose, closing)
+	if opcode, payload := ws.receive(t); opcode != wsClose || !bytes.Equal(payload, closing) {
+		t.Errorf("close: got opcode %#x payload %v", opcode, payload)
+	}
+}
+
+func TestWebSocketClosedOnTimeoutAndShutdown(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.WSIdleTimeout = 50 * time.Millisecond
+	_, ts := newTestServer(t, cfg)
+	idle := dialWS(t, ts.URL)
+	if opcode, payload := idle.receive(t); opcode != wsClose || binary.BigEndian.Uint16(payload) != wsCloseGoingAway {
+		t.Errorf("idle: got opcode %#x payload %q, want a going-away close", opcode, payload)
+	}
+
+	app, ts := newTestServer(t, DefaultConfig())
+	open := dialWS(t, ts.URL)
+	open.send(t, wsText, []byte("still here"))
+	open.receive(t)
+	app.Shutdown()
+	if opcode, payload := open.receive(t); opcode != wsClose || binary.BigEndian.Uint16(payload) != wsCloseGoingAway {
+		t.Errorf("shutdown: got opcode %#x payload %q, want a going-away close", opcode, payload)
+	}
+}